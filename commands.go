@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/controller"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/plan"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	ErrInvalidObjectKey = errors.New("Expected a single namespace/name argument.")
+	ErrNotExported      = errors.New("The remote object isn't exported, it needs the fair.com/cross-cluster=true label.")
+	ErrPurgeCluster     = errors.New("The cluster to purge followers of is required.")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] [command]
+
+Runs the controller if no command is given.
+
+Commands:
+  plan			Print the changes the controller would make to the local cluster, without writing them
+  list			List the exported and followed services in both clusters
+  diff namespace/name	Show the remote service and endpoints, the expected followers and the actual followers
+  sync namespace/name	Reconcile the followers of a single remote service
+  purge --cluster name	Delete every follower created from the named remote cluster. Followers that don't record
+			their cluster are listed, and only deleted with --unannotated
+  purge-finalizers	Remove this cluster's finalizer from every remote service and endpoints. Run it after
+			turning off --remote-finalizers. Needs the remote write kubeconfig and cluster name
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// Lists both clusters, runs the transformers and prints what would change in the local cluster
+func runPlan(localClient, remoteClient kubernetes.Interface) {
+	planner := plan.New(localClient, remoteClient, serviceTransformers(localClient, remoteClient), endpointsTransformers(localClient, remoteClient))
+	changes, err := planner.Plan()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	if len(changes) == 0 {
+		fmt.Println("No changes")
+		return
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+}
+
+// Lists the exported and followed services in both clusters
+func runList(localClient, remoteClient kubernetes.Interface) {
+	clusters := []struct {
+		Name   string
+		Client kubernetes.Interface
+	}{
+		{Name: nameOr(clusterName, "local"), Client: localClient},
+		{Name: nameOr(remoteClusterName, "remote"), Client: remoteClient},
+	}
+	roles := []struct {
+		Name     string
+		Selector string
+	}{
+		{Name: "exported", Selector: k8.CrossClusterRemoteLabel},
+		{Name: "followed", Selector: k8.CrossClusterLocalLabel},
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tROLE\tNAMESPACE\tNAME\tSOURCE")
+	for _, cluster := range clusters {
+		for _, role := range roles {
+			list, err := cluster.Client.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{LabelSelector: role.Selector})
+			if err != nil {
+				logger.Fatal(err.Error())
+			}
+			for _, svc := range list.Items {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", cluster.Name, role.Name, svc.ObjectMeta.Namespace, svc.Name,
+					svc.ObjectMeta.Annotations[k8.CrossClusterSourceAnnotationKey])
+			}
+		}
+	}
+	w.Flush()
+}
+
+// Shows the remote objects, the followers the controller expects to create from them and the actual followers
+func runDiff(localClient, remoteClient kubernetes.Interface, args []string) {
+	namespace, name, err := parseObjectKey(args)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	remoteService, err := getExportedService(remoteClient, namespace, name)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	var expectedService, localService *v1.Service
+	if remoteService != nil {
+		req := &k8.ServiceRequest{Type: k8.RequestTypeUpdate, RemoteService: remoteService}
+		if err := controller.TransformService(req, serviceTransformers(localClient, remoteClient)...); err != nil {
+			logger.Fatal(err.Error())
+		}
+		expectedService = req.LocalService
+		// The transformers can move the follower, so it's looked up where they put it
+		localService, err = getService(localClient, expectedService.ObjectMeta.Namespace, expectedService.Name)
+	} else {
+		localService, err = findServiceFollower(localClient, namespace, name)
+	}
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	printObject("Remote service", remoteService)
+	printObject("Expected follower service", expectedService)
+	printObject("Actual follower service", localService)
+	if expectedService != nil {
+		if localService == nil {
+			localService = &v1.Service{}
+		}
+		printFieldChanges(k8.DiffServices(localService, expectedService))
+	}
+
+	remoteEndpoints, err := getExportedEndpoints(remoteClient, namespace, name)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	var expectedEndpoints, localEndpoints *v1.Endpoints
+	if remoteEndpoints != nil {
+		req := &k8.EndpointsRequest{Type: k8.RequestTypeUpdate, RemoteEndpoints: remoteEndpoints}
+		if err := controller.TransformEndpoints(req, endpointsTransformers(localClient, remoteClient)...); err != nil {
+			logger.Fatal(err.Error())
+		}
+		expectedEndpoints = req.LocalEndpoints
+		localEndpoints, err = getEndpoints(localClient, expectedEndpoints.ObjectMeta.Namespace, expectedEndpoints.Name)
+	} else {
+		localEndpoints, err = findEndpointsFollower(localClient, namespace, name)
+	}
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	printObject("Remote endpoints", remoteEndpoints)
+	printObject("Expected follower endpoints", expectedEndpoints)
+	printObject("Actual follower endpoints", localEndpoints)
+	if expectedEndpoints != nil {
+		if localEndpoints == nil {
+			localEndpoints = &v1.Endpoints{}
+		}
+		printFieldChanges(k8.DiffEndpoints(localEndpoints, expectedEndpoints))
+	}
+}
+
+// Reconciles the followers of a single remote service. If the remote service no longer exists, its followers are deleted
+func runSync(localClient, remoteClient kubernetes.Interface, args []string) {
+	namespace, name, err := parseObjectKey(args)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	serviceWriter, endpointsWriter := syncWriters(localClient)
+
+	remoteService, err := getExportedService(remoteClient, namespace, name)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	if remoteService == nil {
+		var localService *v1.Service
+		localService, err = findServiceFollower(localClient, namespace, name)
+		if err == nil && localService != nil {
+			err = serviceWriter.Write(context.Background(), &k8.ServiceRequest{Type: k8.RequestTypeDelete, LocalService: localService})
+		}
+	} else {
+		req := &k8.ServiceRequest{Type: k8.RequestTypeUpdate, RemoteService: remoteService}
+		if err = controller.TransformService(req, serviceTransformers(localClient, remoteClient)...); err == nil {
+			err = serviceWriter.Write(context.Background(), req)
+		}
+	}
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	remoteEndpoints, err := getExportedEndpoints(remoteClient, namespace, name)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	if remoteEndpoints == nil {
+		var localEndpoints *v1.Endpoints
+		localEndpoints, err = findEndpointsFollower(localClient, namespace, name)
+		if err == nil && localEndpoints != nil {
+			err = endpointsWriter.Write(context.Background(), &k8.EndpointsRequest{Type: k8.RequestTypeDelete, LocalEndpoints: localEndpoints})
+		}
+	} else {
+		req := &k8.EndpointsRequest{Type: k8.RequestTypeUpdate, RemoteEndpoints: remoteEndpoints}
+		if err = controller.TransformEndpoints(req, endpointsTransformers(localClient, remoteClient)...); err == nil {
+			err = endpointsWriter.Write(context.Background(), req)
+		}
+	}
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	fmt.Printf("Synced %s/%s\n", namespace, name)
+}
+
+// Deletes every follower that was created from the given remote cluster
+func runPurge(localClient kubernetes.Interface, args []string) {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	cluster := flags.String("cluster", "", "Name of the remote cluster to delete the followers of")
+	unannotated := flags.Bool("unannotated", false, "Also delete followers that don't record the cluster they were created from")
+	flags.Parse(args)
+	if *cluster == "" {
+		logger.Fatal(ErrPurgeCluster.Error())
+	}
+	if err := purgeFollowers(localClient, *cluster, *unannotated, os.Stdout); err != nil {
+		logger.Fatal(err.Error())
+	}
+}
+
+// Followers created before the source annotation was added, or by a controller without a remote cluster name, don't
+// record where they came from. They're only deleted if asked to, otherwise they're listed so they aren't missed
+func purgeFollowers(localClient kubernetes.Interface, cluster string, unannotated bool, out io.Writer) error {
+	serviceWriter, endpointsWriter := syncWriters(localClient)
+	skipped := 0
+
+	services, err := localClient.CoreV1().Services(metav1.NamespaceAll).List(k8.LocalFilter)
+	if err != nil {
+		return err
+	}
+	for i := range services.Items {
+		svc := &services.Items[i]
+		source, annotated := svc.ObjectMeta.Annotations[k8.CrossClusterSourceAnnotationKey]
+		switch {
+		case !annotated && !unannotated:
+			fmt.Fprintf(out, "Skipped service %s/%s without a source cluster\n", svc.ObjectMeta.Namespace, svc.Name)
+			skipped++
+			continue
+		case annotated && source != cluster:
+			continue
+		}
+		if err := serviceWriter.Write(context.Background(), &k8.ServiceRequest{Type: k8.RequestTypeDelete, LocalService: svc}); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Deleted service %s/%s\n", svc.ObjectMeta.Namespace, svc.Name)
+	}
+
+	endpoints, err := localClient.CoreV1().Endpoints(metav1.NamespaceAll).List(k8.LocalFilter)
+	if err != nil {
+		return err
+	}
+	for i := range endpoints.Items {
+		ep := &endpoints.Items[i]
+		source, annotated := ep.ObjectMeta.Annotations[k8.CrossClusterSourceAnnotationKey]
+		switch {
+		case !annotated && !unannotated:
+			fmt.Fprintf(out, "Skipped endpoints %s/%s without a source cluster\n", ep.ObjectMeta.Namespace, ep.Name)
+			skipped++
+			continue
+		case annotated && source != cluster:
+			continue
+		}
+		if err := endpointsWriter.Write(context.Background(), &k8.EndpointsRequest{Type: k8.RequestTypeDelete, LocalEndpoints: ep}); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Deleted endpoints %s/%s\n", ep.ObjectMeta.Namespace, ep.Name)
+	}
+
+	if skipped > 0 {
+		logger.Warn("Some followers don't record the cluster they were created from and were left in place, pass --unannotated to delete them too",
+			zap.Int("skipped", skipped))
+	}
+	return nil
+}
+
+// Removes the finalizer --remote-finalizers added from every remote object, so turning it off doesn't leave remote
+// objects stuck once they're deleted
+func runPurgeFinalizers() {
+	writer, err := setupFinalizerWriter(remoteWriteKubeconfig)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	if err := purgeFinalizers(writer, os.Stdout); err != nil {
+		logger.Fatal(err.Error())
+	}
+}
+
+// Every remote object is checked rather than just the exported ones, since an object can stop being exported while
+// it still has the finalizer. Respects the dry run flag
+func purgeFinalizers(writer *k8.FinalizerWriter, out io.Writer) error {
+	finalizer := k8.FinalizerName(writer.Cluster)
+	requests := []*k8.FinalizerRequest{}
+	services, err := writer.Client.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, svc := range services.Items {
+		if k8.HasFinalizer(svc.ObjectMeta, finalizer) {
+			requests = append(requests, &k8.FinalizerRequest{Kind: k8.K8Services, Namespace: svc.ObjectMeta.Namespace, Name: svc.Name, Remove: true})
+		}
+	}
+	endpoints, err := writer.Client.CoreV1().Endpoints(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, ep := range endpoints.Items {
+		if k8.HasFinalizer(ep.ObjectMeta, finalizer) {
+			requests = append(requests, &k8.FinalizerRequest{Kind: k8.K8Endpoints, Namespace: ep.ObjectMeta.Namespace, Name: ep.Name, Remove: true})
+		}
+	}
+
+	for _, req := range requests {
+		if dryRun {
+			fmt.Fprintf(out, "Would remove finalizer %s from %s %s/%s\n", finalizer, req.Kind, req.Namespace, req.Name)
+			continue
+		}
+		if err := writer.Write(context.Background(), req); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Removed finalizer %s from %s %s/%s\n", finalizer, req.Kind, req.Namespace, req.Name)
+	}
+	return nil
+}
+
+// Writers for one-off commands. They're called directly rather than run, and respect the dry run flag
+func syncWriters(localClient kubernetes.Interface) (*k8.ServiceWriter, *k8.EndpointsWriter) {
+	serviceWriter := k8.NewServiceWriter(localClient, nil)
+	endpointsWriter := k8.NewEndpointsWriter(localClient, nil)
+	serviceWriter.DryRun = dryRun
+	endpointsWriter.DryRun = dryRun
+	return serviceWriter, endpointsWriter
+}
+
+// Gets a service, returning nil if it doesn't exist
+func getService(client kubernetes.Interface, namespace, name string) (*v1.Service, error) {
+	svc, err := client.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if k8.ResourceNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return svc, nil
+}
+
+// Gets an endpoints, returning nil if it doesn't exist
+func getEndpoints(client kubernetes.Interface, namespace, name string) (*v1.Endpoints, error) {
+	endpoints, err := client.CoreV1().Endpoints(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if k8.ResourceNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// Gets a remote service, returning nil if it doesn't exist. The watchers only see exported services, so one that
+// isn't exported is an error rather than something to make a follower of
+func getExportedService(client kubernetes.Interface, namespace, name string) (*v1.Service, error) {
+	svc, err := getService(client, namespace, name)
+	if err != nil || svc == nil {
+		return svc, err
+	}
+	if !isExported(svc.ObjectMeta) {
+		return nil, ErrNotExported
+	}
+	return svc, nil
+}
+
+// Gets remote endpoints, returning nil if they don't exist. Endpoints that aren't exported are an error
+func getExportedEndpoints(client kubernetes.Interface, namespace, name string) (*v1.Endpoints, error) {
+	endpoints, err := getEndpoints(client, namespace, name)
+	if err != nil || endpoints == nil {
+		return endpoints, err
+	}
+	if !isExported(endpoints.ObjectMeta) {
+		return nil, ErrNotExported
+	}
+	return endpoints, nil
+}
+
+// Checks that a remote object is exported, using the same label the watchers filter on
+func isExported(meta metav1.ObjectMeta) bool {
+	return meta.Labels[k8.CrossClusterServiceLabelKey] == k8.CrossClusterServiceRemoteLabelValue
+}
+
+// Finds the follower of a remote service, returning nil if there isn't one. Followers can be moved by the namespace
+// map or name template, so they're matched by the remote object they record. Only objects the controller created
+// are looked at, so a sync never deletes anything else
+func findServiceFollower(client kubernetes.Interface, namespace, name string) (*v1.Service, error) {
+	list, err := client.CoreV1().Services(metav1.NamespaceAll).List(k8.LocalFilter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		if followerOf(list.Items[i].ObjectMeta, namespace, name) {
+			return &list.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Finds the follower of remote endpoints, returning nil if there isn't one
+func findEndpointsFollower(client kubernetes.Interface, namespace, name string) (*v1.Endpoints, error) {
+	list, err := client.CoreV1().Endpoints(metav1.NamespaceAll).List(k8.LocalFilter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		if followerOf(list.Items[i].ObjectMeta, namespace, name) {
+			return &list.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func followerOf(meta metav1.ObjectMeta, namespace, name string) bool {
+	remoteNamespace, remoteName := k8.RemoteLocation(meta)
+	return remoteNamespace == namespace && remoteName == name
+}
+
+func parseObjectKey(args []string) (string, string, error) {
+	if len(args) != 1 {
+		return "", "", ErrInvalidObjectKey
+	}
+	parts := strings.Split(args[0], "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrInvalidObjectKey
+	}
+	return parts[0], parts[1], nil
+}
+
+func printObject(title string, obj interface{}) {
+	fmt.Printf("%s:\n", title)
+	// A nil pointer in an interface isn't a nil interface, so this checks the marshalled value instead
+	out, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	if string(out) == "null" {
+		fmt.Println("<none>")
+	} else {
+		fmt.Println(string(out))
+	}
+	fmt.Println()
+}
+
+func printFieldChanges(changes []k8.FieldChange) {
+	if len(changes) == 0 {
+		fmt.Print("No differences\n\n")
+		return
+	}
+	fmt.Println("Differences:")
+	for _, change := range changes {
+		fmt.Printf("  %s: %q -> %q\n", change.Field, change.Old, change.New)
+	}
+	fmt.Println()
+}
+
+func nameOr(name, fallback string) string {
+	if name == "" {
+		return fallback
+	}
+	return name
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"go.uber.org/zap"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+var (
+	ErrDrainTimeout    = errors.New("The drain timeout must be shorter than the lease duration minus the renew deadline.")
+	ErrInvalidLockType = errors.New("The lock type must be endpoints or configmaps.")
+	ErrLeaseLock       = errors.New("Lease locks need a newer client-go than this controller is built with, use endpoints or configmaps.")
+	ErrInvalidShard    = errors.New("The shard index must be at least 0 and less than the number of shards.")
+	ErrLockReleased    = errors.New("The leader election lock was released by this replica.")
+)
+
+// coordination.k8s.io Lease locks are blocked on upgrading client-go, they're only in the Kubernetes 1.14 release and
+// later. They're named so asking for one gets a clear error rather than the generic one
+const leaseLockType = "leases"
+
+// The leader election lock. It's also used by the admin server to look up the current leader
+func newLock(id string, localClient kubernetes.Interface) (resourcelock.Interface, error) {
+	broadcaster := record.NewBroadcaster()
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{})
+	lock, err := resourcelock.New(
+		lockType,
+		lockfileNamespace,
+		currentLockName(),
+		localClient.CoreV1(),
+		resourcelock.ResourceLockConfig{
+			Identity:      id,
+			EventRecorder: recorder,
+		},
+	)
+	if err != nil {
+		return nil, ferrors.Error(err)
+	}
+	return lock, nil
+}
+
+// Checks the leader election flags. The timings themselves are checked by the leader elector
+func validateLeaderElection() error {
+	if lockType == leaseLockType {
+		return ErrLeaseLock
+	}
+	if lockType != resourcelock.ConfigMapsResourceLock && lockType != resourcelock.EndpointsResourceLock {
+		return ErrInvalidLockType
+	}
+	if shards > 1 && (shard < 0 || shard >= shards) {
+		return ErrInvalidShard
+	}
+	// The old leader has to be done writing before a standby can take the lock
+	if drainTimeout >= leaseDuration-renewDeadline {
+		return ErrDrainTimeout
+	}
+	return nil
+}
+
+// Each shard is its own election, so it gets its own lock
+func currentLockName() string {
+	if shards > 1 {
+		return fmt.Sprintf("%s-%d", lockName, shard)
+	}
+	return lockName
+}
+
+func currentShard() k8.Shard {
+	if shards > 1 {
+		return k8.Shard{Index: shard, Count: shards}
+	}
+	return k8.Shard{}
+}
+
+// Runs leader election until the context is done. Losing leadership stops the current term straight away and rejoins
+// the election. When the context is done while leading, the writers are drained and the lock is released before this
+// returns, so a standby can take over straight away. A term that fails stops the election the same way, and its error
+// is returned
+func leaderElection(ctx context.Context, lock resourcelock.Interface, run func(ctx context.Context, lost <-chan struct{}) error) error {
+	logger.Info("Setting up leader election")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Failing stops the election, so only one term can fail
+	failed := make(chan error, 1)
+	fail := func(err error) {
+		logger.Error("Leader term failed, releasing the lock and stopping", zap.Error(err))
+		failed <- err
+		cancel()
+	}
+	candidate := &releasableLock{Interface: lock}
+	var leading int32
+	released := make(chan struct{})
+	go func() {
+		for ctx.Err() == nil {
+			electionTerm(ctx, candidate, &leading, released, run, fail)
+			if ctx.Err() == nil {
+				logger.Info("Rejoining leader election")
+			}
+		}
+	}()
+
+	<-ctx.Done()
+	// A standby is stuck acquiring the lock, which can't be interrupted. There's nothing to drain, so it returns
+	// straight away
+	if atomic.LoadInt32(&leading) == 0 {
+		logger.Info("Not the leader, stopping")
+		return nil
+	}
+	<-released
+	select {
+	case err := <-failed:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Runs the elector once, until this replica has led and lost or given up the lock. The term is run by the elector
+// in its own goroutine, so the elector waits for it to finish before the next term can start
+func electionTerm(ctx context.Context, lock *releasableLock, leading *int32, released chan struct{}, run func(ctx context.Context, lost <-chan struct{}) error, fail func(error)) {
+	finished := make(chan struct{})
+	callbacks := leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(stopChan <-chan struct{}) {
+			defer close(finished)
+			atomic.StoreInt32(leading, 1)
+			defer atomic.StoreInt32(leading, 0)
+
+			termCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go func() {
+				select {
+				case <-stopChan:
+					logger.Info("No longer the leader, stopping")
+					cancel()
+				case <-termCtx.Done():
+				}
+			}()
+			if err := run(termCtx, stopChan); err != nil {
+				fail(err)
+			}
+
+			// Still holding the lock, but shutting down
+			if ctx.Err() != nil {
+				lock.release()
+				logger.Info("Released leader election lock")
+				close(released)
+			}
+		},
+		// The term has already been told to stop. Wait for it to finish before rejoining the election
+		OnStoppedLeading: func() {
+			<-finished
+		},
+	}
+	config := leaderelection.LeaderElectionConfig{
+		Callbacks:     callbacks,
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+	}
+	elector, err := leaderelection.NewLeaderElector(config)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	elector.Run()
+}
+
+// Gives up the lock if this replica holds it
+func releaseLock(lock resourcelock.Interface) {
+	record, err := lock.Get()
+	if err != nil {
+		ferrors.Error(err)
+		return
+	}
+	if record.HolderIdentity != lock.Identity() {
+		return
+	}
+	record.HolderIdentity = ""
+	record.LeaseDurationSeconds = 1
+	record.RenewTime = metav1.Now()
+	if err := lock.Update(*record); err != nil {
+		ferrors.Error(err)
+	}
+}
+
+// releasableLock lets a candidate take a lock that was released by the previous leader straight away. The leader
+// election in this version of client-go otherwise waits out the full lease duration, even for a released lock. It's
+// only given to the elector, the admin server reads the lock as it is
+type releasableLock struct {
+	resourcelock.Interface
+	released int32
+}
+
+func (l *releasableLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	record, err := l.Interface.Get()
+	if err != nil || record.HolderIdentity != "" || atomic.LoadInt32(&l.released) == 1 {
+		return record, err
+	}
+	// Passing the released lock off as our own sends the elector straight to the update. The update is still
+	// checked against the lock's resource version, so only one candidate gets it
+	released := *record
+	released.HolderIdentity = l.Identity()
+	return &released, nil
+}
+
+// The elector keeps renewing until its renew deadline runs out, so once this replica has released the lock it's
+// kept from taking it back
+func (l *releasableLock) Create(record resourcelock.LeaderElectionRecord) error {
+	if atomic.LoadInt32(&l.released) == 1 {
+		return ErrLockReleased
+	}
+	return l.Interface.Create(record)
+}
+
+func (l *releasableLock) Update(record resourcelock.LeaderElectionRecord) error {
+	if atomic.LoadInt32(&l.released) == 1 {
+		return ErrLockReleased
+	}
+	return l.Interface.Update(record)
+}
+
+func (l *releasableLock) release() {
+	atomic.StoreInt32(&l.released, 1)
+	releaseLock(l.Interface)
+}
@@ -1,177 +1,504 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/admin"
 	"github.com/wearefair/k8-cross-cluster-controller/pkg/cleaner"
 	"github.com/wearefair/k8-cross-cluster-controller/pkg/controller"
 	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/expiry"
 	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
 	"github.com/wearefair/k8-cross-cluster-controller/pkg/logging"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/retry"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/state"
 	"k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/client-go/tools/record"
 )
 
 const (
-	EnvDevMode                  = "DEV_MODE"
-	EnvKubeConfigPath           = "KUBECONFIG_PATH"
-	channelBufferCount          = 4
-	controllerName              = "cross-cluster-controller"
-	fairSystemK8Namespace       = "fair-system"
-	leaderElectionLeaseDuration = 1 * time.Minute
-	leaderElectionRenewDeadline = 30 * time.Second
-	leaderElectionRetryPeriod   = 5 * time.Second
+	EnvAdminToken             = "ADMIN_TOKEN"
+	EnvClusterName            = "CLUSTER_NAME"
+	EnvDevMode                = "DEV_MODE"
+	EnvDryRun                 = "DRY_RUN"
+	EnvInitialSyncParallelism = "INITIAL_SYNC_PARALLELISM"
+	EnvInitialSyncTimeout     = "INITIAL_SYNC_TIMEOUT"
+	EnvKubeConfigPath         = "KUBECONFIG_PATH"
+	EnvLocalBurst             = "LOCAL_BURST"
+	EnvLocalQPS               = "LOCAL_QPS"
+	EnvMaxWriteFailures       = "MAX_WRITE_FAILURES"
+	EnvRemoteBurst            = "REMOTE_BURST"
+	EnvRemoteClusterName      = "REMOTE_CLUSTER_NAME"
+	EnvRemoteExpiryPolicy     = "REMOTE_EXPIRY_POLICY"
+	EnvRemoteFinalizers       = "REMOTE_FINALIZERS"
+	EnvRemoteQPS              = "REMOTE_QPS"
+	EnvRemoteWriteKubeConfig  = "REMOTE_WRITE_KUBECONFIG_PATH"
+	EnvReplayDeadLetters      = "REPLAY_DEAD_LETTERS"
+	EnvShard                  = "SHARD"
+	EnvShards                 = "SHARDS"
+	EnvSyncCheckpoint         = "SYNC_CHECKPOINT"
+	channelBufferCount        = 4
+	controllerName            = "cross-cluster-controller"
+	fairSystemK8Namespace     = "fair-system"
+	defaultBurst              = 10
+	defaultCheckpointPeriod   = 30 * time.Second
+	defaultDrainTimeout       = 10 * time.Second
+	defaultExpiryAfter        = 5 * time.Minute
+	defaultInitialSyncTimeout = 10 * time.Minute
+	defaultMaxStaleness       = 5 * time.Second
+	defaultQPS                = 5
+	initialSyncRetryDelay     = 10 * time.Second
+	defaultLeaseDuration      = 1 * time.Minute
+	defaultRenewDeadline      = 30 * time.Second
+	defaultRetryPeriod        = 5 * time.Second
 )
 
 var (
-	devMode    string
-	kubeconfig string
+	adminAddr    string
+	adminToken   string
+	probeAddr    string
+	clusterName  string
+	devMode      string
+	drainTimeout time.Duration
+	dryRun       bool
+	kubeconfig   string
+	// Failed writes in a row before an object is dead lettered, and whether the cleaner replays the dead letters
+	maxWriteFailures  int
+	replayDeadLetters bool
+	// Only set while running the controller, commands don't record events
+	eventRecorder record.EventRecorder
+	// Optional. If set, followers are annotated with the cluster they were created from
+	remoteClusterName string
+	// Optional kubeconfig for writing sync status back to the remote cluster
+	remoteWriteKubeconfig string
+	// Adds finalizers to the followed remote services and endpoints, so they can't be deleted without the followers
+	// being cleaned up
+	remoteFinalizers bool
 	// These are only set and used when the controller is running in dev mode
 	localContext      string
 	remoteContext     string
 	logger            = logging.Logger
 	lockfileNamespace string
+	lockName          string
+	lockType          string
+	leaseDuration     time.Duration
+	renewDeadline     time.Duration
+	retryPeriod       time.Duration
+	// In sharded mode, each shard has its own leader, which only handles the namespaces in the shard
+	shard  int
+	shards int
+	// Endpoints changes are held for the window and only the latest is written, but never for longer than the max
+	// staleness. Coalescing is disabled if the window is 0
+	coalesceWindow       time.Duration
+	coalesceMaxStaleness time.Duration
+	// Client side rate limits of the local and remote API clients
+	localQPS    float64
+	localBurst  int
+	remoteQPS   float64
+	remoteBurst int
+	// How many writes the initial sync has waiting at once, how long it keeps retrying, and whether it's running.
+	// Read atomically
+	initialSyncParallelism int
+	initialSyncTimeout     time.Duration
+	syncing                int32
+	// Keeps the last sync of every follower in a local configmap, so the next leader only syncs what changed
+	syncCheckpoint   bool
+	checkpointPeriod time.Duration
+	// What happens to the followers once the remote cluster has been unreachable for the expiry period
+	expiryPolicy string
+	expiryAfter  time.Duration
 
-	ErrLocalRemoteK8ConfMatch = errors.New("Local and remote K8 configuration cannot point to the same host.")
+	ErrClusterNameRequired     = errors.New("Cluster name is required to write sync status to the remote cluster.")
+	ErrInvalidMaxWriteFailures = errors.New("The max write failures must be at least 1.")
+	ErrLocalRemoteK8ConfMatch  = errors.New("Local and remote K8 configuration cannot point to the same host.")
+	ErrRemoteWriteRequired     = errors.New("A remote write kubeconfig is required to add finalizers to remote services.")
 )
 
 func main() {
 	flag.StringVar(&kubeconfig, "kubeconfig", os.Getenv(EnvKubeConfigPath), "Path to kubeconfig for remote cluster")
 	flag.StringVar(&devMode, "devmode", os.Getenv(EnvDevMode), "Dev mode flag")
+	flag.BoolVar(&dryRun, "dry-run", os.Getenv(EnvDryRun) == "true", "Log the changes that would be made to the local cluster instead of writing them")
+	flag.IntVar(&maxWriteFailures, "max-write-failures", envInt(EnvMaxWriteFailures, 5), "Failed writes in a row before an object is dead lettered and no longer retried on its own")
+	flag.BoolVar(&replayDeadLetters, "replay-dead-letters", os.Getenv(EnvReplayDeadLetters) == "true", "Replay the dead lettered objects on every cleaner pass")
+	flag.DurationVar(&drainTimeout, "drain-timeout", defaultDrainTimeout, "How long in flight writes get to finish when stopping. Should be well under the difference between the lease duration and renew deadline")
 	flag.StringVar(&localContext, "local-context", "prototype-general", "DEV MODE: Context override for the local cluster. Defaults to prototype-general")
 	flag.StringVar(&remoteContext, "remote-context", "prototype-secure", "DEV MODE: Context override for the remote cluster. Defaults to prototype-secure")
+	flag.StringVar(&clusterName, "cluster-name", os.Getenv(EnvClusterName), "Name of the local cluster, used when writing sync status to the remote cluster")
+	flag.StringVar(&remoteClusterName, "remote-cluster-name", os.Getenv(EnvRemoteClusterName), "Name of the remote cluster, recorded on the followers created from it")
+	flag.StringVar(&remoteWriteKubeconfig, "remote-write-kubeconfig", os.Getenv(EnvRemoteWriteKubeConfig), "Path to kubeconfig for writing sync status to the remote cluster. Status is not written if unset")
+	flag.BoolVar(&remoteFinalizers, "remote-finalizers", os.Getenv(EnvRemoteFinalizers) == "true", "Add a finalizer to the followed remote services and endpoints, which is removed once their follower is deleted. Needs the remote write kubeconfig")
+	flag.StringVar(&probeAddr, "probe-addr", ":8080", "Address to serve the liveness probe on")
+	flag.StringVar(&adminAddr, "admin-addr", ":9090", "Address to serve the metrics and admin API on")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv(EnvAdminToken), "Bearer token for the admin API. The admin API is disabled if unset")
 	flag.StringVar(&lockfileNamespace, "namespace", fairSystemK8Namespace, "The namespace to use for the leader eelection configmap")
+	flag.StringVar(&lockName, "lock-name", controllerName, "Name of the leader election lock. In sharded mode the shard index is appended")
+	flag.StringVar(&lockType, "lock-type", resourcelock.EndpointsResourceLock, "Kind of object the leader election lock is kept in, endpoints or configmaps. Every replica has to use the same one")
+	flag.DurationVar(&leaseDuration, "lease-duration", defaultLeaseDuration, "How long standbys wait after the last renewal before taking over the lock")
+	flag.DurationVar(&renewDeadline, "renew-deadline", defaultRenewDeadline, "How long the leader keeps retrying to renew the lock before giving it up")
+	flag.DurationVar(&retryPeriod, "retry-period", defaultRetryPeriod, "How long to wait between attempts to acquire or renew the lock")
+	flag.IntVar(&shards, "shards", envInt(EnvShards, 1), "Number of shards to split the namespaces into. Sharding is disabled if 1")
+	flag.IntVar(&shard, "shard", envInt(EnvShard, 0), "Index of the shard this replica runs for, from 0. Only used when sharding")
+	flag.DurationVar(&coalesceWindow, "endpoints-coalesce-window", 0, "How long remote endpoints have to stop changing before the latest change is written. Disabled if 0")
+	flag.DurationVar(&coalesceMaxStaleness, "endpoints-max-staleness", defaultMaxStaleness, "The longest a remote endpoints change is held by the coalescing window before it's written")
+	flag.Float64Var(&localQPS, "local-qps", envFloat(EnvLocalQPS, defaultQPS), "Requests per second the local client is limited to")
+	flag.IntVar(&localBurst, "local-burst", envInt(EnvLocalBurst, defaultBurst), "Requests the local client can make at once over its QPS")
+	flag.Float64Var(&remoteQPS, "remote-qps", envFloat(EnvRemoteQPS, defaultQPS), "Requests per second the remote clients are limited to")
+	flag.IntVar(&remoteBurst, "remote-burst", envInt(EnvRemoteBurst, defaultBurst), "Requests the remote clients can make at once over their QPS")
+	flag.IntVar(&initialSyncParallelism, "initial-sync-parallelism", envInt(EnvInitialSyncParallelism, 4), "How many followers the initial sync has waiting on the writers at once when a replica becomes the leader")
+	flag.DurationVar(&initialSyncTimeout, "initial-sync-timeout", envDuration(EnvInitialSyncTimeout, defaultInitialSyncTimeout), "How long the initial sync keeps retrying before the leader starts watching without it")
+	flag.BoolVar(&syncCheckpoint, "sync-checkpoint", os.Getenv(EnvSyncCheckpoint) == "true", "Keep the last sync of every follower in a configmap next to the leader election lock, so a new leader skips the followers that are up to date")
+	flag.DurationVar(&checkpointPeriod, "checkpoint-period", defaultCheckpointPeriod, "How often the sync checkpoint is saved")
+	flag.StringVar(&expiryPolicy, "remote-expiry-policy", envOr(EnvRemoteExpiryPolicy, expiry.PolicyKeep), "What happens to the followers once the remote cluster has been unreachable for the expiry period: keep, not-ready or delete")
+	flag.DurationVar(&expiryAfter, "remote-expiry-after", defaultExpiryAfter, "How long the remote cluster has to be unreachable before the expiry policy is applied")
+	registerPipelineFlags()
+	flag.Usage = usage
 	flag.Parse()
+	if maxWriteFailures < 1 {
+		logger.Fatal(ErrInvalidMaxWriteFailures.Error())
+	}
+	retry.Default.MaxFailures = maxWriteFailures
 
-	localConf, err := setupLocalConfig()
-	if err != nil {
+	if err := loadPipelineConfig(); err != nil {
 		logger.Fatal(err.Error())
 	}
-	remoteConf, err := setupRemoteConfig(kubeconfig)
+
+	localClient, remoteClient, err := setupClients()
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
+	if err := validatePipeline(localClient, remoteClient); err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	switch flag.Arg(0) {
+	case "":
+		runController(localClient, remoteClient)
+	case "plan":
+		runPlan(localClient, remoteClient)
+	case "list":
+		runList(localClient, remoteClient)
+	case "diff":
+		runDiff(localClient, remoteClient, flag.Args()[1:])
+	case "sync":
+		runSync(localClient, remoteClient, flag.Args()[1:])
+	case "purge":
+		runPurge(localClient, flag.Args()[1:])
+	case "purge-finalizers":
+		runPurgeFinalizers()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
 
+// Runs the controller loop. Only the leader watches the remote cluster and writes to the local one
+func runController(localClient, remoteClient kubernetes.Interface) {
+	// Create a unique identifier for the controller based off of hostname and UUID
 	id := generateId()
 	logger = logger.With(zap.String("id", id))
-	logger.Info("Performing sanity checks on kubeconfig settings")
-	if err := validateK8Conf(localConf, remoteConf); err != nil {
+	if err := validateLeaderElection(); err != nil {
 		logger.Fatal(err.Error())
 	}
-
-	logger.Info("Setting up local K8 client")
-	localClient, err := kubernetes.NewForConfig(localConf)
+	if err := expiry.ValidatePolicy(expiryPolicy); err != nil {
+		logger.Fatal(err.Error())
+	}
+	if shards > 1 {
+		logger = logger.With(zap.Int("shard", shard), zap.Int("shards", shards))
+	}
+	lock, err := newLock(id, localClient)
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
-
-	logger.Info("Setting up remote K8 client")
-	remoteClient, err := kubernetes.NewForConfig(remoteConf)
+	// Set up before leading, so a bad remote write config stops the controller before it takes the lock rather than
+	// in the middle of a term
+	remoteWriteClient, err := setupRemoteWriteClient()
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
 
+	eventRecorder = newEventRecorder(localClient)
+
+	logger.Info("Setting up probe and admin servers")
+	probeServer := admin.NewProbeServer(probeAddr)
+	probeServer.Ready = ready
+	go probeServer.Run()
+	adminServer := admin.New(adminAddr, adminToken, state.Default, lock)
+	adminServer.Retries = retry.Default
+	go adminServer.Run()
+
+	// Stop on SIGTERM, so in flight writes can drain and the lock can be handed off before exiting
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		logger.Info("Received signal, shutting down", zap.String("signal", sig.String()))
+		cancel()
+	}()
+
+	run := func(ctx context.Context, lost <-chan struct{}) error {
+		return runLeader(ctx, lost, localClient, remoteClient, remoteWriteClient)
+	}
+	// The lock has already been released by the time a failed term gets here
+	if err := leaderElection(ctx, lock, run); err != nil {
+		logger.Fatal(err.Error())
+	}
+}
+
+// Runs everything the leader does until the context is done, then waits for the writers to drain. Once leadership is
+// lost, the writers stop straight away instead, since the next leader may already be writing. The remote write client
+// is nil unless sync status or finalizers are turned on
+func runLeader(ctx context.Context, lost <-chan struct{}, localClient, remoteClient, remoteWriteClient kubernetes.Interface) error {
 	logger.Info("Setting up local writers")
 	localServiceWriterChan := make(chan *k8.ServiceRequest, channelBufferCount)
 	localEndpointsWriterChan := make(chan *k8.EndpointsRequest, channelBufferCount)
 	localServiceWriter := k8.NewServiceWriter(localClient, localServiceWriterChan)
 	localEndpointsWriter := k8.NewEndpointsWriter(localClient, localEndpointsWriterChan)
-	go localServiceWriter.Run()
-	go localEndpointsWriter.Run()
+	localServiceWriter.DrainTimeout = drainTimeout
+	localEndpointsWriter.DrainTimeout = drainTimeout
+	localServiceWriter.Abort = lost
+	localEndpointsWriter.Abort = lost
+	localServiceWriter.Retries = retry.Default
+	localEndpointsWriter.Retries = retry.Default
+	// The initial sync and the cleaner's deletes go on the bulk channels, so they don't hold up live updates
+	localServiceWriter.Bulk = make(chan *k8.ServiceRequest, channelBufferCount)
+	localEndpointsWriter.Bulk = make(chan *k8.EndpointsRequest, channelBufferCount)
+	logger.Info("Setting up remote expiry", zap.String("policy", expiryPolicy), zap.Duration("after", expiryAfter))
+	remoteExpiry, err := expiry.New(localClient, remoteClient, localEndpointsWriterChan, localServiceWriterChan,
+		expiryPolicy, expiryAfter)
+	if err != nil {
+		return err
+	}
+	remoteExpiry.Shard = currentShard()
+	remoteExpiry.Recorder = eventRecorder
+	// Retries and dead letter replays wait while the followers are expired, so they aren't written back before the
+	// remote is reachable. Set before the writers start, since nothing has failed yet this term
+	retry.Default.SetPaused(remoteExpiry.Paused)
+	var servicesSynced, endpointsSynced cache.InformerSynced
+	localServiceWriter.Cache, servicesSynced = k8.WatchLocalServices(ctx, localClient)
+	localEndpointsWriter.Cache, endpointsSynced = k8.WatchLocalEndpoints(ctx, localClient)
+	if dryRun {
+		logger.Info("Running in dry run mode, changes to the local cluster will be logged instead of written")
+		localServiceWriter.DryRun = true
+		localEndpointsWriter.DryRun = true
+	}
+	if remoteWriteClient != nil {
+		logger.Info("Setting up remote status writer")
+		statusWriter := k8.NewStatusWriter(remoteWriteClient, clusterName, make(chan *k8.StatusRequest, channelBufferCount))
+		localServiceWriter.Status = statusWriter.Events
+		localEndpointsWriter.Status = statusWriter.Events
+		go statusWriter.Run(ctx)
+	}
+	if remoteFinalizers && remoteWriteClient != nil {
+		logger.Info("Setting up remote finalizer writer")
+		finalizerWriter := k8.NewFinalizerWriter(remoteWriteClient, clusterName)
+		localServiceWriter.Finalizers = finalizerWriter
+		localEndpointsWriter.Finalizers = finalizerWriter
+		go finalizerWriter.Run(ctx)
+	}
+	var checkpoint *k8.Checkpoint
+	if syncCheckpoint && !dryRun {
+		logger.Info("Loading sync checkpoint")
+		checkpoint = setupCheckpoint(localClient)
+		localServiceWriter.Checkpoint = checkpoint
+		localEndpointsWriter.Checkpoint = checkpoint
+		go checkpoint.Run(ctx, checkpointPeriod)
+	}
+	var writers sync.WaitGroup
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		localServiceWriter.Run(ctx)
+	}()
+	go func() {
+		defer writers.Done()
+		localEndpointsWriter.Run(ctx)
+	}()
 
 	logger.Info("Setting up remote readers")
 	remoteServiceReaderChan := make(chan *k8.ServiceRequest, channelBufferCount)
 	remoteEndpointsReaderChan := make(chan *k8.EndpointsRequest, channelBufferCount)
-	remoteServiceReader := k8.NewServiceReader(remoteServiceReaderChan)
-	remoteEndpointsReader := k8.NewEndpointsReader(remoteEndpointsReaderChan)
+	remoteServiceReader := k8.NewServiceReader(ctx, remoteServiceReaderChan)
+	remoteEndpointsReader := k8.NewEndpointsReader(ctx, remoteEndpointsReaderChan)
+	remoteServiceReader.Shard = currentShard()
+	remoteEndpointsReader.Shard = currentShard()
+	remoteServiceReader.Paused = remoteExpiry.Paused
+	remoteEndpointsReader.Paused = remoteExpiry.Paused
 
 	// Set up transformers
 	logger.Info("Setting up transformers")
-	augmenter := &controller.Augmenter{Client: localClient}
+	coalescedEndpointsChan := make(chan *k8.EndpointsRequest, channelBufferCount)
+	go controller.CoalesceEndpoints(ctx, remoteEndpointsReaderChan, coalescedEndpointsChan, coalesceWindow, coalesceMaxStaleness)
+	endpointsSteps := endpointsTransformers(localClient, remoteClient)
+	serviceSteps := serviceTransformers(localClient, remoteClient)
 	go controller.EndpointsPipeline(
-		remoteEndpointsReaderChan,
+		ctx,
+		coalescedEndpointsChan,
 		localEndpointsWriterChan,
-		augmenter.Endpoints,
-		controller.EndpointsWhitelist,
-		controller.EndpointsLabel,
+		eventRecorder,
+		retry.Default,
+		endpointsSteps...,
 	)
 	go controller.ServicePipeline(
+		ctx,
 		remoteServiceReaderChan,
 		localServiceWriterChan,
-		augmenter.Service,
-		controller.ServiceWhitelist,
-		controller.ServiceLabel,
+		eventRecorder,
+		retry.Default,
+		serviceSteps...,
 	)
 
+	// The leader isn't ready until every follower has been brought up to date
+	atomic.StoreInt32(&syncing, 1)
+	initialSync := controller.NewInitialSync(remoteClient, localServiceWriter, localEndpointsWriter)
+	initialSync.ServiceTransformers = serviceSteps
+	initialSync.EndpointsTransformers = endpointsSteps
+	initialSync.Shard = currentShard()
+	initialSync.Parallelism = initialSyncParallelism
+	initialSync.Recorder = eventRecorder
+	initialSync.Checkpoint = checkpoint
+	// The expiry runs during the initial sync too, so a remote that's down from the start still expires the followers.
+	// Syncing them back is a single attempt, so a remote that's still failing doesn't hold up the checks, and the
+	// next check tries again. Syncs run one at a time, so it waits for an initial sync that's still going
+	remoteExpiry.Recovered = func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, initialSyncTimeout)
+		defer cancel()
+		// A remote that was down from the start can come back before the local caches have synced
+		if !cache.WaitForCacheSync(ctx.Done(), servicesSynced, endpointsSynced) {
+			return ctx.Err()
+		}
+		return initialSync.Run(ctx)
+	}
+	go remoteExpiry.Run(ctx)
+	runInitialSync(ctx, initialSync, servicesSynced, endpointsSynced)
+	atomic.StoreInt32(&syncing, 0)
+
 	logger.Info("Setting up service/endpoints cleaner")
-	cleaner := cleaner.New(localClient, remoteClient, localEndpointsWriterChan, localServiceWriterChan)
+	cleaner := cleaner.New(localClient, remoteClient, localEndpointsWriter.Bulk, localServiceWriter.Bulk)
+	cleaner.Shard = currentShard()
+	cleaner.Retries = retry.Default
+	cleaner.ReplayDeadLetters = replayDeadLetters
+	go cleaner.Run(ctx)
 
-	// Set up leader election callback funcs
-	// Reference for leader election setup:
-	// https://github.com/kubernetes/kubernetes/blob/dce1b881284a103909f5cfa969ff56e5e0565362/cmd/cloud-controller-manager/app/controllermanager.go#L157-L190
-	run := func(stopChan <-chan struct{}) {
-		logger.Info("Setting up watchers")
-		k8.WatchEndpoints(remoteClient, remoteEndpointsReader, stopChan)
-		k8.WatchServices(remoteClient, remoteServiceReader, stopChan)
-		go cleaner.Run(stopChan)
+	logger.Info("Setting up watchers")
+	k8.WatchEndpoints(ctx, remoteClient, remoteEndpointsReader)
+	k8.WatchServices(ctx, remoteClient, remoteServiceReader)
+
+	<-ctx.Done()
+	logger.Info("Stopping, waiting for in flight writes to drain", zap.Duration("timeout", drainTimeout))
+	writers.Wait()
+	// The lock is only released once this returns, so the checkpoint is saved while still leading. Once leadership
+	// is lost, the next leader may already be saving its own
+	select {
+	case <-lost:
+	default:
+		if checkpoint != nil {
+			if err := checkpoint.Save(); err != nil {
+				logger.Error("Could not save sync checkpoint", zap.Error(err))
+			}
+		}
 	}
-	leaderElection(id, localClient, run)
+	// The queues belong to this term, so anything left in them is gone, and so are the retries that would go to them
+	state.Default.ResetQueues()
+	retry.Default.Reset()
+	return nil
 }
 
-func generateId() string {
-	id, err := os.Hostname()
-	if err != nil {
-		logger.Fatal(err.Error())
+// Waits for the local caches, so existing followers are compared instead of recreated, then syncs every export.
+// A failed sync is tried again until the timeout, after which it's given up on and the watchers and cleaner bring
+// the followers up to date as they go
+func runInitialSync(parent context.Context, initialSync *controller.InitialSync, synced ...cache.InformerSynced) {
+	ctx, cancel := context.WithTimeout(parent, initialSyncTimeout)
+	defer cancel()
+	logger.Info("Waiting for the local caches to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		if parent.Err() == nil {
+			logger.Error("Gave up on the initial sync, the local caches didn't sync", zap.Duration("timeout", initialSyncTimeout))
+		}
+		return
+	}
+	for {
+		err := initialSync.Run(ctx)
+		if err == nil || parent.Err() != nil {
+			return
+		}
+		if ctx.Err() != nil {
+			logger.Error("Gave up on the initial sync", zap.Error(err), zap.Duration("timeout", initialSyncTimeout))
+			return
+		}
+		logger.Error("Initial sync failed, retrying", zap.Error(err), zap.Duration("delay", initialSyncRetryDelay))
+		select {
+		case <-time.After(initialSyncRetryDelay):
+		case <-ctx.Done():
+			logger.Error("Gave up on the initial sync", zap.Error(err), zap.Duration("timeout", initialSyncTimeout))
+			return
+		}
 	}
-	return id + "_" + UUID()
 }
 
-func leaderElection(id string, localClient kubernetes.Interface, runFunc func(stopChan <-chan struct{})) {
-	// Create a unique identifier for the controller based off of hostname and UUID
-	broadcaster := record.NewBroadcaster()
-	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{})
-	lock, err := resourcelock.New(
-		resourcelock.EndpointsResourceLock,
-		lockfileNamespace,
-		controllerName,
-		localClient.CoreV1(),
-		resourcelock.ResourceLockConfig{
-			Identity:      id,
-			EventRecorder: recorder,
-		},
-	)
+// Replicas are ready unless they're leading and haven't finished the initial sync. Standbys have nothing to sync
+func ready() bool {
+	return atomic.LoadInt32(&syncing) == 0
+}
+
+// Sets up the local and remote clients, after checking that they don't point at the same cluster
+func setupClients() (kubernetes.Interface, kubernetes.Interface, error) {
+	localConf, err := setupLocalConfig()
 	if err != nil {
-		logger.Fatal(err.Error())
+		return nil, nil, err
+	}
+	remoteConf, err := setupRemoteConfig(kubeconfig)
+	if err != nil {
+		return nil, nil, err
 	}
-	logger.Info("Setting up leader election")
-	callbacks := leaderelection.LeaderCallbacks{
-		OnStartedLeading: runFunc,
-		OnStoppedLeading: func() {
-			logger.Fatal("No longer the leader.")
-		},
+
+	logger.Info("Performing sanity checks on kubeconfig settings")
+	if err := validateK8Conf(localConf, remoteConf); err != nil {
+		return nil, nil, err
+	}
+
+	logger.Info("Setting up local K8 client")
+	localClient, err := kubernetes.NewForConfig(localConf)
+	if err != nil {
+		return nil, nil, ferrors.Error(err)
 	}
-	config := leaderelection.LeaderElectionConfig{
-		Callbacks:     callbacks,
-		Lock:          lock,
-		LeaseDuration: leaderElectionLeaseDuration,
-		RenewDeadline: leaderElectionRenewDeadline,
-		RetryPeriod:   leaderElectionRetryPeriod,
+
+	logger.Info("Setting up remote K8 client")
+	remoteClient, err := kubernetes.NewForConfig(remoteConf)
+	if err != nil {
+		return nil, nil, ferrors.Error(err)
 	}
-	leaderelection.RunOrDie(config)
+	return localClient, remoteClient, nil
+}
+
+func generateId() string {
+	id, err := os.Hostname()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	return id + "_" + UUID()
 }
 
 // If the controller is configured to run in development mode, it will
@@ -193,6 +520,8 @@ func setupLocalConfig() (*rest.Config, error) {
 	if err != nil {
 		return nil, ferrors.Error(err)
 	}
+	conf.QPS = float32(localQPS)
+	conf.Burst = localBurst
 	return conf, nil
 }
 
@@ -214,13 +543,119 @@ func setupRemoteConfig(remoteConfPath string) (*rest.Config, error) {
 	if err != nil {
 		return nil, ferrors.Error(err)
 	}
+	remoteConf.QPS = float32(remoteQPS)
+	remoteConf.Burst = remoteBurst
 	return remoteConf, nil
 }
 
+// Sets up the client the sync status and finalizer writers share, or returns nil if neither is turned on. It's a
+// separate client, since the remote client the watchers use only needs read access
+func setupRemoteWriteClient() (kubernetes.Interface, error) {
+	if dryRun || (remoteWriteKubeconfig == "" && !remoteFinalizers) {
+		return nil, nil
+	}
+	if remoteWriteKubeconfig == "" {
+		return nil, ErrRemoteWriteRequired
+	}
+	return newRemoteWriteClient(remoteWriteKubeconfig)
+}
+
+// Builds a client for writing to the remote cluster. The writes are about this cluster, so it needs a name
+func newRemoteWriteClient(remoteConfPath string) (kubernetes.Interface, error) {
+	if clusterName == "" {
+		return nil, ErrClusterNameRequired
+	}
+	conf, err := setupRemoteConfig(remoteConfPath)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(conf)
+	if err != nil {
+		return nil, ferrors.Error(err)
+	}
+	return client, nil
+}
+
+// Loads the sync checkpoint, which is kept next to the lock and named after it, so each shard has its own. If it
+// can't be read, the leader starts from an empty one, and syncs everything
+func setupCheckpoint(localClient kubernetes.Interface) *k8.Checkpoint {
+	checkpoint := k8.NewCheckpoint(localClient, lockfileNamespace, currentLockName()+"-checkpoint")
+	if err := checkpoint.Load(); err != nil {
+		logger.Error("Could not load sync checkpoint, syncing everything", zap.Error(err))
+	}
+	return checkpoint
+}
+
+// Sets up a writer for the finalizers on the remote services and endpoints. It uses the same remote client config as the status
+// writer
+func setupFinalizerWriter(remoteConfPath string) (*k8.FinalizerWriter, error) {
+	if remoteConfPath == "" {
+		return nil, ErrRemoteWriteRequired
+	}
+	client, err := newRemoteWriteClient(remoteConfPath)
+	if err != nil {
+		return nil, err
+	}
+	return k8.NewFinalizerWriter(client, clusterName), nil
+}
+
+// Events are recorded in the local cluster, on the followers they're about
+func newEventRecorder(localClient kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: localClient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: controllerName})
+}
+
 func devModeEnabled() bool {
 	return devMode == "true"
 }
 
+// Splits a comma separated flag, ignoring empty entries
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Reads a string from the environment, for flag defaults
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Reads an int from the environment, for flag defaults
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Reads a duration from the environment, for flag defaults
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Reads a float from the environment, for flag defaults
+func envFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
 // Checks to make sure that the local config and remote config's hosts don't point to
 // the same place
 func validateK8Conf(localConf, remoteConf *rest.Config) error {
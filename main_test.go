@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
 )
 
@@ -40,3 +49,201 @@ func TestValidateK8Conf(t *testing.T) {
 		}
 	}
 }
+
+func TestParseObjectKey(t *testing.T) {
+	testCases := []struct {
+		Args      []string
+		Namespace string
+		Name      string
+		Err       error
+	}{
+		// Namespace and name are split on the slash
+		{
+			Args:      []string{"foo/bar"},
+			Namespace: "foo",
+			Name:      "bar",
+		},
+		// A name without a namespace is an error
+		{
+			Args: []string{"bar"},
+			Err:  ErrInvalidObjectKey,
+		},
+		// An empty namespace is an error
+		{
+			Args: []string{"/bar"},
+			Err:  ErrInvalidObjectKey,
+		},
+		// More than one argument is an error
+		{
+			Args: []string{"foo/bar", "baz"},
+			Err:  ErrInvalidObjectKey,
+		},
+	}
+
+	for _, testCase := range testCases {
+		namespace, name, err := parseObjectKey(testCase.Args)
+		if err != testCase.Err {
+			t.Errorf("Expected error: %v\n, got %v", testCase.Err, err)
+		}
+		if namespace != testCase.Namespace || name != testCase.Name {
+			t.Errorf("Expected %s/%s, got %s/%s", testCase.Namespace, testCase.Name, namespace, name)
+		}
+	}
+}
+
+func TestGetExportedService(t *testing.T) {
+	exported := &v1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:      "exported",
+		Namespace: "bar",
+		Labels:    map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceRemoteLabelValue},
+	}}
+	private := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "private", Namespace: "bar"}}
+	client := fake.NewSimpleClientset(exported, private)
+	testCases := []struct {
+		Name     string
+		Expected *v1.Service
+		Err      error
+	}{
+		{Name: "exported", Expected: exported},
+		// Services that aren't exported are never followed
+		{Name: "private", Err: ErrNotExported},
+		// A missing service isn't an error, its followers are deleted
+		{Name: "missing"},
+	}
+
+	for _, testCase := range testCases {
+		svc, err := getExportedService(client, "bar", testCase.Name)
+		if err != testCase.Err {
+			t.Errorf("Expected error for %s: %v\ngot: %v", testCase.Name, testCase.Err, err)
+		}
+		if !reflect.DeepEqual(testCase.Expected, svc) {
+			t.Errorf("Expected service for %s: %+v\ngot: %+v", testCase.Name, testCase.Expected, svc)
+		}
+	}
+}
+
+func TestFindServiceFollower(t *testing.T) {
+	followerLabels := map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceLocalLabelValue}
+	moved := &v1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:      "foo-cluster-b",
+		Namespace: "moved",
+		Labels:    followerLabels,
+		Annotations: map[string]string{
+			k8.CrossClusterRemoteNamespaceAnnotationKey: "bar",
+			k8.CrossClusterRemoteNameAnnotationKey:      "foo",
+		},
+	}}
+	unmoved := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "baz", Namespace: "bar", Labels: followerLabels}}
+	// Same namespace and name as the remote service, but not created by the controller
+	other := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "qux", Namespace: "bar"}}
+	client := fake.NewSimpleClientset(moved, unmoved, other)
+	testCases := []struct {
+		Name     string
+		Expected *v1.Service
+	}{
+		{Name: "foo", Expected: moved},
+		{Name: "baz", Expected: unmoved},
+		{Name: "qux"},
+	}
+
+	for _, testCase := range testCases {
+		svc, err := findServiceFollower(client, "bar", testCase.Name)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(testCase.Expected, svc) {
+			t.Errorf("Expected follower of bar/%s: %+v\ngot: %+v", testCase.Name, testCase.Expected, svc)
+		}
+	}
+}
+
+func TestPurgeFollowers(t *testing.T) {
+	follower := func(name, source string) *v1.Service {
+		meta := metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "bar",
+			Labels:    map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceLocalLabelValue},
+		}
+		if source != "" {
+			meta.Annotations = map[string]string{k8.CrossClusterSourceAnnotationKey: source}
+		}
+		return &v1.Service{ObjectMeta: meta}
+	}
+	testCases := []struct {
+		Unannotated bool
+		Remaining   []string
+		Skipped     bool
+	}{
+		// Only the followers from the cluster are deleted, and the unannotated one is listed
+		{
+			Remaining: []string{"other", "unannotated"},
+			Skipped:   true,
+		},
+		// The unannotated follower is deleted too if asked to
+		{
+			Unannotated: true,
+			Remaining:   []string{"other"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		localClient := fake.NewSimpleClientset(
+			follower("purged", "cluster-b"),
+			follower("other", "cluster-c"),
+			follower("unannotated", ""),
+		)
+		out := &bytes.Buffer{}
+		if err := purgeFollowers(localClient, "cluster-b", testCase.Unannotated, out); err != nil {
+			t.Fatalf("Could not purge followers %v", err)
+		}
+		list, err := localClient.CoreV1().Services("bar").List(metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("Could not list services %v", err)
+		}
+		remaining := []string{}
+		for _, svc := range list.Items {
+			remaining = append(remaining, svc.Name)
+		}
+		sort.Strings(remaining)
+		if !reflect.DeepEqual(testCase.Remaining, remaining) {
+			t.Errorf("Expected remaining services: %v\ngot: %v", testCase.Remaining, remaining)
+		}
+		if skipped := strings.Contains(out.String(), "Skipped service bar/unannotated"); skipped != testCase.Skipped {
+			t.Errorf("Expected skipped to be listed: %t\ngot output: %s", testCase.Skipped, out.String())
+		}
+	}
+}
+
+func TestPurgeFinalizers(t *testing.T) {
+	finalizer := k8.FinalizerName("cluster-a")
+	remoteClient := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Finalizers: []string{finalizer, "other"}}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "bar", Finalizers: []string{"other"}}},
+		&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Finalizers: []string{finalizer}}},
+	)
+	out := &bytes.Buffer{}
+	if err := purgeFinalizers(k8.NewFinalizerWriter(remoteClient, "cluster-a"), out); err != nil {
+		t.Fatalf("Could not purge finalizers %v", err)
+	}
+
+	// Only the cluster's finalizer is removed, from services and endpoints alike
+	services, err := remoteClient.CoreV1().Services("bar").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Could not list services %v", err)
+	}
+	for _, svc := range services.Items {
+		if expected := []string{"other"}; !reflect.DeepEqual(expected, svc.ObjectMeta.Finalizers) {
+			t.Errorf("Expected service %s finalizers: %v\ngot: %v", svc.Name, expected, svc.ObjectMeta.Finalizers)
+		}
+	}
+	endpoints, err := remoteClient.CoreV1().Endpoints("bar").Get("foo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Could not get endpoints %v", err)
+	}
+	if len(endpoints.ObjectMeta.Finalizers) != 0 {
+		t.Errorf("Expected no endpoints finalizers\ngot: %v", endpoints.ObjectMeta.Finalizers)
+	}
+	if removed := strings.Count(out.String(), "Removed finalizer"); removed != 2 {
+		t.Errorf("Expected 2 removals to be listed\ngot output: %s", out.String())
+	}
+}
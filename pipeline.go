@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/controller"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	EnvAnnotationAllow   = "ANNOTATION_ALLOW"
+	EnvAnnotationDeny    = "ANNOTATION_DENY"
+	EnvCIDRPolicy        = "CIDR_POLICY"
+	EnvExcludePorts      = "EXCLUDE_PORTS"
+	EnvHealthCheck       = "HEALTH_CHECK"
+	EnvLabelAllow        = "LABEL_ALLOW"
+	EnvLabelDeny         = "LABEL_DENY"
+	EnvLocalIPFamilies   = "LOCAL_IP_FAMILIES"
+	EnvLocalPodCIDRs     = "LOCAL_POD_CIDRS"
+	EnvLocalServiceCIDRs = "LOCAL_SERVICE_CIDRS"
+	EnvNotReadyPolicy    = "NOT_READY_POLICY"
+	EnvPipelineConfig    = "PIPELINE_CONFIG"
+	EnvRemoteCIDRs       = "REMOTE_CIDRS"
+)
+
+var (
+	// Every transformer the pipeline config can refer to
+	registry = controller.NewDefaultRegistry()
+	// The transformers requests go through, either from the pipeline config file or built from the flags
+	pipeline *controller.PipelineConfig
+	// Optional. If set, the pipeline is read from this file and the transformer flags below are ignored
+	pipelineConfigPath string
+
+	notReadyPolicy     string
+	healthCheck        string
+	healthCheckTimeout time.Duration
+	healthCheckPath    string
+	healthCheckCache   time.Duration
+	remoteCIDRs        string
+	localPodCIDRs      string
+	localServiceCIDRs  string
+	cidrPolicy         string
+	labelAllow         string
+	labelDeny          string
+	annotationAllow    string
+	annotationDeny     string
+	excludePorts       string
+	localIPFamilies    string
+)
+
+func registerPipelineFlags() {
+	flag.StringVar(&pipelineConfigPath, "pipeline-config", os.Getenv(EnvPipelineConfig), "Path to a YAML file with the transformers services and endpoints go through. If unset, the pipeline is built from the flags below")
+	flag.StringVar(&notReadyPolicy, "not-ready-policy", envOr(EnvNotReadyPolicy, string(controller.NotReadyKeep)), "How not ready remote addresses are copied over: keep them as not ready, drop them, or promote them to ready if the remote service publishes not ready addresses")
+	flag.StringVar(&healthCheck, "health-check", os.Getenv(EnvHealthCheck), "Probe remote addresses from the local cluster before publishing them, with tcp or http checks. Disabled if unset")
+	flag.DurationVar(&healthCheckTimeout, "health-check-timeout", time.Second, "Timeout for each health check")
+	flag.StringVar(&healthCheckPath, "health-check-path", "/", "Path requested by http health checks")
+	flag.DurationVar(&healthCheckCache, "health-check-cache", 30*time.Second, "How long a health check result is reused before the address is checked again")
+	flag.StringVar(&remoteCIDRs, "remote-cidrs", os.Getenv(EnvRemoteCIDRs), "Comma separated CIDRs the remote addresses must be in. Any address is allowed if unset")
+	flag.StringVar(&localPodCIDRs, "local-pod-cidrs", os.Getenv(EnvLocalPodCIDRs), "Comma separated pod CIDRs of the local cluster, which remote addresses must not be in")
+	flag.StringVar(&localServiceCIDRs, "local-service-cidrs", os.Getenv(EnvLocalServiceCIDRs), "Comma separated service CIDRs of the local cluster, which remote addresses must not be in")
+	flag.StringVar(&labelAllow, "label-allow", envOr(EnvLabelAllow, "*"), "Comma separated globs of remote label keys that are propagated to followers. A trailing * is a prefix")
+	flag.StringVar(&labelDeny, "label-deny", os.Getenv(EnvLabelDeny), "Comma separated globs of remote label keys that are never propagated to followers")
+	flag.StringVar(&annotationAllow, "annotation-allow", os.Getenv(EnvAnnotationAllow), "Comma separated globs of remote annotation keys that are propagated to followers. None are if unset")
+	flag.StringVar(&annotationDeny, "annotation-deny", os.Getenv(EnvAnnotationDeny), "Comma separated globs of remote annotation keys that are never propagated to followers")
+	flag.StringVar(&excludePorts, "exclude-ports", os.Getenv(EnvExcludePorts), "Comma separated names or numbers of remote ports that followers never expose")
+	flag.StringVar(&localIPFamilies, "local-ip-families", os.Getenv(EnvLocalIPFamilies), "Comma separated IP families the local cluster can route, IPv4 and/or IPv6. Remote addresses of other families are left out. Defaults to the family of the local kubernetes service")
+	flag.StringVar(&cidrPolicy, "cidr-policy", envOr(EnvCIDRPolicy, string(controller.CIDRFilterAddresses)), "What happens to remote endpoints with addresses that aren't allowed: filter the addresses out, or reject the whole endpoints")
+}
+
+// Reads the pipeline config file if there is one, otherwise the pipeline is built from the flags
+func loadPipelineConfig() error {
+	if pipelineConfigPath != "" {
+		config, err := controller.LoadPipelineConfig(pipelineConfigPath)
+		if err != nil {
+			return err
+		}
+		pipeline = config
+		return nil
+	}
+	config, err := flagPipelineConfig()
+	if err != nil {
+		return err
+	}
+	pipeline = config
+	return nil
+}
+
+// A transformer and its parameters, before they're marshalled into the pipeline config
+type pipelineStep struct {
+	name   string
+	params interface{}
+}
+
+// The pipeline the flags describe. The CIDR filter and health checks are only added if they're configured
+func flagPipelineConfig() (*controller.PipelineConfig, error) {
+	var families []controller.IPFamily
+	var err error
+	if localIPFamilies != "" {
+		if families, err = controller.ParseIPFamilies(localIPFamilies); err != nil {
+			return nil, err
+		}
+	}
+	metaFilter := &controller.MetaFilter{
+		Labels:      controller.KeyFilter{Allow: splitList(labelAllow), Deny: splitList(labelDeny)},
+		Annotations: controller.KeyFilter{Allow: splitList(annotationAllow), Deny: splitList(annotationDeny)},
+	}
+	common := []pipelineStep{
+		{name: "augmenter"},
+		{name: "whitelist"},
+		{name: "annotation-filter", params: metaFilter},
+		{name: "label"},
+		{name: "port-filter", params: &controller.Ports{Exclude: splitList(excludePorts)}},
+	}
+
+	services := append(append([]pipelineStep{}, common...), pipelineStep{name: "source"})
+
+	endpoints := append(append([]pipelineStep{}, common...),
+		pipelineStep{name: "readiness", params: &controller.Readiness{Policy: controller.NotReadyPolicy(notReadyPolicy)}},
+		pipelineStep{name: "ip-families", params: &controller.IPFamilies{Families: families}},
+	)
+	remote := splitList(remoteCIDRs)
+	local := append(splitList(localPodCIDRs), splitList(localServiceCIDRs)...)
+	if len(remote) > 0 || len(local) > 0 {
+		endpoints = append(endpoints, pipelineStep{name: "cidr-filter", params: &controller.CIDRFilterConfig{
+			Policy: controller.CIDRPolicy(cidrPolicy),
+			Remote: remote,
+			Local:  local,
+		}})
+	}
+	if healthCheck != "" {
+		endpoints = append(endpoints, pipelineStep{name: "health-check", params: &controller.HealthCheckConfig{
+			Mode:    healthCheck,
+			Timeout: healthCheckTimeout.String(),
+			Path:    healthCheckPath,
+			Cache:   healthCheckCache.String(),
+			// Addresses the readiness step dropped mustn't come back as not ready ones
+			NotReadyPolicy: controller.NotReadyPolicy(notReadyPolicy),
+		}})
+	}
+	endpoints = append(endpoints, pipelineStep{name: "targets"}, pipelineStep{name: "source"})
+
+	config := &controller.PipelineConfig{}
+	if config.Services, err = transformerConfigs(services); err != nil {
+		return nil, err
+	}
+	if config.Endpoints, err = transformerConfigs(endpoints); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Builds the transformers once, so a bad pipeline is caught at startup rather than when the first request comes in
+func validatePipeline(localClient, remoteClient kubernetes.Interface) error {
+	deps := pipelineDependencies(localClient, remoteClient)
+	if _, err := registry.ServiceTransformers(deps, pipeline.Services); err != nil {
+		return err
+	}
+	_, err := registry.EndpointsTransformers(deps, pipeline.Endpoints)
+	return err
+}
+
+// The transformers every service request goes through
+func serviceTransformers(localClient, remoteClient kubernetes.Interface) []controller.ServiceTransformer {
+	transformers, err := registry.ServiceTransformers(pipelineDependencies(localClient, remoteClient), pipeline.Services)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	return transformers
+}
+
+// The transformers every endpoints request goes through
+func endpointsTransformers(localClient, remoteClient kubernetes.Interface) []controller.EndpointsTransformer {
+	transformers, err := registry.EndpointsTransformers(pipelineDependencies(localClient, remoteClient), pipeline.Endpoints)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	return transformers
+}
+
+func pipelineDependencies(localClient, remoteClient kubernetes.Interface) *controller.Dependencies {
+	return &controller.Dependencies{
+		LocalClient:   localClient,
+		RemoteClient:  remoteClient,
+		Recorder:      eventRecorder,
+		LocalCluster:  clusterName,
+		RemoteCluster: remoteClusterName,
+	}
+}
+
+func transformerConfigs(steps []pipelineStep) ([]controller.TransformerConfig, error) {
+	configs := []controller.TransformerConfig{}
+	for _, step := range steps {
+		config := controller.TransformerConfig{Name: step.name}
+		if step.params != nil {
+			params, err := json.Marshal(step.params)
+			if err != nil {
+				return nil, err
+			}
+			config.Params = params
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
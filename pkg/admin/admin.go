@@ -0,0 +1,157 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strings"
+
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/logging"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/retry"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/state"
+	"go.uber.org/zap"
+
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var (
+	logger = logging.Logger
+)
+
+// Server serves the metrics and a JSON API for looking at the controller's state. The API is authenticated
+// with a bearer token, and is disabled if no token is set. The metrics aren't authenticated
+type Server struct {
+	Addr    string
+	Token   string
+	Tracker *state.Tracker
+	// Optional. Used to look up the current leader
+	Lock resourcelock.Interface
+	// Optional. Used to list and replay the dead letters
+	Retries *retry.Tracker
+}
+
+func New(addr, token string, tracker *state.Tracker, lock resourcelock.Interface) *Server {
+	return &Server{
+		Addr:    addr,
+		Token:   token,
+		Tracker: tracker,
+		Lock:    lock,
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	if s.Token == "" {
+		logger.Info("No admin token set, the admin API is disabled")
+		return mux
+	}
+	mux.HandleFunc("/admin/state", s.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Tracker.Snapshot())
+	}))
+	mux.HandleFunc("/admin/exports", s.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Tracker.Snapshot().Exports)
+	}))
+	mux.HandleFunc("/admin/followers", s.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Tracker.Snapshot().Followers)
+	}))
+	mux.HandleFunc("/admin/errors", s.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Tracker.Snapshot().Errors)
+	}))
+	mux.HandleFunc("/admin/queues", s.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Tracker.Snapshot().Queues)
+	}))
+	mux.HandleFunc("/admin/cleaner", s.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Tracker.Snapshot().Cleaner)
+	}))
+	mux.HandleFunc("/admin/leader", s.authenticated(s.leader))
+	mux.HandleFunc("/admin/deadletters", s.authenticated(s.deadLetters))
+	mux.HandleFunc("/admin/deadletters/replay", s.authenticated(s.replay))
+	return mux
+}
+
+func (s *Server) Run() {
+	logger.Info("Starting admin server", zap.String("addr", s.Addr))
+	if err := http.ListenAndServe(s.Addr, s.Handler()); err != nil {
+		ferrors.Error(err)
+	}
+}
+
+// Reads the current leader straight from the leader election lock, so it's correct on every replica
+func (s *Server) leader(w http.ResponseWriter, r *http.Request) {
+	if s.Lock == nil {
+		http.Error(w, "leader election is not set up", http.StatusNotFound)
+		return
+	}
+	record, err := s.Lock.Get()
+	if err != nil {
+		ferrors.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"identity": s.Lock.Identity(),
+		"leader":   record,
+	})
+}
+
+func (s *Server) deadLetters(w http.ResponseWriter, r *http.Request) {
+	if s.Retries == nil {
+		http.Error(w, "retries are not tracked", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.Retries.DeadLetters())
+}
+
+// Replays a single dead letter given its kind, namespace and name, or every dead letter if none is given
+func (s *Server) replay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Retries == nil {
+		http.Error(w, "retries are not tracked", http.StatusNotFound)
+		return
+	}
+	// Replays would go out while the followers are expired, and undo it
+	if s.Retries.Paused() {
+		http.Error(w, "retries are paused", http.StatusConflict)
+		return
+	}
+	query := r.URL.Query()
+	kind, namespace, name := query.Get("kind"), query.Get("namespace"), query.Get("name")
+	if kind == "" && namespace == "" && name == "" {
+		writeJSON(w, map[string]int{"replayed": s.Retries.ReplayAll()})
+		return
+	}
+	switch err := s.Retries.Replay(kind, namespace, name); err {
+	case nil:
+	case retry.ErrPaused:
+		http.Error(w, "retries are paused", http.StatusConflict)
+		return
+	default:
+		http.Error(w, "not a dead letter", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]int{"replayed": 1})
+}
+
+func (s *Server) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		ferrors.Error(err)
+	}
+}
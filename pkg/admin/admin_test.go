@@ -0,0 +1,124 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/retry"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/state"
+)
+
+func TestServerAuthentication(t *testing.T) {
+	testCases := []struct {
+		ServerToken   string
+		RequestHeader string
+		Path          string
+		Expected      int
+	}{
+		// Correct token is let through
+		{
+			ServerToken:   "secret",
+			RequestHeader: "Bearer secret",
+			Path:          "/admin/state",
+			Expected:      http.StatusOK,
+		},
+		// Wrong token is rejected
+		{
+			ServerToken:   "secret",
+			RequestHeader: "Bearer guess",
+			Path:          "/admin/state",
+			Expected:      http.StatusUnauthorized,
+		},
+		// Missing token is rejected
+		{
+			ServerToken: "secret",
+			Path:        "/admin/followers",
+			Expected:    http.StatusUnauthorized,
+		},
+		// Admin API isn't served at all without a server token
+		{
+			Path:     "/admin/state",
+			Expected: http.StatusNotFound,
+		},
+		// Metrics don't need a token
+		{
+			ServerToken: "secret",
+			Path:        "/debug/vars",
+			Expected:    http.StatusOK,
+		},
+	}
+
+	for _, testCase := range testCases {
+		server := New(":0", testCase.ServerToken, state.New(1), nil)
+		req := httptest.NewRequest(http.MethodGet, testCase.Path, nil)
+		if testCase.RequestHeader != "" {
+			req.Header.Set("Authorization", testCase.RequestHeader)
+		}
+		recorder := httptest.NewRecorder()
+		server.Handler().ServeHTTP(recorder, req)
+		if recorder.Code != testCase.Expected {
+			t.Errorf("Expected status %d for %s, got %d", testCase.Expected, testCase.Path, recorder.Code)
+		}
+	}
+}
+
+func TestServerFollowers(t *testing.T) {
+	tracker := state.New(1)
+	tracker.RecordWrite("services", "add", "bar", "foo", false, nil)
+	server := New(":0", "secret", tracker, nil)
+	req := httptest.NewRequest(http.MethodGet, "/admin/followers", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, req)
+
+	followers := []state.Follower{}
+	if err := json.NewDecoder(recorder.Body).Decode(&followers); err != nil {
+		t.Fatalf("Could not decode followers %v", err)
+	}
+	if len(followers) != 1 || followers[0].Name != "foo" || !followers[0].Synced {
+		t.Errorf("Expected the synced foo follower, got %+v", followers)
+	}
+}
+
+func TestServerReplay(t *testing.T) {
+	retries := retry.New(1)
+	resent := 0
+	retries.Failed("services", "bar", "foo", errors.New("oh no"), func() { resent++ })
+	server := New(":0", "secret", state.New(1), nil)
+	server.Retries = retries
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/deadletters", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, req)
+	deadLetters := []retry.DeadLetter{}
+	if err := json.NewDecoder(recorder.Body).Decode(&deadLetters); err != nil {
+		t.Fatalf("Could not decode dead letters %v", err)
+	}
+	if len(deadLetters) != 1 || deadLetters[0].Name != "foo" {
+		t.Errorf("Expected the foo dead letter, got %+v", deadLetters)
+	}
+
+	// Nothing is replayed while retries are paused
+	paused := true
+	retries.SetPaused(func() bool { return paused })
+	req = httptest.NewRequest(http.MethodPost, "/admin/deadletters/replay?kind=services&namespace=bar&name=foo", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusConflict || resent != 0 {
+		t.Errorf("Expected the replay to be refused while paused, got status %d and %d resends", recorder.Code, resent)
+	}
+
+	paused = false
+	req = httptest.NewRequest(http.MethodPost, "/admin/deadletters/replay?kind=services&namespace=bar&name=foo", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || resent != 1 {
+		t.Errorf("Expected the foo dead letter to be replayed, got status %d and %d resends", recorder.Code, resent)
+	}
+}
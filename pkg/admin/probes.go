@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"net/http"
+
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ProbeServer serves the liveness and readiness probes. It's kept on its own port so the probes don't need the admin token,
+// and the admin API doesn't need to be reachable by the kubelet
+type ProbeServer struct {
+	Addr string
+	// Optional. Reports whether the replica is ready. It's always ready if unset
+	Ready func() bool
+}
+
+func NewProbeServer(addr string) *ProbeServer {
+	return &ProbeServer{
+		Addr: addr,
+	}
+}
+
+func (p *ProbeServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if p.Ready != nil && !p.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	return mux
+}
+
+func (p *ProbeServer) Run() {
+	logger.Info("Starting probe server", zap.String("addr", p.Addr))
+	if err := http.ListenAndServe(p.Addr, p.Handler()); err != nil {
+		ferrors.Error(err)
+	}
+}
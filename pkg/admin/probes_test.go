@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProbeServerReadiness(t *testing.T) {
+	testCases := []struct {
+		Ready    func() bool
+		Expected int
+	}{
+		// Always ready without a readiness check
+		{
+			Expected: http.StatusOK,
+		},
+		// Ready once the check passes
+		{
+			Ready:    func() bool { return true },
+			Expected: http.StatusOK,
+		},
+		// Not ready while the check fails
+		{
+			Ready:    func() bool { return false },
+			Expected: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, testCase := range testCases {
+		server := NewProbeServer(":0")
+		server.Ready = testCase.Ready
+		recorder := httptest.NewRecorder()
+		server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if recorder.Code != testCase.Expected {
+			t.Errorf("Expected status %d, got %d", testCase.Expected, recorder.Code)
+		}
+	}
+}
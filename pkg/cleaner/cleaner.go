@@ -1,11 +1,17 @@
 package cleaner
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
 	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
 	"github.com/wearefair/k8-cross-cluster-controller/pkg/logging"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/retry"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/state"
+	"go.uber.org/zap"
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -28,6 +34,11 @@ type Cleaner struct {
 	RemoteClient   kubernetes.Interface
 	EndpointWriter chan *k8.EndpointsRequest
 	ServiceWriter  chan *k8.ServiceRequest
+	// Only followers in namespaces in the shard are cleaned. The zero value cleans everything
+	Shard k8.Shard
+	// Optional. If set along with ReplayDeadLetters, the dead lettered objects are replayed on every pass
+	Retries           *retry.Tracker
+	ReplayDeadLetters bool
 }
 
 func New(localClient, remoteClient kubernetes.Interface, endpointWriter chan *k8.EndpointsRequest, serviceWriter chan *k8.ServiceRequest) *Cleaner {
@@ -39,59 +50,153 @@ func New(localClient, remoteClient kubernetes.Interface, endpointWriter chan *k8
 	}
 }
 
-func (c *Cleaner) Run(stopChan <-chan struct{}) {
+func (c *Cleaner) Run(ctx context.Context) {
 	logger.Info("Starting cleaner")
 	ticker := time.NewTicker(defaultSleepTime)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-stopChan:
+		case <-ctx.Done():
 			logger.Info("Received stopped signal. Stopping clean")
 			return
 		case <-ticker.C:
-			// If there is a service or endpoint that's local that no longer exists on remote side, send a deletion event
-			c.cleanOrphanedServices(c.listLocalServices(), c.listRemoteServices())
-			c.cleanOrphanedEndpoints(c.listLocalEndpoints(), c.listRemoteEndpoints())
+			c.clean(ctx)
 		}
 	}
 }
 
-func (c *Cleaner) cleanOrphanedServices(localServices, remoteServices []v1.Service) {
+// If there is a service or endpoint that's local that no longer exists on remote side, send a deletion event.
+// A kind is skipped if either side can't be listed, otherwise an unreachable remote would look like it has no exports.
+// The result of the pass is recorded so it can be looked at through the admin API
+func (c *Cleaner) clean(ctx context.Context) {
+	result := state.CleanerResult{Started: time.Now().UTC()}
+	localServices, localErr := c.listLocalServices()
+	remoteServices, remoteErr := c.listRemoteServices()
+	result.Errors = appendErrors(result.Errors, localErr, remoteErr)
+	if localErr == nil && remoteErr == nil {
+		result.DeletedServices = c.cleanOrphanedServices(ctx, localServices, remoteServices)
+		remote := map[string]bool{}
+		for _, remoteService := range remoteServices {
+			remote[objectKey(remoteService.ObjectMeta)] = true
+		}
+		c.forgetDeadLetters(k8.K8Services, result.DeletedServices, remote)
+	}
+
+	localEndpoints, localErr := c.listLocalEndpoints()
+	remoteEndpoints, remoteErr := c.listRemoteEndpoints()
+	result.Errors = appendErrors(result.Errors, localErr, remoteErr)
+	if localErr == nil && remoteErr == nil {
+		result.DeletedEndpoints = c.cleanOrphanedEndpoints(ctx, localEndpoints, remoteEndpoints)
+		remote := map[string]bool{}
+		for _, remoteEndpoint := range remoteEndpoints {
+			remote[objectKey(remoteEndpoint.ObjectMeta)] = true
+		}
+		c.forgetDeadLetters(k8.K8Endpoints, result.DeletedEndpoints, remote)
+	}
+
+	result.Finished = time.Now().UTC()
+	metrics.CleanerRuns.Add(1)
+	metrics.CleanerDeletes.Add(k8.K8Services, int64(len(result.DeletedServices)))
+	metrics.CleanerDeletes.Add(k8.K8Endpoints, int64(len(result.DeletedEndpoints)))
+	state.Default.RecordCleaner(result)
+
+	if c.ReplayDeadLetters && c.Retries != nil {
+		if replayed := c.Retries.ReplayAll(); replayed > 0 {
+			logger.Info("Replayed dead letters", zap.Int("count", replayed))
+		}
+	}
+}
+
+// Returns the namespace/name of every service queued for deletion
+// Stops queueing deletions once the context is done
+func (c *Cleaner) cleanOrphanedServices(ctx context.Context, localServices, remoteServices []v1.Service) []string {
+	deleted := []string{}
 	for _, localService := range localServices {
+		if namespace, _ := k8.RemoteLocation(localService.ObjectMeta); !c.Shard.Contains(namespace) {
+			continue
+		}
 		if exists := c.checkServiceExists(localService, remoteServices); !exists {
 			req := &k8.ServiceRequest{
 				Type:         k8.RequestTypeDelete,
 				LocalService: &localService,
 			}
-			c.ServiceWriter <- req
+			state.Default.Enqueue(k8.K8Services, k8.RequestTypeMap[req.Type], localService.ObjectMeta.Namespace, localService.Name)
+			select {
+			case <-ctx.Done():
+				return deleted
+			case c.ServiceWriter <- req:
+			}
+			deleted = append(deleted, objectKey(localService.ObjectMeta))
+		}
+	}
+	return deleted
+}
+
+// Forgets the dead letters of the followers deleted on this pass, and of the ones whose remote object is gone, so
+// replaying them doesn't write the follower again. The transformer pipeline's dead letters are keyed by the remote
+// object, so they're only checked against the remote objects
+func (c *Cleaner) forgetDeadLetters(kind string, deleted []string, remote map[string]bool) {
+	if c.Retries == nil {
+		return
+	}
+	deletedKeys := map[string]bool{}
+	for _, key := range deleted {
+		deletedKeys[key] = true
+	}
+	for _, deadLetter := range c.Retries.DeadLetters() {
+		if deadLetter.Kind != kind && deadLetter.Kind != kind+k8.TransformKindSuffix {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s", deadLetter.Namespace, deadLetter.Name)
+		remoteKey := fmt.Sprintf("%s/%s", deadLetter.RemoteNamespace, deadLetter.RemoteName)
+		if (deadLetter.Kind == kind && deletedKeys[key]) || !remote[remoteKey] {
+			logger.Info("Forgetting dead letter of a deleted object", zap.String("kind", deadLetter.Kind),
+				zap.String("name", deadLetter.Name), zap.String("namespace", deadLetter.Namespace))
+			c.Retries.Forget(deadLetter.Kind, deadLetter.Namespace, deadLetter.Name)
 		}
 	}
 }
 
+// Followers can be moved to a different namespace or name, so they're matched on where they came from
 func (c *Cleaner) checkServiceExists(localService v1.Service, remoteServices []v1.Service) bool {
+	namespace, name := k8.RemoteLocation(localService.ObjectMeta)
 	for _, remoteService := range remoteServices {
-		if (remoteService.ObjectMeta.Namespace == localService.ObjectMeta.Namespace) && (localService.Name == remoteService.Name) {
+		if (remoteService.ObjectMeta.Namespace == namespace) && (name == remoteService.Name) {
 			return true
 		}
 	}
 	return false
 }
 
-func (c *Cleaner) cleanOrphanedEndpoints(localEndpoints, remoteEndpoints []v1.Endpoints) {
+// Returns the namespace/name of every endpoints queued for deletion
+// Stops queueing deletions once the context is done
+func (c *Cleaner) cleanOrphanedEndpoints(ctx context.Context, localEndpoints, remoteEndpoints []v1.Endpoints) []string {
+	deleted := []string{}
 	for _, localEndpoint := range localEndpoints {
+		if namespace, _ := k8.RemoteLocation(localEndpoint.ObjectMeta); !c.Shard.Contains(namespace) {
+			continue
+		}
 		if exists := c.checkEndpointsExists(localEndpoint, remoteEndpoints); !exists {
 			req := &k8.EndpointsRequest{
 				Type:           k8.RequestTypeDelete,
 				LocalEndpoints: &localEndpoint,
 			}
-			c.EndpointWriter <- req
+			state.Default.Enqueue(k8.K8Endpoints, k8.RequestTypeMap[req.Type], localEndpoint.ObjectMeta.Namespace, localEndpoint.Name)
+			select {
+			case <-ctx.Done():
+				return deleted
+			case c.EndpointWriter <- req:
+			}
+			deleted = append(deleted, objectKey(localEndpoint.ObjectMeta))
 		}
 	}
+	return deleted
 }
 
 func (c *Cleaner) checkEndpointsExists(localEndpoint v1.Endpoints, remoteEndpoints []v1.Endpoints) bool {
+	namespace, name := k8.RemoteLocation(localEndpoint.ObjectMeta)
 	for _, remoteEndpoint := range remoteEndpoints {
-		if (remoteEndpoint.ObjectMeta.Namespace == localEndpoint.ObjectMeta.Namespace) && (localEndpoint.Name == remoteEndpoint.Name) {
+		if (remoteEndpoint.ObjectMeta.Namespace == namespace) && (name == remoteEndpoint.Name) {
 			return true
 		}
 	}
@@ -99,53 +204,62 @@ func (c *Cleaner) checkEndpointsExists(localEndpoint v1.Endpoints, remoteEndpoin
 }
 
 // Lists all endpoints that are local with the cross cluster label
-func (c *Cleaner) listLocalEndpoints() []v1.Endpoints {
+func (c *Cleaner) listLocalEndpoints() ([]v1.Endpoints, error) {
 	logger.Info("Listing local endpoints for clean")
 	list, err := c.LocalClient.CoreV1().Endpoints(metav1.NamespaceAll).List(k8.LocalFilter)
 	// If there's an error, we want to report it, but we don't necessarily need to propagate it
 	if err != nil {
-		ferrors.Error(err)
-		return []v1.Endpoints{}
+		return []v1.Endpoints{}, ferrors.Error(err)
 	}
-	return list.Items
+	return list.Items, nil
 }
 
 // List all services that are local with the cross cluster label
-func (c *Cleaner) listLocalServices() []v1.Service {
+func (c *Cleaner) listLocalServices() ([]v1.Service, error) {
 	logger.Info("Listing local services for clean")
 	list, err := c.LocalClient.CoreV1().Services(metav1.NamespaceAll).List(k8.LocalFilter)
 	// If there's an error, we want to report it, but we don't necessarily need to propagate it
 	if err != nil {
-		ferrors.Error(err)
-		return []v1.Service{}
+		return []v1.Service{}, ferrors.Error(err)
 	}
-	return list.Items
+	return list.Items, nil
 }
 
 // Lists all services that are remote with the cross cluster label
-func (c *Cleaner) listRemoteServices() []v1.Service {
+func (c *Cleaner) listRemoteServices() ([]v1.Service, error) {
 	opts := &metav1.ListOptions{}
 	k8.RemoteFilter(opts)
 	logger.Info("Listing remote services for clean")
 	list, err := c.RemoteClient.CoreV1().Services(metav1.NamespaceAll).List(*opts)
 	// If there's an error, we want to report it, but we don't necessarily need to propagate it
 	if err != nil {
-		ferrors.Error(err)
-		return []v1.Service{}
+		return []v1.Service{}, ferrors.Error(err)
 	}
-	return list.Items
+	return list.Items, nil
 }
 
 // Lists all endpoints that are remote with the cross cluster label
-func (c *Cleaner) listRemoteEndpoints() []v1.Endpoints {
+func (c *Cleaner) listRemoteEndpoints() ([]v1.Endpoints, error) {
 	opts := &metav1.ListOptions{}
 	k8.RemoteFilter(opts)
 	logger.Info("Listing remote services for clean")
 	list, err := c.RemoteClient.CoreV1().Endpoints(metav1.NamespaceAll).List(*opts)
 	// If there's an error, we want to report it, but we don't necessarily need to propagate it
 	if err != nil {
-		ferrors.Error(err)
-		return []v1.Endpoints{}
+		return []v1.Endpoints{}, ferrors.Error(err)
+	}
+	return list.Items, nil
+}
+
+func objectKey(meta metav1.ObjectMeta) string {
+	return fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
+}
+
+func appendErrors(errs []string, newErrs ...error) []string {
+	for _, err := range newErrs {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
 	}
-	return list.Items
+	return errs
 }
@@ -1,14 +1,20 @@
 package cleaner
 
 import (
+	"context"
+	"errors"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/retry"
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8testing "k8s.io/client-go/testing"
 )
 
 func TestCleanOrphanedEndpoints(t *testing.T) {
@@ -121,7 +127,7 @@ func TestCleanOrphanedEndpoints(t *testing.T) {
 		cleaner := &Cleaner{
 			EndpointWriter: make(chan *k8.EndpointsRequest, 4),
 		}
-		cleaner.cleanOrphanedEndpoints(testCase.LocalEndpoints, testCase.RemoteEndpoints)
+		cleaner.cleanOrphanedEndpoints(context.Background(), testCase.LocalEndpoints, testCase.RemoteEndpoints)
 		reqs := []*k8.EndpointsRequest{}
 	OUTER:
 		for {
@@ -251,7 +257,7 @@ func TestCleanOrphanedServices(t *testing.T) {
 		cleaner := &Cleaner{
 			ServiceWriter: make(chan *k8.ServiceRequest, 4),
 		}
-		cleaner.cleanOrphanedServices(testCase.LocalService, testCase.RemoteService)
+		cleaner.cleanOrphanedServices(context.Background(), testCase.LocalService, testCase.RemoteService)
 		reqs := []*k8.ServiceRequest{}
 	OUTER:
 		for {
@@ -270,3 +276,53 @@ func TestCleanOrphanedServices(t *testing.T) {
 		}
 	}
 }
+
+func TestCleanUnreachableRemote(t *testing.T) {
+	follower := map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceLocalLabelValue}
+	localClient := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: follower}},
+		&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: follower}},
+	)
+	remoteClient := fake.NewSimpleClientset()
+	remoteClient.PrependReactor("list", "*", func(k8testing.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("unreachable")
+	})
+	serviceWriter := make(chan *k8.ServiceRequest, 2)
+	endpointsWriter := make(chan *k8.EndpointsRequest, 2)
+	cleaner := New(localClient, remoteClient, endpointsWriter, serviceWriter)
+
+	// Remote exports that can't be listed aren't gone, so nothing is deleted
+	cleaner.clean(context.Background())
+	if len(serviceWriter) != 0 || len(endpointsWriter) != 0 {
+		t.Errorf("Expected no deletes\ngot: %d services and %d endpoints", len(serviceWriter), len(endpointsWriter))
+	}
+}
+
+func TestCleanForgetsDeadLetters(t *testing.T) {
+	follower := map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceLocalLabelValue}
+	exported := map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceRemoteLabelValue}
+	localClient := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "deleted", Namespace: "bar", Labels: follower}},
+	)
+	remoteClient := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "kept", Namespace: "bar", Labels: exported}},
+	)
+	retries := retry.New(1)
+	resent := []string{}
+	for _, name := range []string{"deleted", "gone", "kept"} {
+		name := name
+		retries.Failed(k8.K8Services, "bar", name, errors.New("oh no"), func() { resent = append(resent, name) })
+	}
+	retries.Failed(k8.K8Services+k8.TransformKindSuffix, "bar", "gone", errors.New("oh no"), func() { resent = append(resent, "gone-transform") })
+	serviceWriter := make(chan *k8.ServiceRequest, 1)
+	endpointsWriter := make(chan *k8.EndpointsRequest, 1)
+	cleaner := New(localClient, remoteClient, endpointsWriter, serviceWriter)
+	cleaner.Retries = retries
+	cleaner.ReplayDeadLetters = true
+
+	// The deleted follower and the ones whose remote service is gone aren't written again
+	cleaner.clean(context.Background())
+	if !reflect.DeepEqual([]string{"kept"}, resent) {
+		t.Errorf("Expected resends: [kept]\ngot: %v", resent)
+	}
+}
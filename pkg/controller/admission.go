@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	ErrInvalidAdmissionRule = errors.New("Admission rules need a name and an expression.")
+)
+
+// AdmissionRule only lets remote services be exported if its expression is true. The expression can use `service`,
+// the remote service as JSON, and `cluster.local` and `cluster.remote`, the names of the clusters
+type AdmissionRule struct {
+	// Used in logs and metrics
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	// Optional. Logged when the rule denies a service, instead of the expression
+	Message string `json:"message"`
+
+	compiled *Expression
+}
+
+// Admission checks remote services against the rules before they're exported. Endpoints are checked against their
+// service, so a denied service doesn't get follower endpoints either
+type Admission struct {
+	Rules         []AdmissionRule      `json:"rules"`
+	LocalCluster  string               `json:"-"`
+	RemoteCluster string               `json:"-"`
+	RemoteClient  kubernetes.Interface `json:"-"`
+}
+
+// Compile parses the rules' expressions, so broken rules stop the controller at startup
+func (a *Admission) Compile() error {
+	for i := range a.Rules {
+		rule := &a.Rules[i]
+		if rule.Name == "" || rule.Expression == "" {
+			return ErrInvalidAdmissionRule
+		}
+		compiled, err := ParseExpression(rule.Expression, "service", "cluster")
+		if err != nil {
+			return fmt.Errorf("Admission rule %s: %s", rule.Name, err.Error())
+		}
+		rule.compiled = compiled
+	}
+	return nil
+}
+
+// Service denies remote services that break a rule. Deletes are always let through
+func (a *Admission) Service(req *k8.ServiceRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	return a.admit(req.RemoteService)
+}
+
+// Endpoints denies remote endpoints whose service breaks a rule. Deletes are always let through
+func (a *Admission) Endpoints(req *k8.EndpointsRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	svc, err := a.RemoteClient.CoreV1().Services(req.RemoteEndpoints.ObjectMeta.Namespace).Get(req.RemoteEndpoints.Name, metav1.GetOptions{})
+	if err != nil {
+		// There's no service to check, and the cleaner takes care of endpoints without one
+		if k8.ResourceNotExist(err) {
+			return nil
+		}
+		return ferrors.Error(err)
+	}
+	return a.admit(svc)
+}
+
+func (a *Admission) admit(svc *v1.Service) error {
+	vars, err := a.variables(svc)
+	if err != nil {
+		return ferrors.Error(err)
+	}
+	for _, rule := range a.Rules {
+		allowed, err := rule.compiled.Eval(vars)
+		if err != nil {
+			return fmt.Errorf("Admission rule %s failed: %s", rule.Name, err.Error())
+		}
+		if allowed {
+			continue
+		}
+		reason := rule.Message
+		if reason == "" {
+			reason = fmt.Sprintf("%s is false", rule.Expression)
+		}
+		message := fmt.Sprintf("Export denied by rule %s: %s", rule.Name, reason)
+		logger.Warn(message, zap.String("name", svc.Name), zap.String("namespace", svc.ObjectMeta.Namespace),
+			zap.String("remoteCluster", a.RemoteCluster))
+		metrics.AdmissionDenials.Add(rule.Name, 1)
+		return errors.New(message)
+	}
+	return nil
+}
+
+// The service goes through JSON, so expressions see the same field names as kubectl's JSON output
+func (a *Admission) variables(svc *v1.Service) (map[string]interface{}, error) {
+	data, err := json.Marshal(svc)
+	if err != nil {
+		return nil, err
+	}
+	var service interface{}
+	if err := json.Unmarshal(data, &service); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"service": service,
+		"cluster": map[string]interface{}{"local": a.LocalCluster, "remote": a.RemoteCluster},
+	}, nil
+}
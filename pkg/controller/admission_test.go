@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAdmissionService(t *testing.T) {
+	admission := &Admission{
+		Rules: []AdmissionRule{
+			AdmissionRule{Name: "team", Expression: `"team" in service.metadata.labels`},
+			AdmissionRule{Name: "no-load-balancers", Expression: `service.spec.type != "LoadBalancer"`},
+			AdmissionRule{
+				Name:       "dev-to-prod",
+				Expression: `!(cluster.remote == "dev" && cluster.local == "prod")`,
+				Message:    "nothing is exported from dev to prod",
+			},
+		},
+		LocalCluster: "prod",
+	}
+	if err := admission.Compile(); err != nil {
+		t.Fatalf("Expected the rules to compile\ngot: %s", err.Error())
+	}
+	testCases := []struct {
+		RemoteCluster string
+		Labels        map[string]string
+		Type          v1.ServiceType
+		Err           bool
+	}{
+		// Services that follow every rule are exported
+		{
+			RemoteCluster: "staging",
+			Labels:        map[string]string{"team": "payments"},
+			Type:          v1.ServiceTypeClusterIP,
+		},
+		// Services without a team label are denied
+		{
+			RemoteCluster: "staging",
+			Type:          v1.ServiceTypeClusterIP,
+			Err:           true,
+		},
+		// Load balancers are denied
+		{
+			RemoteCluster: "staging",
+			Labels:        map[string]string{"team": "payments"},
+			Type:          v1.ServiceTypeLoadBalancer,
+			Err:           true,
+		},
+		// Nothing is exported from dev to prod
+		{
+			RemoteCluster: "dev",
+			Labels:        map[string]string{"team": "payments"},
+			Type:          v1.ServiceTypeClusterIP,
+			Err:           true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		admission.RemoteCluster = testCase.RemoteCluster
+		req := &k8.ServiceRequest{
+			Type: k8.RequestTypeAdd,
+			RemoteService: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: testCase.Labels},
+				Spec:       v1.ServiceSpec{Type: testCase.Type},
+			},
+		}
+		if err := admission.Service(req); (err != nil) != testCase.Err {
+			t.Errorf("Expected error: %t\ngot: %v", testCase.Err, err)
+		}
+	}
+}
+
+func TestAdmissionCompile(t *testing.T) {
+	testCases := []struct {
+		Rule AdmissionRule
+		Err  bool
+	}{
+		{Rule: AdmissionRule{Name: "team", Expression: `"team" in service.metadata.labels`}},
+		// Rules need a name and an expression
+		{Rule: AdmissionRule{Expression: `"team" in service.metadata.labels`}, Err: true},
+		{Rule: AdmissionRule{Name: "team"}, Err: true},
+		// Broken expressions stop the controller at startup
+		{Rule: AdmissionRule{Name: "team", Expression: `"team" in labels`}, Err: true},
+	}
+
+	for _, testCase := range testCases {
+		admission := &Admission{Rules: []AdmissionRule{testCase.Rule}}
+		if err := admission.Compile(); (err != nil) != testCase.Err {
+			t.Errorf("Expected error: %t\ngot: %v", testCase.Err, err)
+		}
+	}
+}
+
+func TestAdmissionEndpoints(t *testing.T) {
+	remoteClient := fake.NewSimpleClientset(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"},
+	})
+	admission := &Admission{
+		Rules:        []AdmissionRule{AdmissionRule{Name: "team", Expression: `"team" in service.metadata.labels`}},
+		RemoteClient: remoteClient,
+	}
+	if err := admission.Compile(); err != nil {
+		t.Fatalf("Expected the rules to compile\ngot: %s", err.Error())
+	}
+	testCases := []struct {
+		Type k8.RequestType
+		Name string
+		Err  bool
+	}{
+		// Endpoints of a denied service are denied too
+		{
+			Type: k8.RequestTypeUpdate,
+			Name: "foo",
+			Err:  true,
+		},
+		// Deletes are always let through
+		{
+			Type: k8.RequestTypeDelete,
+			Name: "foo",
+		},
+		// Endpoints without a service are let through for the cleaner
+		{
+			Type: k8.RequestTypeUpdate,
+			Name: "baz",
+		},
+	}
+
+	for _, testCase := range testCases {
+		req := &k8.EndpointsRequest{
+			Type:            testCase.Type,
+			RemoteEndpoints: &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: testCase.Name, Namespace: "bar"}},
+		}
+		if err := admission.Endpoints(req); (err != nil) != testCase.Err {
+			t.Errorf("Expected error: %t\ngot: %v", testCase.Err, err)
+		}
+	}
+}
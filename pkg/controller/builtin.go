@@ -0,0 +1,291 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/prober"
+)
+
+// CIDRFilterConfig is the parameters of the cidr-filter transformer
+type CIDRFilterConfig struct {
+	Policy CIDRPolicy `json:"policy"`
+	// CIDRs the remote addresses must be in
+	Remote []string `json:"remote"`
+	// Local pod and service CIDRs the remote addresses must not be in
+	Local []string `json:"local"`
+}
+
+// HealthCheckConfig is the parameters of the health-check transformer. Durations are strings like "1s". The not ready
+// policy should be the same as the readiness transformer's
+type HealthCheckConfig struct {
+	Mode           string         `json:"mode"`
+	Timeout        string         `json:"timeout"`
+	Path           string         `json:"path"`
+	Cache          string         `json:"cache"`
+	NotReadyPolicy NotReadyPolicy `json:"notReadyPolicy"`
+}
+
+// NewDefaultRegistry has every built in transformer registered
+func NewDefaultRegistry() *Registry {
+	r := NewRegistry()
+
+	r.RegisterService("augmenter", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		augmenter := &Augmenter{Client: deps.LocalClient}
+		return augmenter.Service, nil
+	})
+	r.RegisterEndpoints("augmenter", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		augmenter := &Augmenter{Client: deps.LocalClient}
+		return augmenter.Endpoints, nil
+	})
+	r.RegisterService("whitelist", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		return ServiceWhitelist, nil
+	})
+	r.RegisterEndpoints("whitelist", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		return EndpointsWhitelist, nil
+	})
+	r.RegisterService("label", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		return ServiceLabel, nil
+	})
+	r.RegisterEndpoints("label", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		return EndpointsLabel, nil
+	})
+	r.RegisterService("annotation-filter", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		filter, err := newMetaFilter(params)
+		if err != nil {
+			return nil, err
+		}
+		return filter.Service, nil
+	})
+	r.RegisterEndpoints("annotation-filter", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		filter, err := newMetaFilter(params)
+		if err != nil {
+			return nil, err
+		}
+		return filter.Endpoints, nil
+	})
+	r.RegisterService("port-filter", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		ports := &Ports{RemoteClient: deps.RemoteClient}
+		if err := DecodeParams(params, ports); err != nil {
+			return nil, err
+		}
+		return ports.Service, nil
+	})
+	r.RegisterEndpoints("port-filter", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		ports := &Ports{RemoteClient: deps.RemoteClient}
+		if err := DecodeParams(params, ports); err != nil {
+			return nil, err
+		}
+		return ports.Endpoints, nil
+	})
+	r.RegisterService("source", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		source := &Source{Cluster: deps.RemoteCluster}
+		if err := DecodeParams(params, source); err != nil {
+			return nil, err
+		}
+		return source.Service, nil
+	})
+	r.RegisterEndpoints("source", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		source := &Source{Cluster: deps.RemoteCluster}
+		if err := DecodeParams(params, source); err != nil {
+			return nil, err
+		}
+		return source.Endpoints, nil
+	})
+	r.RegisterService("namespace-map", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		namespaceMap := &NamespaceMap{Client: deps.LocalClient}
+		if err := DecodeParams(params, namespaceMap); err != nil {
+			return nil, err
+		}
+		return namespaceMap.Service, nil
+	})
+	r.RegisterEndpoints("namespace-map", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		namespaceMap := &NamespaceMap{Client: deps.LocalClient}
+		if err := DecodeParams(params, namespaceMap); err != nil {
+			return nil, err
+		}
+		return namespaceMap.Endpoints, nil
+	})
+	r.RegisterService("name-template", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		nameTemplate, err := newNameTemplate(deps, params)
+		if err != nil {
+			return nil, err
+		}
+		return nameTemplate.Service, nil
+	})
+	r.RegisterEndpoints("name-template", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		nameTemplate, err := newNameTemplate(deps, params)
+		if err != nil {
+			return nil, err
+		}
+		return nameTemplate.Endpoints, nil
+	})
+
+	r.RegisterService("admission", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		admission, err := newAdmission(deps, params)
+		if err != nil {
+			return nil, err
+		}
+		return admission.Service, nil
+	})
+	r.RegisterEndpoints("admission", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		admission, err := newAdmission(deps, params)
+		if err != nil {
+			return nil, err
+		}
+		return admission.Endpoints, nil
+	})
+	r.RegisterService("webhook", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		webhook, err := newWebhook(deps, params)
+		if err != nil {
+			return nil, err
+		}
+		return webhook.Service, nil
+	})
+	r.RegisterEndpoints("webhook", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		webhook, err := newWebhook(deps, params)
+		if err != nil {
+			return nil, err
+		}
+		return webhook.Endpoints, nil
+	})
+
+	// Endpoints only
+	r.RegisterEndpoints("readiness", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		readiness := &Readiness{Policy: NotReadyKeep, RemoteClient: deps.RemoteClient}
+		if err := DecodeParams(params, readiness); err != nil {
+			return nil, err
+		}
+		if _, err := ParseNotReadyPolicy(string(readiness.Policy)); err != nil {
+			return nil, err
+		}
+		return readiness.Endpoints, nil
+	})
+	r.RegisterEndpoints("ip-families", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		families := &IPFamilies{Recorder: deps.Recorder}
+		if err := DecodeParams(params, families); err != nil {
+			return nil, err
+		}
+		// Only the local cluster's own family is routed unless it's configured, so a single stack cluster never gets
+		// addresses it can't reach
+		if len(families.Families) == 0 {
+			families.Families = []IPFamily{LocalIPFamily(deps.LocalClient)}
+		}
+		for _, family := range families.Families {
+			if family != IPv4 && family != IPv6 {
+				return nil, ErrInvalidIPFamily
+			}
+		}
+		return families.Endpoints, nil
+	})
+	r.RegisterEndpoints("cidr-filter", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		filter, err := newCIDRFilter(deps, params)
+		if err != nil {
+			return nil, err
+		}
+		return filter.Endpoints, nil
+	})
+	r.RegisterEndpoints("health-check", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		health, err := newHealth(deps, params)
+		if err != nil {
+			return nil, err
+		}
+		return health.Endpoints, nil
+	})
+	r.RegisterEndpoints("targets", func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error) {
+		return EndpointsTargets, nil
+	})
+	return r
+}
+
+func newMetaFilter(params json.RawMessage) (*MetaFilter, error) {
+	filter := &MetaFilter{Labels: KeyFilter{Allow: []string{"*"}}}
+	if err := DecodeParams(params, filter); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func newNameTemplate(deps *Dependencies, params json.RawMessage) (*NameTemplate, error) {
+	nameTemplate := &NameTemplate{Cluster: deps.RemoteCluster, Client: deps.LocalClient}
+	if err := DecodeParams(params, nameTemplate); err != nil {
+		return nil, err
+	}
+	if err := nameTemplate.Parse(); err != nil {
+		return nil, err
+	}
+	return nameTemplate, nil
+}
+
+// The remote ranges are checked against the local ones here, so overlaps are caught when the pipeline is built
+func newCIDRFilter(deps *Dependencies, params json.RawMessage) (*CIDRFilter, error) {
+	config := &CIDRFilterConfig{Policy: CIDRFilterAddresses}
+	if err := DecodeParams(params, config); err != nil {
+		return nil, err
+	}
+	if _, err := ParseCIDRPolicy(string(config.Policy)); err != nil {
+		return nil, err
+	}
+	remote, err := ParseCIDRs(strings.Join(config.Remote, ","))
+	if err != nil {
+		return nil, err
+	}
+	local, err := ParseCIDRs(strings.Join(config.Local, ","))
+	if err != nil {
+		return nil, err
+	}
+	if err := CIDROverlap(remote, local); err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrCIDROverlap.Error(), err.Error())
+	}
+	return &CIDRFilter{Policy: config.Policy, Remote: remote, Local: local, Recorder: deps.Recorder}, nil
+}
+
+func newHealth(deps *Dependencies, params json.RawMessage) (*Health, error) {
+	config := &HealthCheckConfig{Mode: prober.ModeTCP, Timeout: "1s", Path: "/", Cache: "30s", NotReadyPolicy: NotReadyKeep}
+	if err := DecodeParams(params, config); err != nil {
+		return nil, err
+	}
+	if _, err := ParseNotReadyPolicy(string(config.NotReadyPolicy)); err != nil {
+		return nil, err
+	}
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := time.ParseDuration(config.Cache)
+	if err != nil {
+		return nil, err
+	}
+	remote := deps.RemoteCluster
+	if remote == "" {
+		remote = "remote"
+	}
+	p, err := prober.New(config.Mode, remote, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.Path = config.Path
+	p.CacheDuration = cache
+	return &Health{Prober: p, NotReady: config.NotReadyPolicy}, nil
+}
+
+func newWebhook(deps *Dependencies, params json.RawMessage) (*Webhook, error) {
+	config := &WebhookConfig{Name: "webhook", Timeout: "1s", FailurePolicy: WebhookFailClosed}
+	if err := DecodeParams(params, config); err != nil {
+		return nil, err
+	}
+	return NewWebhook(config, deps.Recorder)
+}
+
+func newAdmission(deps *Dependencies, params json.RawMessage) (*Admission, error) {
+	admission := &Admission{LocalCluster: deps.LocalCluster, RemoteCluster: deps.RemoteCluster, RemoteClient: deps.RemoteClient}
+	if err := DecodeParams(params, admission); err != nil {
+		return nil, err
+	}
+	if err := admission.Compile(); err != nil {
+		return nil, err
+	}
+	return admission, nil
+}
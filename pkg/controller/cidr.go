@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/logging"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// CIDRFilterAddresses leaves out the addresses that aren't allowed
+	CIDRFilterAddresses CIDRPolicy = "filter"
+	// CIDRRejectEndpoints skips the whole request if any address isn't allowed
+	CIDRRejectEndpoints CIDRPolicy = "reject"
+
+	reasonOutsideRemote = "outside_remote_cidrs"
+	reasonLocalOverlap  = "local_overlap"
+)
+
+var (
+	logger = logging.Logger
+
+	ErrInvalidCIDRPolicy = errors.New("The CIDR policy must be filter or reject.")
+	ErrCIDROverlap       = errors.New("Remote CIDRs cannot overlap the local pod and service CIDRs.")
+)
+
+// CIDRPolicy is what happens to endpoints with addresses outside the allowed ranges
+type CIDRPolicy string
+
+// ParseCIDRPolicy checks that the policy is one of the known ones
+func ParseCIDRPolicy(policy string) (CIDRPolicy, error) {
+	switch CIDRPolicy(policy) {
+	case CIDRFilterAddresses, CIDRRejectEndpoints:
+		return CIDRPolicy(policy), nil
+	}
+	return "", ErrInvalidCIDRPolicy
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs. An empty string is an empty list
+func ParseCIDRs(cidrs string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// CIDROverlap returns an error naming the first pair of ranges that overlap
+func CIDROverlap(a, b []*net.IPNet) error {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Contains(y.IP) || y.Contains(x.IP) {
+				return fmt.Errorf("CIDR %s overlaps %s", x, y)
+			}
+		}
+	}
+	return nil
+}
+
+// CIDRFilter keeps remote addresses that would be routed somewhere else, or not at all, out of the local endpoints
+type CIDRFilter struct {
+	Policy CIDRPolicy
+	// Ranges the remote addresses must be in. Any address is allowed if empty
+	Remote []*net.IPNet
+	// Local pod and service ranges. Remote addresses in these would be routed inside the local cluster
+	Local []*net.IPNet
+	// Optional. If set, rejected addresses are recorded as events on the local endpoints
+	Recorder record.EventRecorder
+}
+
+// Endpoints filters out the addresses that aren't allowed, or fails the request under the reject policy
+func (c *CIDRFilter) Endpoints(req *k8.EndpointsRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	rejected := []string{}
+	subsets := []v1.EndpointSubset{}
+	for _, subset := range req.LocalEndpoints.Subsets {
+		filtered := v1.EndpointSubset{
+			Addresses:         c.filter(subset.Addresses, &rejected),
+			NotReadyAddresses: c.filter(subset.NotReadyAddresses, &rejected),
+			Ports:             subset.Ports,
+		}
+		// A subset needs at least one address to be valid
+		if len(filtered.Addresses) == 0 && len(filtered.NotReadyAddresses) == 0 {
+			continue
+		}
+		subsets = append(subsets, filtered)
+	}
+	if len(rejected) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("Remote addresses not allowed: %s", strings.Join(rejected, ", "))
+	logger.Warn(message, zap.String("name", req.LocalEndpoints.Name),
+		zap.String("namespace", req.LocalEndpoints.ObjectMeta.Namespace), zap.String("policy", string(c.Policy)))
+	if c.Recorder != nil {
+		c.Recorder.Event(req.LocalEndpoints, v1.EventTypeWarning, "AddressNotAllowed", message)
+	}
+	if c.Policy == CIDRRejectEndpoints {
+		return errors.New(message)
+	}
+	req.LocalEndpoints.Subsets = subsets
+	return nil
+}
+
+func (c *CIDRFilter) filter(addresses []v1.EndpointAddress, rejected *[]string) []v1.EndpointAddress {
+	if addresses == nil {
+		return nil
+	}
+	allowed := []v1.EndpointAddress{}
+	for _, address := range addresses {
+		if reason := c.check(net.ParseIP(address.IP)); reason != "" {
+			metrics.RejectedAddresses.Add(reason, 1)
+			*rejected = append(*rejected, fmt.Sprintf("%s (%s)", address.IP, reason))
+			continue
+		}
+		allowed = append(allowed, address)
+	}
+	return allowed
+}
+
+// Returns why an address isn't allowed, or an empty string if it is
+func (c *CIDRFilter) check(ip net.IP) string {
+	if ip == nil {
+		return reasonOutsideRemote
+	}
+	for _, local := range c.Local {
+		if local.Contains(ip) {
+			return reasonLocalOverlap
+		}
+	}
+	if len(c.Remote) == 0 {
+		return ""
+	}
+	for _, remote := range c.Remote {
+		if remote.Contains(ip) {
+			return ""
+		}
+	}
+	return reasonOutsideRemote
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCIDROverlap(t *testing.T) {
+	testCases := []struct {
+		A        string
+		B        string
+		Expected bool
+	}{
+		// Separate ranges don't overlap
+		{
+			A: "10.0.0.0/16",
+			B: "10.1.0.0/16",
+		},
+		// A range inside another overlaps
+		{
+			A:        "10.0.0.0/8",
+			B:        "192.168.0.0/16,10.2.0.0/16",
+			Expected: true,
+		},
+		// Nothing overlaps an empty list
+		{
+			A: "10.0.0.0/8",
+		},
+	}
+
+	for _, testCase := range testCases {
+		a, err := ParseCIDRs(testCase.A)
+		if err != nil {
+			t.Fatalf("Could not parse %s %v", testCase.A, err)
+		}
+		b, err := ParseCIDRs(testCase.B)
+		if err != nil {
+			t.Fatalf("Could not parse %s %v", testCase.B, err)
+		}
+		if err := CIDROverlap(a, b); (err != nil) != testCase.Expected {
+			t.Errorf("Expected %s and %s to overlap: %t\ngot: %v", testCase.A, testCase.B, testCase.Expected, err)
+		}
+	}
+}
+
+func TestCIDRFilterEndpoints(t *testing.T) {
+	remote, _ := ParseCIDRs("10.1.0.0/16")
+	local, _ := ParseCIDRs("10.1.200.0/24")
+	subsets := []v1.EndpointSubset{
+		v1.EndpointSubset{
+			Addresses: []v1.EndpointAddress{
+				v1.EndpointAddress{IP: "10.1.0.1"},
+				v1.EndpointAddress{IP: "10.1.200.1"},
+			},
+		},
+		v1.EndpointSubset{
+			Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "172.16.0.1"}},
+		},
+	}
+	allowed := []v1.EndpointSubset{
+		v1.EndpointSubset{
+			Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.1.0.1"}},
+		},
+	}
+	testCases := []struct {
+		Policy      CIDRPolicy
+		Subsets     []v1.EndpointSubset
+		Expected    []v1.EndpointSubset
+		ExpectedErr bool
+		Events      int
+	}{
+		// Addresses outside the remote ranges or inside the local ones are filtered, along with empty subsets
+		{
+			Policy:  CIDRFilterAddresses,
+			Subsets: subsets,
+			Expected: []v1.EndpointSubset{
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.1.0.1"}},
+				},
+			},
+			Events: 1,
+		},
+		// The reject policy fails the request and leaves the subsets alone
+		{
+			Policy:      CIDRRejectEndpoints,
+			Subsets:     subsets,
+			Expected:    subsets,
+			ExpectedErr: true,
+			Events:      1,
+		},
+		// Allowed addresses pass through without an event
+		{
+			Policy:   CIDRRejectEndpoints,
+			Subsets:  allowed,
+			Expected: allowed,
+		},
+	}
+
+	for _, testCase := range testCases {
+		recorder := record.NewFakeRecorder(10)
+		filter := &CIDRFilter{Policy: testCase.Policy, Remote: remote, Local: local, Recorder: recorder}
+		req := &k8.EndpointsRequest{
+			Type:           k8.RequestTypeUpdate,
+			LocalEndpoints: &v1.Endpoints{Subsets: testCase.Subsets},
+		}
+		err := filter.Endpoints(req)
+		if (err != nil) != testCase.ExpectedErr {
+			t.Errorf("Expected error: %t\ngot: %v", testCase.ExpectedErr, err)
+		}
+		if !reflect.DeepEqual(testCase.Expected, req.LocalEndpoints.Subsets) {
+			t.Errorf("Expected subsets: %+v\ngot: %+v", testCase.Expected, req.LocalEndpoints.Subsets)
+		}
+		if len(recorder.Events) != testCase.Events {
+			t.Errorf("Expected %d events\ngot: %d", testCase.Events, len(recorder.Events))
+		}
+	}
+}
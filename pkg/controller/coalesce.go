@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+)
+
+// CoalesceEndpoints holds on to endpoints requests until an object has been quiet for the window, and sends on only
+// the latest one. An object that keeps changing is still sent once it's been held for the max staleness. Deletes are
+// sent right away. A zero window passes every request straight through
+func CoalesceEndpoints(ctx context.Context, in, out chan *k8.EndpointsRequest, window, maxStaleness time.Duration) {
+	c := newEndpointsCoalescer(window, maxStaleness)
+	for {
+		var wake <-chan time.Time
+		var timer *time.Timer
+		if next, ok := c.next(); ok {
+			timer = time.NewTimer(next.Sub(time.Now()))
+			wake = timer.C
+		}
+		var ready []*k8.EndpointsRequest
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-in:
+			ready = c.add(req, time.Now())
+		case <-wake:
+			ready = c.due(time.Now())
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		for _, req := range ready {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- req:
+			}
+		}
+	}
+}
+
+type pendingEndpoints struct {
+	req *k8.EndpointsRequest
+	// When the first request that's being held came in, and when the latest one will be sent
+	first    time.Time
+	deadline time.Time
+	// Requests that were replaced by a later one
+	collapsed int
+	// Set if the deadline was cut short by the max staleness
+	stale bool
+}
+
+type endpointsCoalescer struct {
+	window       time.Duration
+	maxStaleness time.Duration
+	pending      map[string]*pendingEndpoints
+}
+
+func newEndpointsCoalescer(window, maxStaleness time.Duration) *endpointsCoalescer {
+	return &endpointsCoalescer{
+		window:       window,
+		maxStaleness: maxStaleness,
+		pending:      map[string]*pendingEndpoints{},
+	}
+}
+
+// Holds on to the request, and returns the requests that are ready to send
+func (c *endpointsCoalescer) add(req *k8.EndpointsRequest, now time.Time) []*k8.EndpointsRequest {
+	if c.window <= 0 {
+		return []*k8.EndpointsRequest{req}
+	}
+	key := remoteKey(req.RemoteEndpoints.ObjectMeta)
+	pending, ok := c.pending[key]
+	if !ok {
+		pending = &pendingEndpoints{first: now}
+		c.pending[key] = pending
+	} else {
+		pending.collapsed++
+	}
+	pending.req = req
+	if req.Type == k8.RequestTypeDelete {
+		c.send(key, "delete")
+		return []*k8.EndpointsRequest{req}
+	}
+	pending.deadline = now.Add(c.window)
+	pending.stale = false
+	if stale := pending.first.Add(c.maxStaleness); c.maxStaleness > 0 && pending.deadline.After(stale) {
+		pending.deadline = stale
+		pending.stale = true
+	}
+	return c.due(now)
+}
+
+// Returns the requests whose deadline has passed, oldest first
+func (c *endpointsCoalescer) due(now time.Time) []*k8.EndpointsRequest {
+	ready := []*pendingEndpoints{}
+	for key, pending := range c.pending {
+		if pending.deadline.After(now) {
+			continue
+		}
+		ready = append(ready, pending)
+		reason := "window"
+		if pending.stale {
+			reason = "staleness"
+		}
+		c.send(key, reason)
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].first.Before(ready[j].first) })
+	reqs := []*k8.EndpointsRequest{}
+	for _, pending := range ready {
+		reqs = append(reqs, pending.req)
+	}
+	return reqs
+}
+
+// The earliest deadline of the requests being held
+func (c *endpointsCoalescer) next() (time.Time, bool) {
+	var next time.Time
+	for _, pending := range c.pending {
+		if next.IsZero() || pending.deadline.Before(next) {
+			next = pending.deadline
+		}
+	}
+	return next, !next.IsZero()
+}
+
+func (c *endpointsCoalescer) send(key, reason string) {
+	pending := c.pending[key]
+	delete(c.pending, key)
+	metrics.CoalescedEndpoints.Add(int64(pending.collapsed))
+	metrics.CoalescerFlushes.Add(reason, 1)
+}
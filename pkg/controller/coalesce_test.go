@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEndpointsCoalescer(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	request := func(requestType k8.RequestType, name, resourceVersion string) *k8.EndpointsRequest {
+		return &k8.EndpointsRequest{
+			Type: requestType,
+			RemoteEndpoints: &v1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "bar", ResourceVersion: resourceVersion},
+			},
+		}
+	}
+	type event struct {
+		// Request to add at the time, or nothing to check what's due then
+		Request *k8.EndpointsRequest
+		At      time.Duration
+		// Resource versions that are sent at the time
+		Expected []string
+	}
+	testCases := []struct {
+		Window       time.Duration
+		MaxStaleness time.Duration
+		Events       []event
+	}{
+		// Without a window every request is sent right away
+		{
+			Events: []event{
+				{Request: request(k8.RequestTypeUpdate, "foo", "1"), Expected: []string{"1"}},
+				{Request: request(k8.RequestTypeUpdate, "foo", "2"), Expected: []string{"2"}},
+			},
+		},
+		// Changes within the window are collapsed into the latest one
+		{
+			Window:       time.Second,
+			MaxStaleness: time.Minute,
+			Events: []event{
+				{Request: request(k8.RequestTypeUpdate, "foo", "1"), Expected: []string{}},
+				{Request: request(k8.RequestTypeUpdate, "foo", "2"), At: 500 * time.Millisecond, Expected: []string{}},
+				{At: 1200 * time.Millisecond, Expected: []string{}},
+				{At: 1500 * time.Millisecond, Expected: []string{"2"}},
+			},
+		},
+		// An object that keeps changing is sent once it's been held for the max staleness
+		{
+			Window:       time.Second,
+			MaxStaleness: 2 * time.Second,
+			Events: []event{
+				{Request: request(k8.RequestTypeUpdate, "foo", "1"), Expected: []string{}},
+				{Request: request(k8.RequestTypeUpdate, "foo", "2"), At: 900 * time.Millisecond, Expected: []string{}},
+				{Request: request(k8.RequestTypeUpdate, "foo", "3"), At: 1800 * time.Millisecond, Expected: []string{}},
+				{At: 2 * time.Second, Expected: []string{"3"}},
+			},
+		},
+		// Deletes are sent right away and replace the held change, other objects are held separately
+		{
+			Window:       time.Second,
+			MaxStaleness: time.Minute,
+			Events: []event{
+				{Request: request(k8.RequestTypeUpdate, "foo", "1"), Expected: []string{}},
+				{Request: request(k8.RequestTypeUpdate, "baz", "2"), At: 100 * time.Millisecond, Expected: []string{}},
+				{Request: request(k8.RequestTypeDelete, "foo", "3"), At: 200 * time.Millisecond, Expected: []string{"3"}},
+				{At: 1100 * time.Millisecond, Expected: []string{"2"}},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		coalescer := newEndpointsCoalescer(testCase.Window, testCase.MaxStaleness)
+		for _, e := range testCase.Events {
+			var sent []*k8.EndpointsRequest
+			if e.Request != nil {
+				sent = coalescer.add(e.Request, start.Add(e.At))
+			} else {
+				sent = coalescer.due(start.Add(e.At))
+			}
+			resourceVersions := []string{}
+			for _, req := range sent {
+				resourceVersions = append(resourceVersions, req.RemoteEndpoints.ObjectMeta.ResourceVersion)
+			}
+			if !reflect.DeepEqual(e.Expected, resourceVersions) {
+				t.Errorf("Expected sent at %s: %v\ngot: %v", e.At, e.Expected, resourceVersions)
+			}
+		}
+		if _, ok := coalescer.next(); ok {
+			t.Errorf("Expected nothing held\ngot: %+v", coalescer.pending)
+		}
+	}
+}
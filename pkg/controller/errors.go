@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TransformerError is a transformer failing on a request, with enough context to tell which one and why
+type TransformerError struct {
+	Transformer string
+	Kind        string
+	RequestType string
+	// Namespace and name of the remote object
+	Key string
+	// Retryable errors are expected to go away on their own, terminal ones need the config or the remote object fixed
+	Retryable bool
+	Err       error
+}
+
+func (e *TransformerError) Error() string {
+	return fmt.Sprintf("Transformer %s failed to %s %s %s: %s", e.Transformer, e.RequestType, e.Kind, e.Key, e.Err.Error())
+}
+
+// Wraps the error with the transformer and the request it failed on. Errors that are already wrapped are kept as
+// they are
+func newTransformerError(transformer, kind string, requestType k8.RequestType, remoteMeta metav1.ObjectMeta, err error) error {
+	if _, ok := err.(*TransformerError); ok {
+		return err
+	}
+	return &TransformerError{
+		Transformer: transformer,
+		Kind:        kind,
+		RequestType: k8.RequestTypeMap[requestType],
+		Key:         fmt.Sprintf("%s/%s", remoteMeta.Namespace, remoteMeta.Name),
+		Retryable:   IsRetryable(err),
+		Err:         err,
+	}
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// Retryable marks an error as one that's expected to go away on its own, so the request is tried again
+func Retryable(err error) error {
+	return &retryableError{err: err}
+}
+
+// IsRetryable checks if the request that failed with the error should be tried again. Errors marked as retryable,
+// network timeouts and API errors that are about the API server rather than the request are
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case *TransformerError:
+		return e.Retryable
+	case *retryableError:
+		return true
+	case net.Error:
+		return e.Timeout() || e.Temporary()
+	}
+	return apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) || apierrors.IsServiceUnavailable(err)
+}
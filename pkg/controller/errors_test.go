@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestIsRetryable(t *testing.T) {
+	testCases := []struct {
+		Err      error
+		Expected bool
+	}{
+		// Plain errors are terminal
+		{
+			Err: errors.New("oh no"),
+		},
+		// Errors can be marked as retryable
+		{
+			Err:      Retryable(errors.New("oh no")),
+			Expected: true,
+		},
+		// The API server being overloaded is retryable
+		{
+			Err:      apierrors.NewServerTimeout(schema.GroupResource{Resource: "services"}, "get", 1),
+			Expected: true,
+		},
+		// Objects that don't exist aren't going to show up by retrying
+		{
+			Err: apierrors.NewNotFound(schema.GroupResource{Resource: "services"}, "foo"),
+		},
+		// Wrapped errors keep their classification
+		{
+			Err:      newTransformerError("webhook", k8.K8Services, k8.RequestTypeAdd, metav1.ObjectMeta{}, Retryable(errors.New("oh no"))),
+			Expected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		if retryable := IsRetryable(testCase.Err); retryable != testCase.Expected {
+			t.Errorf("Expected retryable: %t for %v\ngot: %t", testCase.Expected, testCase.Err, retryable)
+		}
+	}
+}
+
+func TestRegistryTransformerErrors(t *testing.T) {
+	registry := NewRegistry()
+	registry.RegisterService("broken", func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error) {
+		return func(req *k8.ServiceRequest) error {
+			return errors.New("oh no")
+		}, nil
+	})
+	transformers, err := registry.ServiceTransformers(&Dependencies{}, []TransformerConfig{TransformerConfig{Name: "broken"}})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	req := &k8.ServiceRequest{
+		Type:          k8.RequestTypeUpdate,
+		RemoteService: &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"}},
+	}
+	err = TransformService(req, transformers...)
+	transformerErr, ok := err.(*TransformerError)
+	if !ok {
+		t.Fatalf("Expected a transformer error\ngot: %v", err)
+	}
+	expected := "Transformer broken failed to update services bar/foo: oh no"
+	if transformerErr.Error() != expected {
+		t.Errorf("Expected error: %s\ngot: %s", expected, transformerErr.Error())
+	}
+}
+
+func TestReportTransformerError(t *testing.T) {
+	obj := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"}}
+	recorder := record.NewFakeRecorder(1)
+
+	// Retryable errors are retried without an event
+	if retry := reportTransformerError(Retryable(errors.New("oh no")), k8.K8Services, recorder, obj); !retry {
+		t.Errorf("Expected retry: true\ngot: %t", retry)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("Expected no events for a retryable error")
+	}
+
+	// Terminal errors are recorded as an event
+	if retry := reportTransformerError(errors.New("oh no"), k8.K8Services, recorder, obj); retry {
+		t.Errorf("Expected retry: false\ngot: %t", retry)
+	}
+	select {
+	case event := <-recorder.Events:
+		if event != "Warning TransformerFailed oh no" {
+			t.Errorf("Expected event: Warning TransformerFailed oh no\ngot: %s", event)
+		}
+	default:
+		t.Errorf("Expected an event")
+	}
+}
+
+func TestCurrentRequest(t *testing.T) {
+	latest := map[string]string{}
+	currentRequest(latest, "bar/foo", "1", 0)
+	// Retries of the latest version go through
+	if !currentRequest(latest, "bar/foo", "1", 1) {
+		t.Errorf("Expected retry of the latest version to go through")
+	}
+	currentRequest(latest, "bar/foo", "2", 0)
+	// Retries of an older version are dropped
+	if currentRequest(latest, "bar/foo", "1", 2) {
+		t.Errorf("Expected retry of an older version to be dropped")
+	}
+}
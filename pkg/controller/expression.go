@@ -0,0 +1,417 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+const (
+	tokenIdent = iota
+	tokenLiteral
+	tokenOp
+)
+
+// Expression is a boolean expression over JSON values. It's a small subset of CEL: variables, field selection with
+// `.` and `[...]`, list literals, `==`, `!=`, `in`, `!`, `&&`, `||` and parentheses, on strings, numbers, booleans and
+// null. Fields that don't exist are null
+type Expression struct {
+	Source string
+	eval   evalFunc
+}
+
+type evalFunc func(vars map[string]interface{}) (interface{}, error)
+
+type expressionToken struct {
+	kind  int
+	text  string
+	value interface{}
+}
+
+// ParseExpression parses the expression, checking that it only uses the given variables
+func ParseExpression(source string, variables ...string) (*Expression, error) {
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse expression %q: %s", source, err.Error())
+	}
+	p := &expressionParser{tokens: tokens, variables: variables}
+	eval, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %s", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse expression %q: %s", source, err.Error())
+	}
+	return &Expression{Source: source, eval: eval}, nil
+}
+
+// Eval evaluates the expression with the variables, which must be JSON values as decoded by encoding/json. It fails
+// if the expression isn't a boolean
+func (e *Expression) Eval(vars map[string]interface{}) (bool, error) {
+	return evalBool(e.eval, vars)
+}
+
+func lexExpression(source string) ([]expressionToken, error) {
+	var tokens []expressionToken
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentByte(c) && !isDigitByte(c):
+			j := i
+			for j < len(source) && isIdentByte(source[j]) {
+				j++
+			}
+			word := source[i:j]
+			switch word {
+			case "true", "false":
+				tokens = append(tokens, expressionToken{kind: tokenLiteral, text: word, value: word == "true"})
+			case "null":
+				tokens = append(tokens, expressionToken{kind: tokenLiteral, text: word})
+			case "in":
+				tokens = append(tokens, expressionToken{kind: tokenOp, text: word})
+			default:
+				tokens = append(tokens, expressionToken{kind: tokenIdent, text: word})
+			}
+			i = j
+		case isDigitByte(c):
+			j := i
+			for j < len(source) && (isDigitByte(source[j]) || source[j] == '.') {
+				j++
+			}
+			// Numbers are float64, the same as encoding/json decodes them to
+			value, err := strconv.ParseFloat(source[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s", source[i:j])
+			}
+			tokens = append(tokens, expressionToken{kind: tokenLiteral, text: source[i:j], value: value})
+			i = j
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(source) && source[j] != c {
+				// Only double quoted strings have escapes
+				if c == '"' && source[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(source) {
+				return nil, errors.New("unterminated string")
+			}
+			text := source[i : j+1]
+			value := source[i+1 : j]
+			if c == '"' {
+				var err error
+				if value, err = strconv.Unquote(text); err != nil {
+					return nil, fmt.Errorf("invalid string %s", text)
+				}
+			}
+			tokens = append(tokens, expressionToken{kind: tokenLiteral, text: text, value: value})
+			i = j + 1
+		default:
+			op := source[i : i+1]
+			if i+1 < len(source) {
+				switch source[i : i+2] {
+				case "&&", "||", "==", "!=":
+					op = source[i : i+2]
+				}
+			}
+			switch op {
+			case "&&", "||", "==", "!=", "!", "(", ")", "[", "]", ".", ",":
+			default:
+				return nil, fmt.Errorf("unexpected %s", op)
+			}
+			tokens = append(tokens, expressionToken{kind: tokenOp, text: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || isDigitByte(c)
+}
+
+func isDigitByte(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// A recursive descent parser, from the loosest binding operator to the tightest
+type expressionParser struct {
+	tokens    []expressionToken
+	pos       int
+	variables []string
+}
+
+func (p *expressionParser) next() *expressionToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	p.pos++
+	return &p.tokens[p.pos-1]
+}
+
+func (p *expressionParser) accept(op string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOp && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *expressionParser) expect(op string) error {
+	if !p.accept(op) {
+		return fmt.Errorf("expected %s", op)
+	}
+	return nil
+}
+
+func (p *expressionParser) or() (evalFunc, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, true)
+	}
+	return left, nil
+}
+
+func (p *expressionParser) and() (evalFunc, error) {
+	left, err := p.relation()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.relation()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, false)
+	}
+	return left, nil
+}
+
+func (p *expressionParser) relation() (evalFunc, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	var compare func(left, right interface{}) (bool, error)
+	switch {
+	case p.accept("=="):
+		compare = func(left, right interface{}) (bool, error) {
+			return reflect.DeepEqual(left, right), nil
+		}
+	case p.accept("!="):
+		compare = func(left, right interface{}) (bool, error) {
+			return !reflect.DeepEqual(left, right), nil
+		}
+	case p.accept("in"):
+		compare = contains
+	default:
+		return left, nil
+	}
+	right, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(vars map[string]interface{}) (interface{}, error) {
+		l, err := left(vars)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(vars)
+		if err != nil {
+			return nil, err
+		}
+		return compare(l, r)
+	}, nil
+}
+
+func (p *expressionParser) unary() (evalFunc, error) {
+	if !p.accept("!") {
+		return p.member()
+	}
+	operand, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(vars map[string]interface{}) (interface{}, error) {
+		value, err := evalBool(operand, vars)
+		return !value, err
+	}, nil
+}
+
+func (p *expressionParser) member() (evalFunc, error) {
+	object, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var key evalFunc
+		switch {
+		case p.accept("."):
+			field := p.next()
+			if field == nil || field.kind != tokenIdent {
+				return nil, errors.New("expected a field name after .")
+			}
+			key = constant(field.text)
+		case p.accept("["):
+			if key, err = p.or(); err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		default:
+			return object, nil
+		}
+		object = selectField(object, key)
+	}
+}
+
+func (p *expressionParser) primary() (evalFunc, error) {
+	token := p.next()
+	if token == nil {
+		return nil, errors.New("unexpected end of expression")
+	}
+	switch {
+	case token.kind == tokenLiteral:
+		return constant(token.value), nil
+	case token.kind == tokenIdent:
+		for _, variable := range p.variables {
+			if variable == token.text {
+				name := token.text
+				return func(vars map[string]interface{}) (interface{}, error) {
+					return vars[name], nil
+				}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown variable %s", token.text)
+	case token.text == "(":
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case token.text == "[":
+		var items []evalFunc
+		for !p.accept("]") {
+			if len(items) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			item, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return func(vars map[string]interface{}) (interface{}, error) {
+			list := make([]interface{}, len(items))
+			for i, item := range items {
+				value, err := item(vars)
+				if err != nil {
+					return nil, err
+				}
+				list[i] = value
+			}
+			return list, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", token.text)
+}
+
+func constant(value interface{}) evalFunc {
+	return func(vars map[string]interface{}) (interface{}, error) {
+		return value, nil
+	}
+}
+
+// && and || only evaluate the right side if the left side doesn't settle the result
+func logical(left, right evalFunc, or bool) evalFunc {
+	return func(vars map[string]interface{}) (interface{}, error) {
+		value, err := evalBool(left, vars)
+		if err != nil || value == or {
+			return value, err
+		}
+		return evalBool(right, vars)
+	}
+}
+
+func evalBool(eval evalFunc, vars map[string]interface{}) (bool, error) {
+	value, err := eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a boolean, got %v", value)
+	}
+	return b, nil
+}
+
+// Selecting from null is null, so checks on optional fields don't need to test every parent first
+func selectField(object, key evalFunc) evalFunc {
+	return func(vars map[string]interface{}) (interface{}, error) {
+		o, err := object(vars)
+		if err != nil {
+			return nil, err
+		}
+		k, err := key(vars)
+		if err != nil {
+			return nil, err
+		}
+		switch o := o.(type) {
+		case nil:
+			return nil, nil
+		case map[string]interface{}:
+			field, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("maps are indexed with strings, got %v", k)
+			}
+			return o[field], nil
+		case []interface{}:
+			index, ok := k.(float64)
+			if !ok || index != float64(int(index)) {
+				return nil, fmt.Errorf("lists are indexed with integers, got %v", k)
+			}
+			if index < 0 || int(index) >= len(o) {
+				return nil, nil
+			}
+			return o[int(index)], nil
+		}
+		return nil, fmt.Errorf("cannot select %v from %v", k, o)
+	}
+}
+
+// Checks if a list has the value, or a map has it as a key
+func contains(value, collection interface{}) (bool, error) {
+	switch collection := collection.(type) {
+	case nil:
+		return false, nil
+	case []interface{}:
+		for _, item := range collection {
+			if reflect.DeepEqual(value, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]interface{}:
+		key, ok := value.(string)
+		if !ok {
+			return false, fmt.Errorf("maps are indexed with strings, got %v", value)
+		}
+		_, ok = collection[key]
+		return ok, nil
+	}
+	return false, fmt.Errorf("in needs a list or a map, got %v", collection)
+}
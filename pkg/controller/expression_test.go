@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestExpression(t *testing.T) {
+	vars := map[string]interface{}{
+		"service": map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": map[string]interface{}{"team": "payments"},
+			},
+			"spec": map[string]interface{}{
+				"type":  "ClusterIP",
+				"ports": []interface{}{map[string]interface{}{"port": float64(443)}},
+			},
+		},
+		"cluster": map[string]interface{}{"local": "prod", "remote": "dev"},
+	}
+	testCases := []struct {
+		Expression string
+		ParseErr   bool
+		EvalErr    bool
+		Expected   bool
+	}{
+		{Expression: `"team" in service.metadata.labels`, Expected: true},
+		{Expression: `'owner' in service.metadata.labels`, Expected: false},
+		{Expression: `service.spec.type != "LoadBalancer"`, Expected: true},
+		{Expression: `service.spec.type in ["NodePort", "LoadBalancer"]`, Expected: false},
+		{Expression: `!(cluster.remote == "dev" && cluster.local == "prod")`, Expected: false},
+		{Expression: `cluster.remote == "dev" || cluster.local == "dev"`, Expected: true},
+		{Expression: `service.spec.ports[0].port == 443`, Expected: true},
+		{Expression: `service.metadata["labels"]["team"] == "payments"`, Expected: true},
+		// Missing fields are null, even several levels down
+		{Expression: `service.status.loadBalancer.ingress == null`, Expected: true},
+		{Expression: `"team" in service.metadata.annotations`, Expected: false},
+		// The right side isn't evaluated once the left side settles the result
+		{Expression: `cluster.local == "prod" || service.spec.type`, Expected: true},
+		// Expressions must be booleans
+		{Expression: `service.spec.type`, EvalErr: true},
+		{Expression: `!service.spec.type`, EvalErr: true},
+		{Expression: `service.spec.type[0] == "C"`, EvalErr: true},
+		// Unknown variables and broken syntax are caught when the expression is parsed
+		{Expression: `namespace == "default"`, ParseErr: true},
+		{Expression: `service.spec.type ==`, ParseErr: true},
+		{Expression: `service.spec.type == "LoadBalancer`, ParseErr: true},
+		{Expression: `(cluster.local == "prod"`, ParseErr: true},
+		{Expression: `cluster.local = "prod"`, ParseErr: true},
+		{Expression: `cluster.local == "prod" cluster`, ParseErr: true},
+	}
+
+	for _, testCase := range testCases {
+		expression, err := ParseExpression(testCase.Expression, "service", "cluster")
+		if (err != nil) != testCase.ParseErr {
+			t.Errorf("Expected parse error for %s: %t\ngot: %v", testCase.Expression, testCase.ParseErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		result, err := expression.Eval(vars)
+		if (err != nil) != testCase.EvalErr {
+			t.Errorf("Expected eval error for %s: %t\ngot: %v", testCase.Expression, testCase.EvalErr, err)
+		}
+		if err == nil && result != testCase.Expected {
+			t.Errorf("Expected %s: %t\ngot: %t", testCase.Expression, testCase.Expected, result)
+		}
+	}
+}
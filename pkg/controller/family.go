@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	IPv4 IPFamily = "IPv4"
+	IPv6 IPFamily = "IPv6"
+
+	reasonUnsupportedFamily = "unsupported_family"
+)
+
+var (
+	ErrInvalidIPFamily = errors.New("The IP families must be IPv4, IPv6 or both.")
+)
+
+// IPFamily is the family of an address. The Kubernetes API this is built against doesn't have IP families on
+// services yet, so they're worked out from the addresses instead
+type IPFamily string
+
+// ParseIPFamilies parses a comma separated list of IP families
+func ParseIPFamilies(families string) ([]IPFamily, error) {
+	parsed := []IPFamily{}
+	for _, family := range strings.Split(families, ",") {
+		switch IPFamily(strings.TrimSpace(family)) {
+		case IPv4:
+			parsed = append(parsed, IPv4)
+		case IPv6:
+			parsed = append(parsed, IPv6)
+		default:
+			return nil, ErrInvalidIPFamily
+		}
+	}
+	return parsed, nil
+}
+
+// LocalIPFamily works out the local cluster's IP family from the cluster IP of its kubernetes service. If that can't
+// be read, the cluster is taken to be IPv4. Dual stack clusters can't be told apart this way, so they have to be
+// configured
+func LocalIPFamily(client kubernetes.Interface) IPFamily {
+	if client == nil {
+		return IPv4
+	}
+	svc, err := client.CoreV1().Services(metav1.NamespaceDefault).Get("kubernetes", metav1.GetOptions{})
+	if err != nil {
+		logger.Warn("Could not work out the local cluster's IP family, assuming IPv4", zap.Error(err))
+		return IPv4
+	}
+	if familyOf(svc.Spec.ClusterIP) == IPv6 {
+		return IPv6
+	}
+	return IPv4
+}
+
+func familyOf(ip string) IPFamily {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if parsed.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
+
+// IPFamilies splits the local endpoints into a subset per family, and leaves out the families the local cluster
+// can't route
+type IPFamilies struct {
+	// Families the local cluster can route, in the order their subsets are written
+	Families []IPFamily `json:"families,omitempty"`
+	// Optional. If set, addresses that are left out are recorded as events on the local endpoints
+	Recorder record.EventRecorder `json:"-"`
+
+	mu sync.Mutex
+	// The addresses last left out of each local endpoints, so the warning is only given when they change rather than
+	// on every resync
+	dropped map[string]string
+}
+
+// Endpoints splits mixed family subsets, so every subset only has addresses of a single family
+func (f *IPFamilies) Endpoints(req *k8.EndpointsRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		f.warned(req.LocalEndpoints.ObjectMeta, "")
+		return nil
+	}
+	dropped := []string{}
+	subsets := []v1.EndpointSubset{}
+	for _, subset := range req.LocalEndpoints.Subsets {
+		for _, family := range f.Families {
+			split := v1.EndpointSubset{
+				Addresses:         addressesOfFamily(subset.Addresses, family),
+				NotReadyAddresses: addressesOfFamily(subset.NotReadyAddresses, family),
+				Ports:             subset.Ports,
+			}
+			if len(split.Addresses) > 0 || len(split.NotReadyAddresses) > 0 {
+				subsets = append(subsets, split)
+			}
+		}
+		for _, address := range append(append([]v1.EndpointAddress{}, subset.Addresses...), subset.NotReadyAddresses...) {
+			if !f.supports(familyOf(address.IP)) {
+				metrics.RejectedAddresses.Add(reasonUnsupportedFamily, 1)
+				dropped = append(dropped, address.IP)
+			}
+		}
+	}
+	req.LocalEndpoints.Subsets = subsets
+	addresses := strings.Join(dropped, ", ")
+	if f.warned(req.LocalEndpoints.ObjectMeta, addresses) || len(dropped) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("Remote addresses of a family the local cluster can't route: %s", addresses)
+	logger.Warn(message, zap.String("name", req.LocalEndpoints.Name),
+		zap.String("namespace", req.LocalEndpoints.ObjectMeta.Namespace))
+	if f.Recorder != nil {
+		f.Recorder.Event(req.LocalEndpoints, v1.EventTypeWarning, "UnsupportedIPFamily", message)
+	}
+	return nil
+}
+
+// Records the addresses left out of the endpoints, and returns whether they're the same as last time
+func (f *IPFamilies) warned(meta metav1.ObjectMeta, addresses string) bool {
+	key := fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dropped == nil {
+		f.dropped = map[string]string{}
+	}
+	if f.dropped[key] == addresses {
+		return true
+	}
+	if addresses == "" {
+		delete(f.dropped, key)
+	} else {
+		f.dropped[key] = addresses
+	}
+	return false
+}
+
+func (f *IPFamilies) supports(family IPFamily) bool {
+	for _, supported := range f.Families {
+		if family == supported {
+			return true
+		}
+	}
+	return false
+}
+
+func addressesOfFamily(addresses []v1.EndpointAddress, family IPFamily) []v1.EndpointAddress {
+	var matching []v1.EndpointAddress
+	for _, address := range addresses {
+		if familyOf(address.IP) == family {
+			matching = append(matching, address)
+		}
+	}
+	return matching
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestIPFamiliesEndpoints(t *testing.T) {
+	ports := []v1.EndpointPort{v1.EndpointPort{Port: 80}}
+	subsets := []v1.EndpointSubset{
+		v1.EndpointSubset{
+			Addresses:         []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}, v1.EndpointAddress{IP: "fd00::1"}},
+			NotReadyAddresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "fd00::2"}},
+			Ports:             ports,
+		},
+	}
+	testCases := []struct {
+		Families []IPFamily
+		Expected []v1.EndpointSubset
+		Events   int
+	}{
+		// Dual stack splits the mixed subset into one per family
+		{
+			Families: []IPFamily{IPv4, IPv6},
+			Expected: []v1.EndpointSubset{
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}},
+					Ports:     ports,
+				},
+				v1.EndpointSubset{
+					Addresses:         []v1.EndpointAddress{v1.EndpointAddress{IP: "fd00::1"}},
+					NotReadyAddresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "fd00::2"}},
+					Ports:             ports,
+				},
+			},
+		},
+		// IPv4 only leaves out the IPv6 addresses with a warning
+		{
+			Families: []IPFamily{IPv4},
+			Expected: []v1.EndpointSubset{
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}},
+					Ports:     ports,
+				},
+			},
+			Events: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		recorder := record.NewFakeRecorder(10)
+		families := &IPFamilies{Families: testCase.Families, Recorder: recorder}
+		req := &k8.EndpointsRequest{
+			Type:           k8.RequestTypeUpdate,
+			LocalEndpoints: &v1.Endpoints{Subsets: subsets},
+		}
+		if err := families.Endpoints(req); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(testCase.Expected, req.LocalEndpoints.Subsets) {
+			t.Errorf("Expected subsets: %+v\ngot: %+v", testCase.Expected, req.LocalEndpoints.Subsets)
+		}
+		if len(recorder.Events) != testCase.Events {
+			t.Errorf("Expected %d events\ngot: %d", testCase.Events, len(recorder.Events))
+		}
+	}
+}
+
+func TestIPFamiliesWarnsOnChange(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	families := &IPFamilies{Families: []IPFamily{IPv4}, Recorder: recorder}
+	endpoints := func(ips ...string) *k8.EndpointsRequest {
+		addresses := []v1.EndpointAddress{}
+		for _, ip := range ips {
+			addresses = append(addresses, v1.EndpointAddress{IP: ip})
+		}
+		return &k8.EndpointsRequest{
+			Type: k8.RequestTypeUpdate,
+			LocalEndpoints: &v1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"},
+				Subsets:    []v1.EndpointSubset{v1.EndpointSubset{Addresses: addresses}},
+			},
+		}
+	}
+	testCases := []struct {
+		Request *k8.EndpointsRequest
+		Events  int
+	}{
+		{Request: endpoints("10.0.0.1", "fd00::1"), Events: 1},
+		// A resync with the same addresses doesn't warn again
+		{Request: endpoints("10.0.0.1", "fd00::1"), Events: 0},
+		{Request: endpoints("10.0.0.1", "fd00::2"), Events: 1},
+		// Once nothing is left out, the next address that is gets a warning
+		{Request: endpoints("10.0.0.1"), Events: 0},
+		{Request: endpoints("10.0.0.1", "fd00::2"), Events: 1},
+	}
+
+	for i, testCase := range testCases {
+		if err := families.Endpoints(testCase.Request); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if len(recorder.Events) != testCase.Events {
+			t.Errorf("Expected %d events for request %d\ngot: %d", testCase.Events, i, len(recorder.Events))
+		}
+		for len(recorder.Events) > 0 {
+			<-recorder.Events
+		}
+	}
+}
+
+func TestLocalIPFamily(t *testing.T) {
+	kubernetes := func(clusterIP string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "kubernetes", Namespace: metav1.NamespaceDefault},
+			Spec:       v1.ServiceSpec{ClusterIP: clusterIP},
+		}
+	}
+	testCases := []struct {
+		Client   *fake.Clientset
+		Expected IPFamily
+	}{
+		{Client: fake.NewSimpleClientset(kubernetes("10.96.0.1")), Expected: IPv4},
+		{Client: fake.NewSimpleClientset(kubernetes("fd00:10:96::1")), Expected: IPv6},
+		// Clusters whose family can't be worked out are taken to be IPv4
+		{Client: fake.NewSimpleClientset(), Expected: IPv4},
+	}
+
+	for _, testCase := range testCases {
+		if actual := LocalIPFamily(testCase.Client); actual != testCase.Expected {
+			t.Errorf("Expected family: %s\ngot: %s", testCase.Expected, actual)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/prober"
+
+	"k8s.io/api/core/v1"
+)
+
+// Health moves ready addresses that can't be reached from the local cluster to the not ready addresses. With the drop
+// not ready policy they're left out instead, so the probe doesn't put back what the policy took out
+type Health struct {
+	Prober   *prober.Prober
+	NotReady NotReadyPolicy
+}
+
+// Endpoints probes the ready addresses on every TCP port of their subset. UDP ports can't be probed, so subsets
+// without any TCP ports are left as they are
+func (h *Health) Endpoints(req *k8.EndpointsRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	subsets := make([]v1.EndpointSubset, 0, len(req.LocalEndpoints.Subsets))
+	for _, subset := range req.LocalEndpoints.Subsets {
+		ports := []int32{}
+		for _, port := range subset.Ports {
+			if port.Protocol == "" || port.Protocol == v1.ProtocolTCP {
+				ports = append(ports, port.Port)
+			}
+		}
+		if len(ports) == 0 || len(subset.Addresses) == 0 {
+			subsets = append(subsets, subset)
+			continue
+		}
+
+		ips := make([]string, 0, len(subset.Addresses))
+		for _, address := range subset.Addresses {
+			ips = append(ips, address.IP)
+		}
+		reachable := h.Prober.Reachable(ips, ports)
+		probed := v1.EndpointSubset{
+			NotReadyAddresses: append([]v1.EndpointAddress{}, subset.NotReadyAddresses...),
+			Ports:             subset.Ports,
+		}
+		for _, address := range subset.Addresses {
+			switch {
+			case reachable[address.IP]:
+				probed.Addresses = append(probed.Addresses, address)
+			case h.NotReady != NotReadyDrop:
+				probed.NotReadyAddresses = append(probed.NotReadyAddresses, address)
+			}
+		}
+		if len(probed.NotReadyAddresses) == 0 {
+			probed.NotReadyAddresses = nil
+		}
+		// A subset needs at least one address to be valid
+		if len(probed.Addresses) == 0 && len(probed.NotReadyAddresses) == 0 {
+			continue
+		}
+		subsets = append(subsets, probed)
+	}
+	req.LocalEndpoints.Subsets = subsets
+	return nil
+}
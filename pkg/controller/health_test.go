@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/prober"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+	defer listener.Close()
+	_, portString, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portString)
+	p, err := prober.New(prober.ModeTCP, "remote", time.Second)
+	if err != nil {
+		t.Fatalf("Could not create prober %v", err)
+	}
+	subsets := []v1.EndpointSubset{
+		v1.EndpointSubset{
+			Addresses:         []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.1"}, v1.EndpointAddress{IP: "127.0.0.2"}},
+			NotReadyAddresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.3"}},
+			Ports:             []v1.EndpointPort{v1.EndpointPort{Port: int32(port), Protocol: v1.ProtocolTCP}},
+		},
+		// UDP only subsets aren't probed
+		v1.EndpointSubset{
+			Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.2"}},
+			Ports:     []v1.EndpointPort{v1.EndpointPort{Port: 53, Protocol: v1.ProtocolUDP}},
+		},
+		// Nothing is left of a subset whose only address is dropped
+		v1.EndpointSubset{
+			Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.4"}},
+			Ports:     []v1.EndpointPort{v1.EndpointPort{Port: int32(port), Protocol: v1.ProtocolTCP}},
+		},
+	}
+	testCases := []struct {
+		NotReady NotReadyPolicy
+		Expected []v1.EndpointSubset
+	}{
+		// Only 127.0.0.1 is listening, so the others are moved to the not ready addresses
+		{
+			NotReady: NotReadyKeep,
+			Expected: []v1.EndpointSubset{
+				v1.EndpointSubset{
+					Addresses:         []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.1"}},
+					NotReadyAddresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.3"}, v1.EndpointAddress{IP: "127.0.0.2"}},
+					Ports:             []v1.EndpointPort{v1.EndpointPort{Port: int32(port), Protocol: v1.ProtocolTCP}},
+				},
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.2"}},
+					Ports:     []v1.EndpointPort{v1.EndpointPort{Port: 53, Protocol: v1.ProtocolUDP}},
+				},
+				v1.EndpointSubset{
+					NotReadyAddresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.4"}},
+					Ports:             []v1.EndpointPort{v1.EndpointPort{Port: int32(port), Protocol: v1.ProtocolTCP}},
+				},
+			},
+		},
+		// The drop policy leaves them out instead. Not ready addresses the policy kept are left alone
+		{
+			NotReady: NotReadyDrop,
+			Expected: []v1.EndpointSubset{
+				v1.EndpointSubset{
+					Addresses:         []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.1"}},
+					NotReadyAddresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.3"}},
+					Ports:             []v1.EndpointPort{v1.EndpointPort{Port: int32(port), Protocol: v1.ProtocolTCP}},
+				},
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "127.0.0.2"}},
+					Ports:     []v1.EndpointPort{v1.EndpointPort{Port: 53, Protocol: v1.ProtocolUDP}},
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		health := &Health{Prober: p, NotReady: testCase.NotReady}
+		req := &k8.EndpointsRequest{
+			Type:           k8.RequestTypeUpdate,
+			LocalEndpoints: &v1.Endpoints{Subsets: subsets},
+		}
+		if err := health.Endpoints(req); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(testCase.Expected, req.LocalEndpoints.Subsets) {
+			t.Errorf("Expected subsets with the %s policy: %+v\ngot: %+v", testCase.NotReady, testCase.Expected, req.LocalEndpoints.Subsets)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package controller
+
+import (
+	"context"
+	"sync"
+
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/state"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const defaultSyncParallelism = 4
+
+// InitialSync brings every follower up to date when a leader starts, before the watchers take over. It lists the
+// remote exports, transforms all of them into the desired followers, and sends those to the running writers' bulk
+// channels with a bounded number waiting at once. A newer request from the watchers for the same follower replaces
+// the sync's
+type InitialSync struct {
+	RemoteClient          kubernetes.Interface
+	ServiceTransformers   []ServiceTransformer
+	EndpointsTransformers []EndpointsTransformer
+	ServiceWriter         *k8.ServiceWriter
+	EndpointsWriter       *k8.EndpointsWriter
+	// Only exports in namespaces in the shard are synced. The zero value syncs everything
+	Shard k8.Shard
+	// How many requests can be waiting on the writers at once
+	Parallelism int
+	// Optional. Transformer errors are recorded as events
+	Recorder record.EventRecorder
+	// Optional. Exports whose follower was last synced from the same remote version with the same content are
+	// skipped, and followers whose remote object is gone are deleted
+	Checkpoint *k8.Checkpoint
+
+	mu sync.Mutex
+	// Holds a token while a sync runs, so only one runs at a time and they don't send the same followers to the
+	// writers twice over. A channel rather than a mutex, so waiting for it stops when the context is done
+	running chan struct{}
+	// The progress of the latest sync. Writes from an earlier sync that was cut short can still finish after it
+	current *syncProgress
+}
+
+// The progress of a single sync
+type syncProgress struct {
+	total int
+	done  int
+	// Followers the checkpoint had up to date. Only used while working out the desired followers
+	skipped int
+}
+
+func NewInitialSync(remoteClient kubernetes.Interface, serviceWriter *k8.ServiceWriter, endpointsWriter *k8.EndpointsWriter) *InitialSync {
+	return &InitialSync{
+		RemoteClient:    remoteClient,
+		ServiceWriter:   serviceWriter,
+		EndpointsWriter: endpointsWriter,
+		Parallelism:     defaultSyncParallelism,
+	}
+}
+
+// Run syncs every export and returns once all of them have been written, or the context is done. Failed writes are
+// left to the writers' retries, so they don't hold up the sync
+// Syncs started while another one runs, like the remote expiry's on recovery, wait for it to finish first
+func (s *InitialSync) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running == nil {
+		s.running = make(chan struct{}, 1)
+	}
+	running := s.running
+	s.mu.Unlock()
+	select {
+	case running <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-running }()
+	progress := &syncProgress{}
+	services, err := s.desiredServices(progress)
+	if err != nil {
+		return err
+	}
+	endpoints, err := s.desiredEndpoints(progress)
+	if err != nil {
+		return err
+	}
+	s.start(progress, len(services)+len(endpoints))
+	logger.Info("Starting initial sync", zap.Int("services", len(services)), zap.Int("endpoints", len(endpoints)),
+		zap.Int("skipped", progress.skipped))
+
+	// Services go first, so the endpoints have something to attach to
+	sends := []func(done func(error)) bool{}
+	for _, req := range services {
+		req := req
+		sends = append(sends, func(done func(error)) bool {
+			req.Done = done
+			state.Default.Enqueue(k8.K8Services, k8.RequestTypeMap[req.Type], req.LocalService.ObjectMeta.Namespace, req.LocalService.Name)
+			select {
+			case s.ServiceWriter.Bulk <- req:
+				return true
+			case <-ctx.Done():
+				state.Default.Dequeue(k8.K8Services, req.LocalService.ObjectMeta.Namespace, req.LocalService.Name)
+				return false
+			}
+		})
+	}
+	s.write(ctx, progress, sends)
+	sends = []func(done func(error)) bool{}
+	for _, req := range endpoints {
+		req := req
+		sends = append(sends, func(done func(error)) bool {
+			req.Done = done
+			state.Default.Enqueue(k8.K8Endpoints, k8.RequestTypeMap[req.Type], req.LocalEndpoints.ObjectMeta.Namespace, req.LocalEndpoints.Name)
+			select {
+			case s.EndpointsWriter.Bulk <- req:
+				return true
+			case <-ctx.Done():
+				state.Default.Dequeue(k8.K8Endpoints, req.LocalEndpoints.ObjectMeta.Namespace, req.LocalEndpoints.Name)
+				return false
+			}
+		})
+	}
+	s.write(ctx, progress, sends)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	logger.Info("Initial sync done", zap.Int("objects", progress.total))
+	return nil
+}
+
+func (s *InitialSync) desiredServices(progress *syncProgress) ([]*k8.ServiceRequest, error) {
+	opts := &metav1.ListOptions{}
+	k8.RemoteFilter(opts)
+	remote, err := s.RemoteClient.CoreV1().Services(metav1.NamespaceAll).List(*opts)
+	if err != nil {
+		return nil, ferrors.Error(err)
+	}
+	desired := []*k8.ServiceRequest{}
+	exported := map[string]bool{}
+	for i := range remote.Items {
+		if !s.Shard.Contains(remote.Items[i].ObjectMeta.Namespace) {
+			continue
+		}
+		exported[exportKey(remote.Items[i].ObjectMeta.Namespace, remote.Items[i].Name)] = true
+		req := &k8.ServiceRequest{Type: k8.RequestTypeUpdate, RemoteService: &remote.Items[i]}
+		// Services that were deleted while there was no leader are still around if they're waiting on finalizers
+		if k8.Terminating(req.RemoteService.ObjectMeta) {
+			req.Type = k8.RequestTypeDelete
+		}
+		// Exports that fail are left out, the watchers send them through the pipeline again right after
+		if err := TransformService(req, s.ServiceTransformers...); err != nil {
+			reportTransformerError(err, k8.K8Services, s.Recorder, req.RemoteService)
+			continue
+		}
+		hash := func() (string, error) { return k8.ServiceHash(req.LocalService) }
+		upToDate := func() bool { return s.ServiceWriter.UpToDate(req.LocalService) }
+		if req.Type != k8.RequestTypeDelete &&
+			s.checkpointed(progress, k8.K8Services, req.LocalService.ObjectMeta, req.RemoteService.ObjectMeta.ResourceVersion, hash, upToDate) {
+			continue
+		}
+		desired = append(desired, req)
+	}
+	for _, meta := range s.orphans(k8.K8Services, exported) {
+		desired = append(desired, &k8.ServiceRequest{
+			Type:         k8.RequestTypeDelete,
+			LocalService: &v1.Service{ObjectMeta: meta},
+		})
+	}
+	return desired, nil
+}
+
+func (s *InitialSync) desiredEndpoints(progress *syncProgress) ([]*k8.EndpointsRequest, error) {
+	opts := &metav1.ListOptions{}
+	k8.RemoteFilter(opts)
+	remote, err := s.RemoteClient.CoreV1().Endpoints(metav1.NamespaceAll).List(*opts)
+	if err != nil {
+		return nil, ferrors.Error(err)
+	}
+	desired := []*k8.EndpointsRequest{}
+	exported := map[string]bool{}
+	for i := range remote.Items {
+		if !s.Shard.Contains(remote.Items[i].ObjectMeta.Namespace) {
+			continue
+		}
+		exported[exportKey(remote.Items[i].ObjectMeta.Namespace, remote.Items[i].Name)] = true
+		req := &k8.EndpointsRequest{Type: k8.RequestTypeUpdate, RemoteEndpoints: &remote.Items[i]}
+		// The same goes for endpoints
+		if k8.Terminating(req.RemoteEndpoints.ObjectMeta) {
+			req.Type = k8.RequestTypeDelete
+		}
+		if err := TransformEndpoints(req, s.EndpointsTransformers...); err != nil {
+			reportTransformerError(err, k8.K8Endpoints, s.Recorder, req.RemoteEndpoints)
+			continue
+		}
+		hash := func() (string, error) { return k8.EndpointsHash(req.LocalEndpoints) }
+		upToDate := func() bool { return s.EndpointsWriter.UpToDate(req.LocalEndpoints) }
+		if req.Type != k8.RequestTypeDelete &&
+			s.checkpointed(progress, k8.K8Endpoints, req.LocalEndpoints.ObjectMeta, req.RemoteEndpoints.ObjectMeta.ResourceVersion, hash, upToDate) {
+			continue
+		}
+		desired = append(desired, req)
+	}
+	for _, meta := range s.orphans(k8.K8Endpoints, exported) {
+		desired = append(desired, &k8.EndpointsRequest{
+			Type:           k8.RequestTypeDelete,
+			LocalEndpoints: &v1.Endpoints{ObjectMeta: meta},
+		})
+	}
+	return desired, nil
+}
+
+// The namespace/name of a remote export
+func exportKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// Checks if the checkpoint has the follower synced from the same remote version with the same content, and the
+// follower is still in the local cache as it was written. It can have been changed or deleted locally since, which
+// the checkpoint can't tell
+func (s *InitialSync) checkpointed(progress *syncProgress, kind string, local metav1.ObjectMeta, resourceVersion string, hash func() (string, error), upToDate func() bool) bool {
+	if s.Checkpoint == nil {
+		return false
+	}
+	sum, err := hash()
+	if err != nil {
+		ferrors.Error(err)
+		return false
+	}
+	if !s.Checkpoint.Synced(kind, local, resourceVersion, sum) || !upToDate() {
+		return false
+	}
+	progress.skipped++
+	metrics.InitialSyncSkipped.Add(1)
+	return true
+}
+
+// Followers in the checkpoint whose remote object wasn't listed. They were synced before, so their remote object was
+// deleted while there was no leader to see it
+func (s *InitialSync) orphans(kind string, exported map[string]bool) []metav1.ObjectMeta {
+	if s.Checkpoint == nil {
+		return nil
+	}
+	orphans := []metav1.ObjectMeta{}
+	for _, meta := range s.Checkpoint.Followers(kind) {
+		namespace, name := k8.RemoteLocation(meta)
+		if !s.Shard.Contains(namespace) || exported[exportKey(namespace, name)] {
+			continue
+		}
+		logger.Info("Remote object was deleted while there was no leader, deleting its follower",
+			zap.String("kind", kind), zap.String("name", meta.Name), zap.String("namespace", meta.Namespace),
+			zap.String("remoteName", name), zap.String("remoteNamespace", namespace))
+		metrics.CheckpointOrphans.Add(kind, 1)
+		orphans = append(orphans, meta)
+	}
+	return orphans
+}
+
+// Sends the requests to the writers with up to the parallelism waiting at once, and returns once they're all done
+// or the context is done. The writers run on their own, so the sync never writes to a follower at the same time
+func (s *InitialSync) write(ctx context.Context, progress *syncProgress, sends []func(done func(error)) bool) {
+	parallelism := s.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	slots := make(chan struct{}, parallelism)
+	var pending sync.WaitGroup
+	for _, send := range sends {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		pending.Add(1)
+		done := func(err error) {
+			s.finish(progress, err)
+			<-slots
+			pending.Done()
+		}
+		if !send(done) {
+			return
+		}
+	}
+	// Requests left in the writers' queues when the context is done are dropped without being reported
+	finished := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+}
+
+func (s *InitialSync) start(progress *syncProgress, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	progress.total = total
+	s.current = progress
+	metrics.InitialSyncTotal.Set(int64(total))
+	metrics.InitialSyncDone.Set(0)
+}
+
+// Records a finished write, and logs the progress every tenth of the way. Writes from an earlier sync that was cut
+// short only count towards that sync, so they don't show up in the latest one's progress
+func (s *InitialSync) finish(progress *syncProgress, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if progress.total == 0 {
+		return
+	}
+	progress.done++
+	if err != nil {
+		metrics.InitialSyncErrors.Add(1)
+	}
+	if progress != s.current {
+		return
+	}
+	metrics.InitialSyncDone.Set(int64(progress.done))
+	if progress.done == progress.total || progress.done*10/progress.total != (progress.done-1)*10/progress.total {
+		logger.Info("Initial sync progress", zap.Int("done", progress.done), zap.Int("total", progress.total))
+	}
+}
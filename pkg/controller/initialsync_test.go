@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestInitialSync(t *testing.T) {
+	exported := map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceRemoteLabelValue}
+	remoteClient := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: exported}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "broken", Namespace: "bar", Labels: exported}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "private", Namespace: "bar"}},
+		&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: exported}},
+	)
+	localClient := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceWriter, endpointsWriter := runWriters(ctx, localClient)
+	sync := NewInitialSync(remoteClient, serviceWriter, endpointsWriter)
+	sync.ServiceTransformers = []ServiceTransformer{
+		func(req *k8.ServiceRequest) error {
+			if req.RemoteService.Name == "broken" {
+				return errors.New("broken")
+			}
+			req.LocalService = req.RemoteService.DeepCopy()
+			return nil
+		},
+	}
+	sync.EndpointsTransformers = []EndpointsTransformer{
+		func(req *k8.EndpointsRequest) error {
+			req.LocalEndpoints = req.RemoteEndpoints.DeepCopy()
+			return nil
+		},
+	}
+
+	if err := sync.Run(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	// Only the exports that made it through the transformers are synced
+	if done, total := metrics.InitialSyncDone.Value(), metrics.InitialSyncTotal.Value(); done != 2 || total != 2 {
+		t.Errorf("Expected progress: 2/2\ngot: %d/%d", done, total)
+	}
+	if _, err := localClient.CoreV1().Services("bar").Get("foo", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the foo service to be synced\ngot: %v", err)
+	}
+	if _, err := localClient.CoreV1().Endpoints("bar").Get("foo", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the foo endpoints to be synced\ngot: %v", err)
+	}
+	for _, name := range []string{"broken", "private"} {
+		if _, err := localClient.CoreV1().Services("bar").Get(name, metav1.GetOptions{}); !k8.ResourceNotExist(err) {
+			t.Errorf("Expected the %s service not to be synced\ngot: %v", name, err)
+		}
+	}
+}
+
+func TestInitialSyncCheckpoint(t *testing.T) {
+	exported := map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceRemoteLabelValue}
+	remoteClient := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: exported}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "changed", Namespace: "bar", Labels: exported}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "deleted", Namespace: "bar", Labels: exported}},
+	)
+	localClient := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "gone", Namespace: "bar"}},
+	)
+	checkpoint := k8.NewCheckpoint(localClient, "fair-system", "checkpoint")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	followers := cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+	// foo was synced from the version that's there now and its follower is cached as it was written, deleted was
+	// too but its follower has been deleted locally since, changed was synced from an older version, and gone's
+	// remote service was deleted while there was no leader
+	for _, name := range []string{"foo", "deleted"} {
+		remote, err := remoteClient.CoreV1().Services("bar").Get(name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Could not get service %v", err)
+		}
+		hash, err := k8.ServiceHash(remote)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		checkpoint.Record(k8.K8Services, remote.ObjectMeta, remote.ObjectMeta.ResourceVersion, hash)
+	}
+	checkpoint.Record(k8.K8Services, metav1.ObjectMeta{Name: "changed", Namespace: "bar"}, "old", "hash")
+	checkpoint.Record(k8.K8Services, metav1.ObjectMeta{Name: "gone", Namespace: "bar"}, "old", "hash")
+	foo, err := remoteClient.CoreV1().Services("bar").Get("foo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Could not get service %v", err)
+	}
+	err = k8.NewServiceWriter(localClient, nil).Write(ctx, &k8.ServiceRequest{Type: k8.RequestTypeUpdate, RemoteService: foo, LocalService: foo.DeepCopy()})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	follower, err := localClient.CoreV1().Services("bar").Get("foo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Could not get service %v", err)
+	}
+	followers.Add(follower)
+
+	serviceWriter, endpointsWriter := runWriters(ctx, localClient, func(w *k8.ServiceWriter) {
+		w.Checkpoint = checkpoint
+		w.Cache = followers
+	})
+	sync := NewInitialSync(remoteClient, serviceWriter, endpointsWriter)
+	sync.Checkpoint = checkpoint
+	sync.ServiceTransformers = []ServiceTransformer{
+		func(req *k8.ServiceRequest) error {
+			req.LocalService = req.RemoteService.DeepCopy()
+			return nil
+		},
+	}
+
+	if err := sync.Run(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if done, total := metrics.InitialSyncDone.Value(), metrics.InitialSyncTotal.Value(); done != 3 || total != 3 {
+		t.Errorf("Expected progress: 3/3\ngot: %d/%d", done, total)
+	}
+	for _, name := range []string{"changed", "deleted"} {
+		if _, err := localClient.CoreV1().Services("bar").Get(name, metav1.GetOptions{}); err != nil {
+			t.Errorf("Expected the %s service to be synced\ngot: %v", name, err)
+		}
+	}
+	if _, err := localClient.CoreV1().Services("bar").Get("gone", metav1.GetOptions{}); !k8.ResourceNotExist(err) {
+		t.Errorf("Expected the gone service to be deleted\ngot: %v", err)
+	}
+	// The deleted follower is dropped from the checkpoint, so it isn't deleted again next time
+	names := []string{}
+	for _, meta := range checkpoint.Followers(k8.K8Services) {
+		names = append(names, meta.Name)
+	}
+	if expected := []string{"changed", "deleted", "foo"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf("Expected followers: %v\ngot: %v", expected, names)
+	}
+}
+
+// Starts a service and endpoints writer against the client, like the leader does. The options are applied to the
+// service writer before it starts
+func runWriters(ctx context.Context, client *fake.Clientset, options ...func(*k8.ServiceWriter)) (*k8.ServiceWriter, *k8.EndpointsWriter) {
+	serviceWriter := k8.NewServiceWriter(client, make(chan *k8.ServiceRequest))
+	serviceWriter.Bulk = make(chan *k8.ServiceRequest)
+	endpointsWriter := k8.NewEndpointsWriter(client, make(chan *k8.EndpointsRequest))
+	endpointsWriter.Bulk = make(chan *k8.EndpointsRequest)
+	for _, option := range options {
+		option(serviceWriter)
+	}
+	go serviceWriter.Run(ctx)
+	go endpointsWriter.Run(ctx)
+	return serviceWriter, endpointsWriter
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"path"
+	"strings"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// KeyFilter decides which label or annotation keys are propagated. Patterns are globs, so a prefix is written as
+// "prefix*". A key is propagated if it matches an allow pattern and no deny pattern
+type KeyFilter struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Allowed checks a key against the patterns
+func (f KeyFilter) Allowed(key string) bool {
+	return matchesAny(key, f.Allow) && !matchesAny(key, f.Deny)
+}
+
+func matchesAny(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		// A trailing * is a prefix. Slashes in keys aren't path separators, so it matches past them too
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if matched, err := path.Match(pattern, key); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// MetaFilter propagates the remote labels and annotations that pass the filters
+type MetaFilter struct {
+	Labels      KeyFilter `json:"labels"`
+	Annotations KeyFilter `json:"annotations"`
+}
+
+// Service filters the follower service's labels and annotations
+func (m *MetaFilter) Service(req *k8.ServiceRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	m.filter(req.RemoteService.ObjectMeta, &req.LocalService.ObjectMeta)
+	return nil
+}
+
+// Endpoints filters the follower endpoints' labels and annotations
+func (m *MetaFilter) Endpoints(req *k8.EndpointsRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	m.filter(req.RemoteEndpoints.ObjectMeta, &req.LocalEndpoints.ObjectMeta)
+	return nil
+}
+
+// Labels are all owned by the remote side, so they're replaced. Annotations are merged, since the local follower
+// can have its own. Allowed keys are owned by the remote side, so they're removed when the remote drops them
+func (m *MetaFilter) filter(remoteMeta metav1.ObjectMeta, localMeta *metav1.ObjectMeta) {
+	labels := map[string]string{}
+	for key, value := range remoteMeta.Labels {
+		if m.Labels.Allowed(key) {
+			labels[key] = value
+		}
+	}
+	localMeta.Labels = labels
+
+	annotations := map[string]string{}
+	for key, value := range localMeta.Annotations {
+		if !m.propagated(key) {
+			annotations[key] = value
+		}
+	}
+	for key, value := range remoteMeta.Annotations {
+		if m.propagated(key) {
+			annotations[key] = value
+		}
+	}
+	localMeta.Annotations = annotations
+}
+
+func (m *MetaFilter) propagated(key string) bool {
+	return !strings.HasPrefix(key, k8.CrossClusterAnnotationPrefix) && m.Annotations.Allowed(key)
+}
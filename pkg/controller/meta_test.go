@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestKeyFilterAllowed(t *testing.T) {
+	filter := KeyFilter{
+		Allow: []string{"prometheus.io/*", "*.mesh.io/protocol", "team"},
+		Deny:  []string{"prometheus.io/secret*"},
+	}
+	testCases := []struct {
+		Key      string
+		Expected bool
+	}{
+		// Prefix match
+		{Key: "prometheus.io/scrape", Expected: true},
+		// Glob match
+		{Key: "linkerd.mesh.io/protocol", Expected: true},
+		// Exact match
+		{Key: "team", Expected: true},
+		// Denied even though it's allowed
+		{Key: "prometheus.io/secret-token"},
+		// Not allowed
+		{Key: "kubectl.kubernetes.io/last-applied-configuration"},
+	}
+
+	for _, testCase := range testCases {
+		if allowed := filter.Allowed(testCase.Key); allowed != testCase.Expected {
+			t.Errorf("Expected %s allowed: %t\ngot: %t", testCase.Key, testCase.Expected, allowed)
+		}
+	}
+}
+
+func TestMetaFilterService(t *testing.T) {
+	filter := &MetaFilter{
+		Labels:      KeyFilter{Allow: []string{"*"}, Deny: []string{"internal"}},
+		Annotations: KeyFilter{Allow: []string{"prometheus.io/*", "fair.com/*"}},
+	}
+	req := &k8.ServiceRequest{
+		Type: k8.RequestTypeUpdate,
+		RemoteService: &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{"app": "foo", "internal": "true"},
+				Annotations: map[string]string{
+					"prometheus.io/scrape":             "true",
+					"secret":                           "shh",
+					k8.StatusAnnotationKey("local"):    "{}",
+					"kubectl.kubernetes.io/managed-by": "remote",
+				},
+			},
+		},
+		LocalService: &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"prometheus.io/port":               "9100",
+					"kubectl.kubernetes.io/managed-by": "local",
+					k8.CrossClusterSourceAnnotationKey: "remote",
+				},
+			},
+		},
+	}
+	// Allowed annotations dropped by the remote are removed, local annotations that aren't allowed are kept, and the
+	// controller's own annotations are never propagated
+	expectedLabels := map[string]string{"app": "foo"}
+	expectedAnnotations := map[string]string{
+		"prometheus.io/scrape":             "true",
+		"kubectl.kubernetes.io/managed-by": "local",
+		k8.CrossClusterSourceAnnotationKey: "remote",
+	}
+
+	if err := filter.Service(req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(expectedLabels, req.LocalService.ObjectMeta.Labels) {
+		t.Errorf("Expected labels: %+v\ngot: %+v", expectedLabels, req.LocalService.ObjectMeta.Labels)
+	}
+	if !reflect.DeepEqual(expectedAnnotations, req.LocalService.ObjectMeta.Annotations) {
+		t.Errorf("Expected annotations: %+v\ngot: %+v", expectedAnnotations, req.LocalService.ObjectMeta.Annotations)
+	}
+}
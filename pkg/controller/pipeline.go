@@ -1,33 +1,163 @@
 package controller
 
-import "github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+import (
+	"context"
+	"fmt"
 
-func EndpointsPipeline(in, out chan *k8.EndpointsRequest, transformers ...EndpointsTransformer) {
-OUTER:
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/retry"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/state"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// EndpointsPipeline transforms requests and sends them on to the writer until the context is done. Requests that
+// fail with a retryable error are sent through again by the retry tracker, and terminal errors are recorded as events
+func EndpointsPipeline(ctx context.Context, in, out chan *k8.EndpointsRequest, recorder record.EventRecorder, retries *retry.Tracker, transformers ...EndpointsTransformer) {
+	latest := map[string]string{}
 	for {
-		req := <-in
-		for _, transformer := range transformers {
-			// We've already reported the error. However, we don't want anything to fail here, so we
-			// just skip trying to create the request
-			if err := transformer(req); err != nil {
-				continue OUTER
+		var req *k8.EndpointsRequest
+		select {
+		case <-ctx.Done():
+			return
+		case req = <-in:
+		}
+		key := remoteKey(req.RemoteEndpoints.ObjectMeta)
+		if !currentRequest(latest, key, req.RemoteEndpoints.ObjectMeta.ResourceVersion, req.Attempt) {
+			continue
+		}
+		// Transformers change the request, so a retry starts over from what the reader sent
+		next := &k8.EndpointsRequest{Type: req.Type, RemoteEndpoints: req.RemoteEndpoints, Attempt: req.Attempt + 1}
+		meta := req.RemoteEndpoints.ObjectMeta
+		if err := TransformEndpoints(req, transformers...); err != nil {
+			var obj runtime.Object = req.RemoteEndpoints
+			if req.LocalEndpoints != nil {
+				obj = req.LocalEndpoints
 			}
+			if reportTransformerError(err, k8.K8Endpoints, recorder, obj) {
+				retries.Failed(k8.K8Endpoints+k8.TransformKindSuffix, meta.Namespace, meta.Name, err, func() {
+					select {
+					case in <- next:
+					case <-ctx.Done():
+					}
+				})
+			}
+			continue
+		}
+		retries.Succeeded(k8.K8Endpoints+k8.TransformKindSuffix, meta.Namespace, meta.Name)
+		if req.Type == k8.RequestTypeDelete {
+			delete(latest, key)
+		}
+		state.Default.Enqueue(k8.K8Endpoints, k8.RequestTypeMap[req.Type], req.LocalEndpoints.ObjectMeta.Namespace, req.LocalEndpoints.Name)
+		select {
+		case <-ctx.Done():
+			return
+		case out <- req:
 		}
-		out <- req
 	}
 }
 
-func ServicePipeline(in, out chan *k8.ServiceRequest, transformers ...ServiceTransformer) {
-OUTER:
+// ServicePipeline transforms requests and sends them on to the writer until the context is done. Requests that
+// fail with a retryable error are sent through again by the retry tracker, and terminal errors are recorded as events
+func ServicePipeline(ctx context.Context, in, out chan *k8.ServiceRequest, recorder record.EventRecorder, retries *retry.Tracker, transformers ...ServiceTransformer) {
+	latest := map[string]string{}
 	for {
-		req := <-in
-		for _, transformer := range transformers {
-			// We've already reported the error. However, we don't want anything to fail here, so we
-			// just skip trying to create the request
-			if err := transformer(req); err != nil {
-				continue OUTER
+		var req *k8.ServiceRequest
+		select {
+		case <-ctx.Done():
+			return
+		case req = <-in:
+		}
+		key := remoteKey(req.RemoteService.ObjectMeta)
+		if !currentRequest(latest, key, req.RemoteService.ObjectMeta.ResourceVersion, req.Attempt) {
+			continue
+		}
+		// Transformers change the request, so a retry starts over from what the reader sent
+		next := &k8.ServiceRequest{Type: req.Type, RemoteService: req.RemoteService, Attempt: req.Attempt + 1}
+		meta := req.RemoteService.ObjectMeta
+		if err := TransformService(req, transformers...); err != nil {
+			var obj runtime.Object = req.RemoteService
+			if req.LocalService != nil {
+				obj = req.LocalService
+			}
+			if reportTransformerError(err, k8.K8Services, recorder, obj) {
+				retries.Failed(k8.K8Services+k8.TransformKindSuffix, meta.Namespace, meta.Name, err, func() {
+					select {
+					case in <- next:
+					case <-ctx.Done():
+					}
+				})
 			}
+			continue
+		}
+		retries.Succeeded(k8.K8Services+k8.TransformKindSuffix, meta.Namespace, meta.Name)
+		if req.Type == k8.RequestTypeDelete {
+			delete(latest, key)
+		}
+		state.Default.Enqueue(k8.K8Services, k8.RequestTypeMap[req.Type], req.LocalService.ObjectMeta.Namespace, req.LocalService.Name)
+		select {
+		case <-ctx.Done():
+			return
+		case out <- req:
+		}
+	}
+}
+
+// TransformEndpoints runs a single request through the transformers, stopping at the first error
+func TransformEndpoints(req *k8.EndpointsRequest, transformers ...EndpointsTransformer) error {
+	for _, transformer := range transformers {
+		if err := transformer(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransformService runs a single request through the transformers, stopping at the first error
+func TransformService(req *k8.ServiceRequest, transformers ...ServiceTransformer) error {
+	for _, transformer := range transformers {
+		if err := transformer(req); err != nil {
+			return err
 		}
-		out <- req
 	}
+	return nil
+}
+
+// Records the resource version of new requests, and checks that retries haven't been superseded by a newer event
+// for the same object in the meantime
+func currentRequest(latest map[string]string, key, resourceVersion string, attempt int) bool {
+	if attempt == 0 {
+		latest[key] = resourceVersion
+		return true
+	}
+	return latest[key] == resourceVersion
+}
+
+// Retryable errors are logged and should be tried again. Terminal ones are recorded as an event on the object and
+// the request is dropped
+func reportTransformerError(err error, kind string, recorder record.EventRecorder, obj runtime.Object) bool {
+	transformer := "unknown"
+	if transformerErr, ok := err.(*TransformerError); ok {
+		transformer = transformerErr.Transformer
+	}
+	if IsRetryable(err) {
+		metrics.TransformerErrors.Add(metrics.Key(kind, transformer, "retryable"), 1)
+		logger.Warn("Transformer failed, retrying", zap.Error(err))
+		return true
+	}
+	metrics.TransformerErrors.Add(metrics.Key(kind, transformer, "terminal"), 1)
+	logger.Warn("Transformer failed, dropping request", zap.Error(err))
+	if recorder != nil {
+		recorder.Event(obj, v1.EventTypeWarning, "TransformerFailed", err.Error())
+	}
+	return false
+}
+
+func remoteKey(meta metav1.ObjectMeta) string {
+	return fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
 }
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/retry"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServicePipelineRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan *k8.ServiceRequest, 1)
+	out := make(chan *k8.ServiceRequest, 1)
+	retries := retry.New(2)
+	retries.BaseDelay = time.Millisecond
+
+	// Fails once with a retryable error, then copies the remote service over
+	calls := 0
+	transformer := func(req *k8.ServiceRequest) error {
+		calls++
+		if calls == 1 {
+			return Retryable(errors.New("oh no"))
+		}
+		req.LocalService = req.RemoteService.DeepCopy()
+		return nil
+	}
+	go ServicePipeline(ctx, in, out, nil, retries, transformer)
+
+	in <- &k8.ServiceRequest{
+		Type:          k8.RequestTypeAdd,
+		RemoteService: &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", ResourceVersion: "1"}},
+	}
+	select {
+	case req := <-out:
+		if req.Attempt != 1 {
+			t.Errorf("Expected attempt: 1\ngot: %d", req.Attempt)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the request to be retried")
+	}
+	if deadLetters := retries.DeadLetters(); len(deadLetters) != 0 {
+		t.Errorf("Expected no dead letters\ngot: %+v", deadLetters)
+	}
+}
+
+func TestServicePipelineDeadLetters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan *k8.ServiceRequest, 1)
+	out := make(chan *k8.ServiceRequest, 1)
+	retries := retry.New(2)
+	retries.BaseDelay = time.Millisecond
+
+	failed := make(chan struct{}, 2)
+	transformer := func(req *k8.ServiceRequest) error {
+		failed <- struct{}{}
+		return Retryable(errors.New("oh no"))
+	}
+	go ServicePipeline(ctx, in, out, nil, retries, transformer)
+
+	in <- &k8.ServiceRequest{
+		Type:          k8.RequestTypeAdd,
+		RemoteService: &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", ResourceVersion: "1"}},
+	}
+	// The second failure dead letters the request, which isn't retried again
+	for i := 0; i < 2; i++ {
+		select {
+		case <-failed:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %d attempts\ngot: %d", 2, i)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(retries.DeadLetters()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	deadLetters := retries.DeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].Kind != "services-transform" || deadLetters[0].Name != "foo" {
+		t.Errorf("Expected services-transform bar/foo to be dead lettered\ngot: %+v", deadLetters)
+	}
+	select {
+	case <-failed:
+		t.Errorf("Expected the dead lettered request not to be retried")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"strconv"
+	"strings"
+
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ExposePortsAnnotationKey lists the ports of the remote service the follower exposes, by name or number
+	ExposePortsAnnotationKey = "fair.com/cross-cluster-expose-ports"
+	// PortMapAnnotationKey lists renamed and renumbered ports, as from=name, from=number or from=name/number
+	PortMapAnnotationKey = "fair.com/cross-cluster-port-map"
+)
+
+// Ports renames, renumbers and drops the ports of followers. The rules come from annotations on the remote service,
+// and ports can also be excluded from every follower. The follower endpoints' ports are matched to the service ports
+// by name, so they're renamed and dropped along with them. Renumbering only changes the service port, the endpoints
+// keep pointing at the remote pods' ports
+type Ports struct {
+	// Names or numbers of ports that are never exposed
+	Exclude []string `json:"exclude"`
+	// Used to look up the remote service of endpoints
+	RemoteClient kubernetes.Interface `json:"-"`
+}
+
+type portRule struct {
+	Drop bool
+	Name string
+	Port int32
+}
+
+// Service applies the rules to the follower service's ports
+func (p *Ports) Service(req *k8.ServiceRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	rules := p.rules(req.RemoteService)
+	ports := []v1.ServicePort{}
+	for _, port := range req.LocalService.Spec.Ports {
+		rule := rules[port.Name]
+		if rule.Drop {
+			continue
+		}
+		if rule.Name != "" {
+			port.Name = rule.Name
+		}
+		if rule.Port != 0 {
+			port.Port = rule.Port
+		}
+		ports = append(ports, port)
+	}
+	req.LocalService.Spec.Ports = ports
+	return nil
+}
+
+// Endpoints applies the rules to the follower endpoints' ports, so they keep matching the service
+func (p *Ports) Endpoints(req *k8.EndpointsRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	svc, err := p.RemoteClient.CoreV1().Services(req.RemoteEndpoints.ObjectMeta.Namespace).Get(req.RemoteEndpoints.Name, metav1.GetOptions{})
+	if err != nil {
+		// Without the service there's nothing to match the ports to
+		if k8.ResourceNotExist(err) {
+			return nil
+		}
+		return ferrors.Error(err)
+	}
+	rules := p.rules(svc)
+	subsets := []v1.EndpointSubset{}
+	for _, subset := range req.LocalEndpoints.Subsets {
+		ports := []v1.EndpointPort{}
+		for _, port := range subset.Ports {
+			rule := rules[port.Name]
+			if rule.Drop {
+				continue
+			}
+			if rule.Name != "" {
+				port.Name = rule.Name
+			}
+			ports = append(ports, port)
+		}
+		// A subset without ports doesn't route anywhere
+		if len(ports) == 0 {
+			continue
+		}
+		subset.Ports = ports
+		subsets = append(subsets, subset)
+	}
+	req.LocalEndpoints.Subsets = subsets
+	return nil
+}
+
+// Works out the rules for each port of the remote service, keyed by port name
+func (p *Ports) rules(svc *v1.Service) map[string]portRule {
+	annotations := svc.ObjectMeta.Annotations
+	expose := splitList(annotations[ExposePortsAnnotationKey])
+	portMap := map[string]string{}
+	for _, entry := range splitList(annotations[PortMapAnnotationKey]) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			logger.Warn("Ignoring invalid port map entry", zap.String("entry", entry),
+				zap.String("name", svc.Name), zap.String("namespace", svc.ObjectMeta.Namespace))
+			continue
+		}
+		portMap[parts[0]] = parts[1]
+	}
+
+	rules := map[string]portRule{}
+	for _, port := range svc.Spec.Ports {
+		rule := portRule{}
+		if matchesPort(port, p.Exclude) || (len(expose) > 0 && !matchesPort(port, expose)) {
+			rule.Drop = true
+		}
+		for from, to := range portMap {
+			if matchesPort(port, []string{from}) {
+				rule.Name, rule.Port = parsePortTarget(to)
+			}
+		}
+		rules[port.Name] = rule
+	}
+	return rules
+}
+
+// Parses name, number or name/number
+func parsePortTarget(target string) (string, int32) {
+	name := target
+	number := ""
+	if i := strings.Index(target, "/"); i >= 0 {
+		name, number = target[:i], target[i+1:]
+	} else if _, err := strconv.Atoi(target); err == nil {
+		name, number = "", target
+	}
+	port, err := strconv.ParseInt(number, 10, 32)
+	if err != nil {
+		return name, 0
+	}
+	return name, int32(port)
+}
+
+func matchesPort(port v1.ServicePort, refs []string) bool {
+	for _, ref := range refs {
+		if ref == port.Name || ref == strconv.Itoa(int(port.Port)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits a comma separated list, ignoring empty entries
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPortsService(t *testing.T) {
+	ports := []v1.ServicePort{
+		v1.ServicePort{Name: "grpc", Port: 9090},
+		v1.ServicePort{Name: "http", Port: 80},
+		v1.ServicePort{Name: "metrics", Port: 9100},
+	}
+	testCases := []struct {
+		Annotations map[string]string
+		Exclude     []string
+		Expected    []v1.ServicePort
+	}{
+		// No rules exposes every port
+		{
+			Expected: ports,
+		},
+		// Only the exposed ports are kept
+		{
+			Annotations: map[string]string{ExposePortsAnnotationKey: "grpc, 80"},
+			Expected: []v1.ServicePort{
+				v1.ServicePort{Name: "grpc", Port: 9090},
+				v1.ServicePort{Name: "http", Port: 80},
+			},
+		},
+		// Excluded ports are dropped, and mapped ports are renamed and renumbered
+		{
+			Annotations: map[string]string{PortMapAnnotationKey: "grpc=grpc-public/19090,80=8080,invalid"},
+			Exclude:     []string{"metrics"},
+			Expected: []v1.ServicePort{
+				v1.ServicePort{Name: "grpc-public", Port: 19090},
+				v1.ServicePort{Name: "http", Port: 8080},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		remote := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Annotations: testCase.Annotations},
+			Spec:       v1.ServiceSpec{Ports: ports},
+		}
+		req := &k8.ServiceRequest{
+			Type:          k8.RequestTypeUpdate,
+			RemoteService: remote,
+			LocalService:  &v1.Service{Spec: v1.ServiceSpec{Ports: ports}},
+		}
+		p := &Ports{Exclude: testCase.Exclude}
+		if err := p.Service(req); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(testCase.Expected, req.LocalService.Spec.Ports) {
+			t.Errorf("Expected ports: %+v\ngot: %+v", testCase.Expected, req.LocalService.Spec.Ports)
+		}
+	}
+}
+
+func TestPortsEndpoints(t *testing.T) {
+	remoteClient := fake.NewSimpleClientset(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "bar",
+			Annotations: map[string]string{
+				ExposePortsAnnotationKey: "grpc",
+				PortMapAnnotationKey:     "grpc=grpc-public/19090",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				v1.ServicePort{Name: "grpc", Port: 9090},
+				v1.ServicePort{Name: "metrics", Port: 9100},
+			},
+		},
+	})
+	req := &k8.EndpointsRequest{
+		Type:            k8.RequestTypeUpdate,
+		RemoteEndpoints: &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"}},
+		LocalEndpoints: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}},
+					Ports: []v1.EndpointPort{
+						v1.EndpointPort{Name: "grpc", Port: 9090},
+						v1.EndpointPort{Name: "metrics", Port: 9100},
+					},
+				},
+				// Subsets left without ports are dropped
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.2"}},
+					Ports:     []v1.EndpointPort{v1.EndpointPort{Name: "metrics", Port: 9100}},
+				},
+			},
+		},
+	}
+	// The endpoints port is renamed to match the service, but keeps pointing at the remote pod's port
+	expected := []v1.EndpointSubset{
+		v1.EndpointSubset{
+			Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{v1.EndpointPort{Name: "grpc-public", Port: 9090}},
+		},
+	}
+
+	p := &Ports{RemoteClient: remoteClient}
+	if err := p.Endpoints(req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(expected, req.LocalEndpoints.Subsets) {
+		t.Errorf("Expected subsets: %+v\ngot: %+v", expected, req.LocalEndpoints.Subsets)
+	}
+}
@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// NotReadyKeep copies not ready addresses over as they are
+	NotReadyKeep NotReadyPolicy = "keep"
+	// NotReadyDrop leaves not ready addresses out of the local endpoints
+	NotReadyDrop NotReadyPolicy = "drop"
+	// NotReadyPromote makes not ready addresses ready if the remote service publishes them, and keeps them otherwise
+	NotReadyPromote NotReadyPolicy = "promote"
+
+	// RemoteTargetsAnnotationKey holds the remote pods and nodes behind each address, which don't exist locally
+	RemoteTargetsAnnotationKey = "fair.com/cross-cluster-remote-targets"
+
+	tolerateUnreadyAnnotationKey = "service.alpha.kubernetes.io/tolerate-unready-endpoints"
+)
+
+var (
+	ErrInvalidNotReadyPolicy = errors.New("The not ready policy must be keep, drop or promote.")
+)
+
+// NotReadyPolicy is how the remote endpoints' not ready addresses are handled
+type NotReadyPolicy string
+
+// ParseNotReadyPolicy checks that the policy is one of the known ones
+func ParseNotReadyPolicy(policy string) (NotReadyPolicy, error) {
+	switch NotReadyPolicy(policy) {
+	case NotReadyKeep, NotReadyDrop, NotReadyPromote:
+		return NotReadyPolicy(policy), nil
+	}
+	return "", ErrInvalidNotReadyPolicy
+}
+
+// RemoteTarget is what an address pointed at in the remote cluster
+type RemoteTarget struct {
+	NodeName  string `json:"nodeName,omitempty"`
+	TargetRef string `json:"targetRef,omitempty"`
+}
+
+// Readiness applies the not ready policy to the local endpoints
+type Readiness struct {
+	Policy NotReadyPolicy `json:"policy"`
+	// Only used by the promote policy, to check whether the remote service publishes not ready addresses
+	RemoteClient kubernetes.Interface `json:"-"`
+}
+
+// Endpoints applies the not ready policy. The subsets are rebuilt rather than changed in place, since they're
+// shared with the remote endpoints
+func (r *Readiness) Endpoints(req *k8.EndpointsRequest) error {
+	if req.Type == k8.RequestTypeDelete || r.Policy == NotReadyKeep {
+		return nil
+	}
+	promote := false
+	if r.Policy == NotReadyPromote {
+		publish, err := r.publishNotReady(req.RemoteEndpoints.ObjectMeta.Namespace, req.RemoteEndpoints.Name)
+		if err != nil {
+			return err
+		}
+		// Nothing to promote, so the not ready addresses are kept as they are
+		if !publish {
+			return nil
+		}
+		promote = true
+	}
+
+	subsets := []v1.EndpointSubset{}
+	for _, subset := range req.LocalEndpoints.Subsets {
+		addresses := append([]v1.EndpointAddress{}, subset.Addresses...)
+		if promote {
+			addresses = append(addresses, subset.NotReadyAddresses...)
+		}
+		// A subset needs at least one address to be valid
+		if len(addresses) == 0 {
+			continue
+		}
+		subsets = append(subsets, v1.EndpointSubset{
+			Addresses: addresses,
+			Ports:     subset.Ports,
+		})
+	}
+	req.LocalEndpoints.Subsets = subsets
+	return nil
+}
+
+// Checks the service itself, and the annotation that came before the field
+func (r *Readiness) publishNotReady(namespace, name string) (bool, error) {
+	svc, err := r.RemoteClient.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if k8.ResourceNotExist(err) {
+			return false, nil
+		}
+		return false, ferrors.Error(err)
+	}
+	return svc.Spec.PublishNotReadyAddresses || svc.ObjectMeta.Annotations[tolerateUnreadyAnnotationKey] == "true", nil
+}
+
+// EndpointsTargets strips the remote pods and nodes from the addresses, so nothing locally tries to look them up.
+// They're kept in an annotation instead, keyed by IP
+func EndpointsTargets(req *k8.EndpointsRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	targets := map[string]RemoteTarget{}
+	subsets := make([]v1.EndpointSubset, 0, len(req.LocalEndpoints.Subsets))
+	for _, subset := range req.LocalEndpoints.Subsets {
+		subsets = append(subsets, v1.EndpointSubset{
+			Addresses:         stripTargets(subset.Addresses, targets),
+			NotReadyAddresses: stripTargets(subset.NotReadyAddresses, targets),
+			Ports:             subset.Ports,
+		})
+	}
+	req.LocalEndpoints.Subsets = subsets
+
+	meta := &req.LocalEndpoints.ObjectMeta
+	if len(targets) == 0 {
+		delete(meta.Annotations, RemoteTargetsAnnotationKey)
+		return nil
+	}
+	value, err := json.Marshal(targets)
+	if err != nil {
+		return ferrors.Error(err)
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[RemoteTargetsAnnotationKey] = string(value)
+	return nil
+}
+
+func stripTargets(addresses []v1.EndpointAddress, targets map[string]RemoteTarget) []v1.EndpointAddress {
+	if addresses == nil {
+		return nil
+	}
+	stripped := make([]v1.EndpointAddress, 0, len(addresses))
+	for _, address := range addresses {
+		target := RemoteTarget{}
+		if address.NodeName != nil {
+			target.NodeName = *address.NodeName
+		}
+		if ref := address.TargetRef; ref != nil {
+			target.TargetRef = fmt.Sprintf("%s/%s/%s", ref.Kind, ref.Namespace, ref.Name)
+		}
+		if target != (RemoteTarget{}) {
+			targets[address.IP] = target
+		}
+		address.NodeName = nil
+		address.TargetRef = nil
+		stripped = append(stripped, address)
+	}
+	return stripped
+}
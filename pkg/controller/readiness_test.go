@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReadinessEndpoints(t *testing.T) {
+	subsets := []v1.EndpointSubset{
+		v1.EndpointSubset{
+			Addresses:         []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}},
+			NotReadyAddresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.2"}},
+			Ports:             []v1.EndpointPort{v1.EndpointPort{Port: 80}},
+		},
+		v1.EndpointSubset{
+			NotReadyAddresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.3"}},
+			Ports:             []v1.EndpointPort{v1.EndpointPort{Port: 8080}},
+		},
+	}
+	testCases := []struct {
+		Policy          NotReadyPolicy
+		PublishNotReady bool
+		Expected        []v1.EndpointSubset
+	}{
+		// Keep leaves the subsets as they are
+		{
+			Policy:   NotReadyKeep,
+			Expected: subsets,
+		},
+		// Drop removes not ready addresses, and subsets left without any addresses
+		{
+			Policy: NotReadyDrop,
+			Expected: []v1.EndpointSubset{
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}},
+					Ports:     []v1.EndpointPort{v1.EndpointPort{Port: 80}},
+				},
+			},
+		},
+		// Promote keeps not ready addresses as they are if the remote service doesn't publish them
+		{
+			Policy:   NotReadyPromote,
+			Expected: subsets,
+		},
+		// Promote makes not ready addresses ready if the remote service publishes them
+		{
+			Policy:          NotReadyPromote,
+			PublishNotReady: true,
+			Expected: []v1.EndpointSubset{
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}, v1.EndpointAddress{IP: "10.0.0.2"}},
+					Ports:     []v1.EndpointPort{v1.EndpointPort{Port: 80}},
+				},
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.3"}},
+					Ports:     []v1.EndpointPort{v1.EndpointPort{Port: 8080}},
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		remoteClient := fake.NewSimpleClientset(&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"},
+			Spec:       v1.ServiceSpec{PublishNotReadyAddresses: testCase.PublishNotReady},
+		})
+		readiness := &Readiness{Policy: testCase.Policy, RemoteClient: remoteClient}
+		req := &k8.EndpointsRequest{
+			Type:            k8.RequestTypeUpdate,
+			RemoteEndpoints: &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"}},
+			LocalEndpoints:  &v1.Endpoints{Subsets: subsets},
+		}
+		if err := readiness.Endpoints(req); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(testCase.Expected, req.LocalEndpoints.Subsets) {
+			t.Errorf("Expected subsets: %+v\ngot: %+v", testCase.Expected, req.LocalEndpoints.Subsets)
+		}
+	}
+}
+
+func TestEndpointsTargets(t *testing.T) {
+	nodeName := "node-a"
+	req := &k8.EndpointsRequest{
+		Type: k8.RequestTypeUpdate,
+		LocalEndpoints: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{
+						v1.EndpointAddress{
+							IP:        "10.0.0.1",
+							NodeName:  &nodeName,
+							TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "bar", Name: "foo-1"},
+						},
+						v1.EndpointAddress{IP: "10.0.0.2"},
+					},
+				},
+			},
+		},
+	}
+	expectedSubsets := []v1.EndpointSubset{
+		v1.EndpointSubset{
+			Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}, v1.EndpointAddress{IP: "10.0.0.2"}},
+		},
+	}
+	expectedAnnotation := `{"10.0.0.1":{"nodeName":"node-a","targetRef":"Pod/bar/foo-1"}}`
+
+	if err := EndpointsTargets(req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(expectedSubsets, req.LocalEndpoints.Subsets) {
+		t.Errorf("Expected subsets: %+v\ngot: %+v", expectedSubsets, req.LocalEndpoints.Subsets)
+	}
+	if annotation := req.LocalEndpoints.ObjectMeta.Annotations[RemoteTargetsAnnotationKey]; annotation != expectedAnnotation {
+		t.Errorf("Expected annotation: %s\ngot: %s", expectedAnnotation, annotation)
+	}
+}
@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// Dependencies are what transformers can be built with, on top of their own parameters
+type Dependencies struct {
+	LocalClient  kubernetes.Interface
+	RemoteClient kubernetes.Interface
+	// Optional. Only set while running the controller, commands don't record events
+	Recorder record.EventRecorder
+	// Optional. Names of the local and remote clusters
+	LocalCluster  string
+	RemoteCluster string
+}
+
+// ServiceTransformerFactory builds a service transformer from its parameters in the pipeline config
+type ServiceTransformerFactory func(deps *Dependencies, params json.RawMessage) (ServiceTransformer, error)
+
+// EndpointsTransformerFactory builds an endpoints transformer from its parameters in the pipeline config
+type EndpointsTransformerFactory func(deps *Dependencies, params json.RawMessage) (EndpointsTransformer, error)
+
+// TransformerConfig is a single step of a pipeline
+type TransformerConfig struct {
+	Name   string          `json:"name"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// PipelineConfig is the order and parameters of the transformers every request goes through
+type PipelineConfig struct {
+	Services  []TransformerConfig `json:"services"`
+	Endpoints []TransformerConfig `json:"endpoints"`
+}
+
+// LoadPipelineConfig reads a pipeline config from a YAML file
+func LoadPipelineConfig(path string) (*PipelineConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &PipelineConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Could not parse pipeline config %s: %s", path, err.Error())
+	}
+	return config, nil
+}
+
+// Registry looks up transformers by the name they're given in the pipeline config
+type Registry struct {
+	services  map[string]ServiceTransformerFactory
+	endpoints map[string]EndpointsTransformerFactory
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		services:  map[string]ServiceTransformerFactory{},
+		endpoints: map[string]EndpointsTransformerFactory{},
+	}
+}
+
+// RegisterService adds a service transformer, replacing any with the same name
+func (r *Registry) RegisterService(name string, factory ServiceTransformerFactory) {
+	r.services[name] = factory
+}
+
+// RegisterEndpoints adds an endpoints transformer, replacing any with the same name
+func (r *Registry) RegisterEndpoints(name string, factory EndpointsTransformerFactory) {
+	r.endpoints[name] = factory
+}
+
+// ServiceTransformers builds the service transformers in the order they're configured
+func (r *Registry) ServiceTransformers(deps *Dependencies, configs []TransformerConfig) ([]ServiceTransformer, error) {
+	transformers := []ServiceTransformer{}
+	for _, config := range configs {
+		factory, ok := r.services[config.Name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown service transformer %q, expected one of %v", config.Name, serviceNames(r.services))
+		}
+		transformer, err := factory(deps, config.Params)
+		if err != nil {
+			return nil, fmt.Errorf("Could not build service transformer %q: %s", config.Name, err.Error())
+		}
+		transformers = append(transformers, namedService(config.Name, transformer))
+	}
+	return transformers, nil
+}
+
+// EndpointsTransformers builds the endpoints transformers in the order they're configured
+func (r *Registry) EndpointsTransformers(deps *Dependencies, configs []TransformerConfig) ([]EndpointsTransformer, error) {
+	transformers := []EndpointsTransformer{}
+	for _, config := range configs {
+		factory, ok := r.endpoints[config.Name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown endpoints transformer %q, expected one of %v", config.Name, endpointsNames(r.endpoints))
+		}
+		transformer, err := factory(deps, config.Params)
+		if err != nil {
+			return nil, fmt.Errorf("Could not build endpoints transformer %q: %s", config.Name, err.Error())
+		}
+		transformers = append(transformers, namedEndpoints(config.Name, transformer))
+	}
+	return transformers, nil
+}
+
+// DecodeParams decodes a transformer's parameters over the defaults already in v. Unknown fields are an error, so
+// typos in the config don't go unnoticed
+func DecodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// Errors are wrapped with the transformer's name, so they can be traced back to the step of the pipeline
+func namedService(name string, transformer ServiceTransformer) ServiceTransformer {
+	return func(req *k8.ServiceRequest) error {
+		if err := transformer(req); err != nil {
+			return newTransformerError(name, k8.K8Services, req.Type, req.RemoteService.ObjectMeta, err)
+		}
+		return nil
+	}
+}
+
+func namedEndpoints(name string, transformer EndpointsTransformer) EndpointsTransformer {
+	return func(req *k8.EndpointsRequest) error {
+		if err := transformer(req); err != nil {
+			return newTransformerError(name, k8.K8Endpoints, req.Type, req.RemoteEndpoints.ObjectMeta, err)
+		}
+		return nil
+	}
+}
+
+func serviceNames(factories map[string]ServiceTransformerFactory) []string {
+	names := []string{}
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func endpointsNames(factories map[string]EndpointsTransformerFactory) []string {
+	names := []string{}
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLoadPipelineConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatalf("Could not create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pipeline.yaml")
+	config := `
+services:
+- name: augmenter
+- name: port-filter
+  params:
+    exclude: [metrics]
+endpoints:
+- name: augmenter
+- name: readiness
+  params:
+    policy: drop
+`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("Could not write pipeline config %v", err)
+	}
+
+	pipeline, err := LoadPipelineConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := &PipelineConfig{
+		Services: []TransformerConfig{
+			TransformerConfig{Name: "augmenter"},
+			TransformerConfig{Name: "port-filter", Params: json.RawMessage(`{"exclude":["metrics"]}`)},
+		},
+		Endpoints: []TransformerConfig{
+			TransformerConfig{Name: "augmenter"},
+			TransformerConfig{Name: "readiness", Params: json.RawMessage(`{"policy":"drop"}`)},
+		},
+	}
+	if !reflect.DeepEqual(expected, pipeline) {
+		t.Errorf("Expected pipeline: %+v\ngot: %+v", expected, pipeline)
+	}
+}
+
+func TestRegistryEndpointsTransformers(t *testing.T) {
+	testCases := []struct {
+		Configs  []TransformerConfig
+		Expected int
+		Err      bool
+	}{
+		// Every transformer is built in order
+		{
+			Configs: []TransformerConfig{
+				TransformerConfig{Name: "augmenter"},
+				TransformerConfig{Name: "readiness", Params: json.RawMessage(`{"policy":"promote"}`)},
+				TransformerConfig{Name: "targets"},
+			},
+			Expected: 3,
+		},
+		// Unknown transformers are an error
+		{
+			Configs: []TransformerConfig{TransformerConfig{Name: "nope"}},
+			Err:     true,
+		},
+		// Unknown parameters are an error
+		{
+			Configs: []TransformerConfig{TransformerConfig{Name: "readiness", Params: json.RawMessage(`{"polcy":"drop"}`)}},
+			Err:     true,
+		},
+		// Invalid parameters are an error
+		{
+			Configs: []TransformerConfig{TransformerConfig{Name: "readiness", Params: json.RawMessage(`{"policy":"maybe"}`)}},
+			Err:     true,
+		},
+		// Remote ranges separate from the local ones are valid
+		{
+			Configs: []TransformerConfig{
+				TransformerConfig{Name: "cidr-filter", Params: json.RawMessage(`{"remote":["10.1.0.0/16"],"local":["10.2.0.0/16","10.3.0.0/16"]}`)},
+			},
+			Expected: 1,
+		},
+		// A remote range overlapping a local one is invalid
+		{
+			Configs: []TransformerConfig{
+				TransformerConfig{Name: "cidr-filter", Params: json.RawMessage(`{"remote":["10.0.0.0/8"],"local":["192.168.0.0/16","10.3.0.0/16"]}`)},
+			},
+			Err: true,
+		},
+		// Unknown health check modes are an error
+		{
+			Configs: []TransformerConfig{TransformerConfig{Name: "health-check", Params: json.RawMessage(`{"mode":"icmp"}`)}},
+			Err:     true,
+		},
+	}
+
+	registry := NewDefaultRegistry()
+	deps := &Dependencies{LocalClient: fake.NewSimpleClientset(), RemoteClient: fake.NewSimpleClientset()}
+	for _, testCase := range testCases {
+		transformers, err := registry.EndpointsTransformers(deps, testCase.Configs)
+		if (err != nil) != testCase.Err {
+			t.Errorf("Expected error: %t\ngot: %v", testCase.Err, err)
+			continue
+		}
+		if len(transformers) != testCase.Expected {
+			t.Errorf("Expected transformers: %d\ngot: %d", testCase.Expected, len(transformers))
+		}
+	}
+}
+
+func TestRegistryServiceTransformers(t *testing.T) {
+	registry := NewDefaultRegistry()
+	deps := &Dependencies{LocalClient: fake.NewSimpleClientset(), RemoteClient: fake.NewSimpleClientset()}
+	// Endpoints only transformers can't be used for services
+	if _, err := registry.ServiceTransformers(deps, []TransformerConfig{TransformerConfig{Name: "readiness"}}); err == nil {
+		t.Errorf("Expected error: true\ngot: %v", err)
+	}
+	transformers, err := registry.ServiceTransformers(deps, []TransformerConfig{
+		TransformerConfig{Name: "augmenter"},
+		TransformerConfig{Name: "name-template", Params: json.RawMessage(`{"template":"{{.Cluster}}-{{.Name}}"}`)},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(transformers) != 2 {
+		t.Errorf("Expected transformers: 2\ngot: %d", len(transformers))
+	}
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"bytes"
+	"text/template"
+
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// NamespaceMap moves followers to a different namespace from their remote object
+type NamespaceMap struct {
+	// Remote namespace to local namespace. Namespaces that aren't listed are kept
+	Namespaces map[string]string    `json:"namespaces"`
+	Client     kubernetes.Interface `json:"-"`
+}
+
+// Service moves the follower service if its remote namespace is mapped
+func (n *NamespaceMap) Service(req *k8.ServiceRequest) error {
+	namespace, ok := n.Namespaces[req.RemoteService.ObjectMeta.Namespace]
+	if !ok {
+		return nil
+	}
+	return relocateService(n.Client, req, namespace, req.LocalService.Name)
+}
+
+// Endpoints moves the follower endpoints if its remote namespace is mapped
+func (n *NamespaceMap) Endpoints(req *k8.EndpointsRequest) error {
+	namespace, ok := n.Namespaces[req.RemoteEndpoints.ObjectMeta.Namespace]
+	if !ok {
+		return nil
+	}
+	return relocateEndpoints(n.Client, req, namespace, req.LocalEndpoints.Name)
+}
+
+// NameTemplate renames followers. The template gets the remote namespace and name, and the remote cluster
+type NameTemplate struct {
+	Template string               `json:"template"`
+	Cluster  string               `json:"-"`
+	Client   kubernetes.Interface `json:"-"`
+
+	tmpl *template.Template
+}
+
+type nameTemplateData struct {
+	Namespace string
+	Name      string
+	Cluster   string
+}
+
+// Parse checks the template, and has to be called before the transformer is used
+func (n *NameTemplate) Parse() error {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(n.Template)
+	if err != nil {
+		return err
+	}
+	n.tmpl = tmpl
+	return nil
+}
+
+// Service renames the follower service
+func (n *NameTemplate) Service(req *k8.ServiceRequest) error {
+	name, err := n.render(req.RemoteService.ObjectMeta)
+	if err != nil {
+		return err
+	}
+	return relocateService(n.Client, req, req.LocalService.ObjectMeta.Namespace, name)
+}
+
+// Endpoints renames the follower endpoints, which has to match the service's name
+func (n *NameTemplate) Endpoints(req *k8.EndpointsRequest) error {
+	name, err := n.render(req.RemoteEndpoints.ObjectMeta)
+	if err != nil {
+		return err
+	}
+	return relocateEndpoints(n.Client, req, req.LocalEndpoints.ObjectMeta.Namespace, name)
+}
+
+func (n *NameTemplate) render(remoteMeta metav1.ObjectMeta) (string, error) {
+	var name bytes.Buffer
+	data := nameTemplateData{Namespace: remoteMeta.Namespace, Name: remoteMeta.Name, Cluster: n.Cluster}
+	if err := n.tmpl.Execute(&name, data); err != nil {
+		return "", ferrors.Error(err)
+	}
+	return name.String(), nil
+}
+
+// Followers are looked up by the remote namespace and name before they're moved, so the request is pointed at
+// whatever already exists at the new location instead. The remote location is recorded, so the follower can be
+// matched back to its remote object
+func relocateService(client kubernetes.Interface, req *k8.ServiceRequest, namespace, name string) error {
+	// Deletes reuse the remote object as the local one, so it's copied before it's changed
+	local := req.LocalService.DeepCopy()
+	local.ObjectMeta.Namespace = namespace
+	local.Name = name
+	setRemoteLocation(&local.ObjectMeta, req.RemoteService.ObjectMeta)
+	if req.Type != k8.RequestTypeDelete {
+		existing, err := client.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+		switch {
+		case k8.ResourceNotExist(err):
+			req.Type = k8.RequestTypeAdd
+			local.ObjectMeta.ResourceVersion = ""
+			local.ObjectMeta.UID = ""
+			local.Spec.ClusterIP = ""
+		case err != nil:
+			return ferrors.Error(err)
+		default:
+			req.Type = k8.RequestTypeUpdate
+			local.ObjectMeta.ResourceVersion = existing.ObjectMeta.ResourceVersion
+			local.ObjectMeta.UID = existing.ObjectMeta.UID
+			local.Spec.ClusterIP = existing.Spec.ClusterIP
+		}
+	}
+	req.LocalService = local
+	return nil
+}
+
+func relocateEndpoints(client kubernetes.Interface, req *k8.EndpointsRequest, namespace, name string) error {
+	local := req.LocalEndpoints.DeepCopy()
+	local.ObjectMeta.Namespace = namespace
+	local.Name = name
+	setRemoteLocation(&local.ObjectMeta, req.RemoteEndpoints.ObjectMeta)
+	if req.Type != k8.RequestTypeDelete {
+		existing, err := client.CoreV1().Endpoints(namespace).Get(name, metav1.GetOptions{})
+		switch {
+		case k8.ResourceNotExist(err):
+			req.Type = k8.RequestTypeAdd
+			local.ObjectMeta.ResourceVersion = ""
+			local.ObjectMeta.UID = ""
+		case err != nil:
+			return ferrors.Error(err)
+		default:
+			req.Type = k8.RequestTypeUpdate
+			local.ObjectMeta.ResourceVersion = existing.ObjectMeta.ResourceVersion
+			local.ObjectMeta.UID = existing.ObjectMeta.UID
+		}
+	}
+	req.LocalEndpoints = local
+	return nil
+}
+
+func setRemoteLocation(meta *metav1.ObjectMeta, remoteMeta metav1.ObjectMeta) {
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[k8.CrossClusterRemoteNamespaceAnnotationKey] = remoteMeta.Namespace
+	meta.Annotations[k8.CrossClusterRemoteNameAnnotationKey] = remoteMeta.Name
+}
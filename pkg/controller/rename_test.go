@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNamespaceMapService(t *testing.T) {
+	localClient := fake.NewSimpleClientset(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "mapped", ResourceVersion: "42"},
+		Spec:       v1.ServiceSpec{ClusterIP: "10.0.0.1"},
+	})
+	testCases := []struct {
+		Namespace         string
+		ExpectedType      k8.RequestType
+		ExpectedNamespace string
+		ExpectedVersion   string
+	}{
+		// Namespaces that aren't mapped are kept
+		{
+			Namespace:         "bar",
+			ExpectedType:      k8.RequestTypeUpdate,
+			ExpectedNamespace: "bar",
+		},
+		// The follower is moved onto the service already in the mapped namespace
+		{
+			Namespace:         "baz",
+			ExpectedType:      k8.RequestTypeUpdate,
+			ExpectedNamespace: "mapped",
+			ExpectedVersion:   "42",
+		},
+		// The follower is created if there's nothing in the mapped namespace yet
+		{
+			Namespace:         "qux",
+			ExpectedType:      k8.RequestTypeAdd,
+			ExpectedNamespace: "empty",
+		},
+	}
+
+	namespaceMap := &NamespaceMap{
+		Namespaces: map[string]string{"baz": "mapped", "qux": "empty"},
+		Client:     localClient,
+	}
+	for _, testCase := range testCases {
+		remote := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: testCase.Namespace}}
+		req := &k8.ServiceRequest{
+			Type:          k8.RequestTypeUpdate,
+			RemoteService: remote,
+			LocalService:  remote.DeepCopy(),
+		}
+		if err := namespaceMap.Service(req); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if req.Type != testCase.ExpectedType {
+			t.Errorf("Expected request type: %d\ngot: %d", testCase.ExpectedType, req.Type)
+		}
+		if req.LocalService.ObjectMeta.Namespace != testCase.ExpectedNamespace {
+			t.Errorf("Expected namespace: %s\ngot: %s", testCase.ExpectedNamespace, req.LocalService.ObjectMeta.Namespace)
+		}
+		if req.LocalService.ObjectMeta.ResourceVersion != testCase.ExpectedVersion {
+			t.Errorf("Expected resource version: %s\ngot: %s", testCase.ExpectedVersion, req.LocalService.ObjectMeta.ResourceVersion)
+		}
+		if testCase.ExpectedNamespace != testCase.Namespace {
+			namespace, name := k8.RemoteLocation(req.LocalService.ObjectMeta)
+			if namespace != testCase.Namespace || name != "foo" {
+				t.Errorf("Expected remote location: %s/foo\ngot: %s/%s", testCase.Namespace, namespace, name)
+			}
+		}
+	}
+}
+
+func TestNameTemplateEndpoints(t *testing.T) {
+	nameTemplate := &NameTemplate{Template: "{{.Cluster}}-{{.Namespace}}-{{.Name}}", Cluster: "remote", Client: fake.NewSimpleClientset()}
+	if err := nameTemplate.Parse(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	remote := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"}}
+	req := &k8.EndpointsRequest{
+		Type:            k8.RequestTypeUpdate,
+		RemoteEndpoints: remote,
+		LocalEndpoints:  remote.DeepCopy(),
+	}
+	if err := nameTemplate.Endpoints(req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if req.LocalEndpoints.Name != "remote-bar-foo" {
+		t.Errorf("Expected name: remote-bar-foo\ngot: %s", req.LocalEndpoints.Name)
+	}
+	if req.Type != k8.RequestTypeAdd {
+		t.Errorf("Expected request type: %d\ngot: %d", k8.RequestTypeAdd, req.Type)
+	}
+}
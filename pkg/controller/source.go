@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Source records provenance on the local followers, so they can be traced back to the remote object they came from
+type Source struct {
+	// Optional. Name of the remote cluster, the source annotation is only added if it's set
+	Cluster string `json:"cluster"`
+
+	now func() time.Time
+}
+
+// Service adds the provenance annotations to the local service that's created
+func (s *Source) Service(req *k8.ServiceRequest) error {
+	// Deletes reuse the remote object as the local one, so there's nothing to annotate
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	s.sourceModifier(req.RemoteService.ObjectMeta, &req.LocalService.ObjectMeta)
+	return nil
+}
+
+// Endpoints adds the provenance annotations to the local endpoints that's created
+func (s *Source) Endpoints(req *k8.EndpointsRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	s.sourceModifier(req.RemoteEndpoints.ObjectMeta, &req.LocalEndpoints.ObjectMeta)
+	return nil
+}
+
+func (s *Source) sourceModifier(remoteMeta metav1.ObjectMeta, meta *metav1.ObjectMeta) {
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	if s.Cluster != "" {
+		meta.Annotations[k8.CrossClusterSourceAnnotationKey] = s.Cluster
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	meta.Annotations[k8.CrossClusterRemoteUIDAnnotationKey] = string(remoteMeta.UID)
+	meta.Annotations[k8.CrossClusterRemoteResourceVersionAnnotationKey] = remoteMeta.ResourceVersion
+	meta.Annotations[k8.CrossClusterLastSyncAnnotationKey] = now().UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSourceEndpoints(t *testing.T) {
+	syncTime := time.Date(2018, time.August, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		Cluster  string
+		Expected map[string]string
+	}{
+		// Provenance is always recorded
+		{
+			Expected: map[string]string{
+				k8.CrossClusterRemoteUIDAnnotationKey:             "1234",
+				k8.CrossClusterRemoteResourceVersionAnnotationKey: "9000",
+				k8.CrossClusterLastSyncAnnotationKey:              "2018-08-01T00:00:00Z",
+			},
+		},
+		// The source cluster is only recorded if it's named
+		{
+			Cluster: "remote",
+			Expected: map[string]string{
+				k8.CrossClusterSourceAnnotationKey:                "remote",
+				k8.CrossClusterRemoteUIDAnnotationKey:             "1234",
+				k8.CrossClusterRemoteResourceVersionAnnotationKey: "9000",
+				k8.CrossClusterLastSyncAnnotationKey:              "2018-08-01T00:00:00Z",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		source := &Source{Cluster: testCase.Cluster, now: func() time.Time { return syncTime }}
+		req := &k8.EndpointsRequest{
+			Type: k8.RequestTypeAdd,
+			RemoteEndpoints: &v1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{UID: "1234", ResourceVersion: "9000"},
+			},
+			LocalEndpoints: &v1.Endpoints{},
+		}
+		if err := source.Endpoints(req); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(testCase.Expected, req.LocalEndpoints.ObjectMeta.Annotations) {
+			t.Errorf("Expected annotations: %+v\ngot: %+v", testCase.Expected, req.LocalEndpoints.ObjectMeta.Annotations)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// WebhookFailOpen passes requests through when the webhook can't be reached or answers with garbage
+	WebhookFailOpen WebhookFailurePolicy = "open"
+	// WebhookFailClosed skips requests when the webhook can't be reached or answers with garbage
+	WebhookFailClosed WebhookFailurePolicy = "closed"
+
+	// Responses are small, anything bigger than this is a broken webhook
+	maxWebhookResponse = 1 << 20
+)
+
+var (
+	ErrInvalidFailurePolicy = errors.New("The webhook failure policy must be open or closed.")
+	ErrInvalidWebhookURL    = errors.New("The webhook URL must be https.")
+	ErrWebhookRenamed       = errors.New("Webhooks cannot change the namespace or name of the follower.")
+	ErrWebhookUntracked     = errors.New("Webhooks cannot change the labels and annotations the controller tracks followers with.")
+)
+
+// WebhookFailurePolicy is what happens to requests when the webhook fails
+type WebhookFailurePolicy string
+
+// WebhookRequest is what's posted to the webhook
+type WebhookRequest struct {
+	Type string `json:"type"`
+	Kind string `json:"kind"`
+	// The remote object, and the local object the controller is about to write
+	Remote interface{} `json:"remote"`
+	Local  interface{} `json:"local"`
+}
+
+// WebhookResponse is the webhook's answer. An empty response passes the request through as it is
+type WebhookResponse struct {
+	// Vetoes the request, so nothing is written
+	Denied bool   `json:"denied"`
+	Reason string `json:"reason,omitempty"`
+	// Optional. Replaces the local object that's written
+	Local json.RawMessage `json:"local,omitempty"`
+}
+
+// WebhookConfig is the parameters of the webhook transformer. The timeout is a string like "1s"
+type WebhookConfig struct {
+	// Used in logs, events and metrics
+	Name          string               `json:"name"`
+	URL           string               `json:"url"`
+	Timeout       string               `json:"timeout"`
+	FailurePolicy WebhookFailurePolicy `json:"failurePolicy"`
+	// Optional. PEM file of the CAs that sign the webhook's certificate, if it's not signed by a system CA
+	CAFile string `json:"caFile"`
+}
+
+// Webhook hands requests to an outside service, which can change the local object, veto the request or pass it
+// through
+type Webhook struct {
+	Name          string
+	URL           string
+	FailurePolicy WebhookFailurePolicy
+	Client        *http.Client
+	// Optional. Denials and failures are recorded as events on the local object
+	Recorder record.EventRecorder
+}
+
+// NewWebhook checks the config and builds the webhook's HTTP client
+func NewWebhook(config *WebhookConfig, recorder record.EventRecorder) (*Webhook, error) {
+	if config.FailurePolicy != WebhookFailOpen && config.FailurePolicy != WebhookFailClosed {
+		return nil, ErrInvalidFailurePolicy
+	}
+	parsed, err := url.Parse(config.URL)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, ErrInvalidWebhookURL
+	}
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeout}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", config.CAFile)
+		}
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+	return &Webhook{
+		Name:          config.Name,
+		URL:           config.URL,
+		FailurePolicy: config.FailurePolicy,
+		Client:        client,
+		Recorder:      recorder,
+	}, nil
+}
+
+// Service sends the service request to the webhook. Deletes aren't sent, a webhook can't keep a follower around once
+// its remote service is gone
+func (w *Webhook) Service(req *k8.ServiceRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	response, err := w.call(k8.K8Services, req.Type, req.RemoteService, req.LocalService)
+	if err != nil {
+		return w.fail(req.LocalService, req.LocalService.ObjectMeta, err)
+	}
+	if response.Denied {
+		return w.deny(req.LocalService, req.LocalService.ObjectMeta, response.Reason)
+	}
+	if len(response.Local) == 0 {
+		metrics.Webhooks.Add(metrics.Key(w.Name, "allowed"), 1)
+		return nil
+	}
+	local := &v1.Service{}
+	if err := json.Unmarshal(response.Local, local); err != nil {
+		return w.fail(req.LocalService, req.LocalService.ObjectMeta, err)
+	}
+	if err := checkMutation(local.ObjectMeta, req.LocalService.ObjectMeta); err != nil {
+		return w.fail(req.LocalService, req.LocalService.ObjectMeta, err)
+	}
+	req.LocalService = local
+	metrics.Webhooks.Add(metrics.Key(w.Name, "mutated"), 1)
+	return nil
+}
+
+// Endpoints sends the endpoints request to the webhook. Deletes aren't sent
+func (w *Webhook) Endpoints(req *k8.EndpointsRequest) error {
+	if req.Type == k8.RequestTypeDelete {
+		return nil
+	}
+	response, err := w.call(k8.K8Endpoints, req.Type, req.RemoteEndpoints, req.LocalEndpoints)
+	if err != nil {
+		return w.fail(req.LocalEndpoints, req.LocalEndpoints.ObjectMeta, err)
+	}
+	if response.Denied {
+		return w.deny(req.LocalEndpoints, req.LocalEndpoints.ObjectMeta, response.Reason)
+	}
+	if len(response.Local) == 0 {
+		metrics.Webhooks.Add(metrics.Key(w.Name, "allowed"), 1)
+		return nil
+	}
+	local := &v1.Endpoints{}
+	if err := json.Unmarshal(response.Local, local); err != nil {
+		return w.fail(req.LocalEndpoints, req.LocalEndpoints.ObjectMeta, err)
+	}
+	if err := checkMutation(local.ObjectMeta, req.LocalEndpoints.ObjectMeta); err != nil {
+		return w.fail(req.LocalEndpoints, req.LocalEndpoints.ObjectMeta, err)
+	}
+	req.LocalEndpoints = local
+	metrics.Webhooks.Add(metrics.Key(w.Name, "mutated"), 1)
+	return nil
+}
+
+func (w *Webhook) call(kind string, requestType k8.RequestType, remote, local interface{}) (*WebhookResponse, error) {
+	body, err := json.Marshal(&WebhookRequest{
+		Type:   k8.RequestTypeMap[requestType],
+		Kind:   kind,
+		Remote: remote,
+		Local:  local,
+	})
+	if err != nil {
+		return nil, err
+	}
+	httpResponse, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		io.Copy(ioutil.Discard, io.LimitReader(httpResponse.Body, maxWebhookResponse))
+		err := fmt.Errorf("Webhook %s returned status %d", w.Name, httpResponse.StatusCode)
+		// The webhook itself is having trouble, rather than objecting to the request
+		if httpResponse.StatusCode >= 500 {
+			return nil, Retryable(err)
+		}
+		return nil, err
+	}
+	response := &WebhookResponse{}
+	if err := json.NewDecoder(io.LimitReader(httpResponse.Body, maxWebhookResponse)).Decode(response); err != nil {
+		return nil, fmt.Errorf("Could not decode webhook %s response: %s", w.Name, err.Error())
+	}
+	return response, nil
+}
+
+func (w *Webhook) deny(obj runtime.Object, meta metav1.ObjectMeta, reason string) error {
+	message := fmt.Sprintf("Denied by webhook %s: %s", w.Name, reason)
+	logger.Info(message, zap.String("name", meta.Name), zap.String("namespace", meta.Namespace))
+	metrics.Webhooks.Add(metrics.Key(w.Name, "denied"), 1)
+	if w.Recorder != nil {
+		w.Recorder.Event(obj, v1.EventTypeWarning, "WebhookDenied", message)
+	}
+	return errors.New(message)
+}
+
+// Failures pass the request through if the webhook fails open, and skip it if it fails closed
+func (w *Webhook) fail(obj runtime.Object, meta metav1.ObjectMeta, err error) error {
+	metrics.Webhooks.Add(metrics.Key(w.Name, "error"), 1)
+	if w.FailurePolicy == WebhookFailOpen {
+		logger.Warn("Webhook failed, passing the request through", zap.String("webhook", w.Name),
+			zap.String("name", meta.Name), zap.String("namespace", meta.Namespace), zap.Error(err))
+		return nil
+	}
+	if w.Recorder != nil {
+		w.Recorder.Event(obj, v1.EventTypeWarning, "WebhookFailed", fmt.Sprintf("Webhook %s failed: %s", w.Name, err.Error()))
+	}
+	return ferrors.Error(err)
+}
+
+// The cleaner, the plan and the commands find followers by their namespace and name, the follower label and the
+// controller's annotations, so a webhook that changes them would lose the follower
+func checkMutation(mutated, proposed metav1.ObjectMeta) error {
+	if mutated.Namespace != proposed.Namespace || mutated.Name != proposed.Name {
+		return ErrWebhookRenamed
+	}
+	if !reflect.DeepEqual(trackedMeta(mutated), trackedMeta(proposed)) {
+		return ErrWebhookUntracked
+	}
+	return nil
+}
+
+func trackedMeta(meta metav1.ObjectMeta) map[string]string {
+	tracked := map[string]string{}
+	if value, ok := meta.Labels[k8.CrossClusterServiceLabelKey]; ok {
+		tracked["labels/"+k8.CrossClusterServiceLabelKey] = value
+	}
+	for key, value := range meta.Annotations {
+		if strings.HasPrefix(key, k8.CrossClusterAnnotationPrefix) {
+			tracked["annotations/"+key] = value
+		}
+	}
+	return tracked
+}
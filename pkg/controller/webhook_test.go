@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWebhookService(t *testing.T) {
+	testCases := []struct {
+		// Answers the webhook request, given the proposed local service
+		Handler       func(w http.ResponseWriter, local *v1.Service)
+		FailurePolicy WebhookFailurePolicy
+		Err           bool
+		Expected      map[string]string
+	}{
+		// An empty response passes the request through
+		{
+			Handler: func(w http.ResponseWriter, local *v1.Service) {
+				w.Write([]byte(`{}`))
+			},
+			FailurePolicy: WebhookFailClosed,
+			Expected:      map[string]string{"team": "payments"},
+		},
+		// The webhook can change the local service
+		{
+			Handler: func(w http.ResponseWriter, local *v1.Service) {
+				local.ObjectMeta.Labels["owner"] = "platform"
+				json.NewEncoder(w).Encode(map[string]interface{}{"local": local})
+			},
+			FailurePolicy: WebhookFailClosed,
+			Expected:      map[string]string{"team": "payments", "owner": "platform"},
+		},
+		// The webhook can veto the request
+		{
+			Handler: func(w http.ResponseWriter, local *v1.Service) {
+				w.Write([]byte(`{"denied": true, "reason": "no"}`))
+			},
+			FailurePolicy: WebhookFailOpen,
+			Err:           true,
+		},
+		// The webhook can't rename the follower
+		{
+			Handler: func(w http.ResponseWriter, local *v1.Service) {
+				local.Name = "other"
+				json.NewEncoder(w).Encode(map[string]interface{}{"local": local})
+			},
+			FailurePolicy: WebhookFailClosed,
+			Err:           true,
+		},
+		// Or drop the label the controller finds followers by
+		{
+			Handler: func(w http.ResponseWriter, local *v1.Service) {
+				delete(local.ObjectMeta.Labels, k8.CrossClusterServiceLabelKey)
+				json.NewEncoder(w).Encode(map[string]interface{}{"local": local})
+			},
+			FailurePolicy: WebhookFailClosed,
+			Err:           true,
+		},
+		// Or change the controller's annotations
+		{
+			Handler: func(w http.ResponseWriter, local *v1.Service) {
+				local.ObjectMeta.Annotations[k8.CrossClusterRemoteNameAnnotationKey] = "other"
+				json.NewEncoder(w).Encode(map[string]interface{}{"local": local})
+			},
+			FailurePolicy: WebhookFailClosed,
+			Err:           true,
+		},
+		// Errors pass the request through if the webhook fails open
+		{
+			Handler: func(w http.ResponseWriter, local *v1.Service) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			FailurePolicy: WebhookFailOpen,
+			Expected:      map[string]string{"team": "payments"},
+		},
+		// Errors skip the request if the webhook fails closed
+		{
+			Handler: func(w http.ResponseWriter, local *v1.Service) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			FailurePolicy: WebhookFailClosed,
+			Err:           true,
+		},
+		// Timeouts are errors
+		{
+			Handler: func(w http.ResponseWriter, local *v1.Service) {
+				time.Sleep(200 * time.Millisecond)
+				w.Write([]byte(`{}`))
+			},
+			FailurePolicy: WebhookFailClosed,
+			Err:           true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		handler := testCase.Handler
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			webhookRequest := struct {
+				Type  string     `json:"type"`
+				Kind  string     `json:"kind"`
+				Local v1.Service `json:"local"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&webhookRequest); err != nil {
+				t.Errorf("Could not decode webhook request %v", err)
+			}
+			if webhookRequest.Type != "update" || webhookRequest.Kind != k8.K8Services {
+				t.Errorf("Expected request: update %s\ngot: %s %s", k8.K8Services, webhookRequest.Type, webhookRequest.Kind)
+			}
+			handler(w, &webhookRequest.Local)
+		}))
+		client := server.Client()
+		client.Timeout = 100 * time.Millisecond
+		webhook := &Webhook{Name: "test", URL: server.URL, FailurePolicy: testCase.FailurePolicy, Client: client}
+
+		meta := metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: map[string]string{"team": "payments"}}
+		localMeta := meta.DeepCopy()
+		localMeta.Labels[k8.CrossClusterServiceLabelKey] = k8.CrossClusterServiceLocalLabelValue
+		localMeta.Annotations = map[string]string{k8.CrossClusterRemoteNameAnnotationKey: "foo"}
+		req := &k8.ServiceRequest{
+			Type:          k8.RequestTypeUpdate,
+			RemoteService: &v1.Service{ObjectMeta: meta},
+			LocalService:  &v1.Service{ObjectMeta: *localMeta},
+		}
+		err := webhook.Service(req)
+		server.Close()
+		if (err != nil) != testCase.Err {
+			t.Errorf("Expected error: %t\ngot: %v", testCase.Err, err)
+			continue
+		}
+		labels := req.LocalService.ObjectMeta.Labels
+		if label := labels[k8.CrossClusterServiceLabelKey]; err == nil && label != k8.CrossClusterServiceLocalLabelValue {
+			t.Errorf("Expected the follower label to be kept\ngot: %q", label)
+		}
+		delete(labels, k8.CrossClusterServiceLabelKey)
+		if err == nil && !reflect.DeepEqual(testCase.Expected, labels) {
+			t.Errorf("Expected labels: %+v\ngot: %+v", testCase.Expected, labels)
+		}
+	}
+}
+
+func TestNewWebhook(t *testing.T) {
+	testCases := []struct {
+		Config *WebhookConfig
+		Err    error
+	}{
+		// Webhooks must be called over https
+		{
+			Config: &WebhookConfig{URL: "http://policy.example.com", Timeout: "1s", FailurePolicy: WebhookFailClosed},
+			Err:    ErrInvalidWebhookURL,
+		},
+		// The failure policy must be open or closed
+		{
+			Config: &WebhookConfig{URL: "https://policy.example.com", Timeout: "1s", FailurePolicy: "maybe"},
+			Err:    ErrInvalidFailurePolicy,
+		},
+		// A valid config
+		{
+			Config: &WebhookConfig{URL: "https://policy.example.com", Timeout: "1s", FailurePolicy: WebhookFailOpen},
+		},
+	}
+
+	for _, testCase := range testCases {
+		if _, err := NewWebhook(testCase.Config, nil); err != testCase.Err {
+			t.Errorf("Expected error: %v\ngot: %v", testCase.Err, err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package expiry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/logging"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/state"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// The followers are left as they are
+	PolicyKeep = "keep"
+	// Every address of the endpoints followers is moved to their not ready addresses
+	PolicyNotReady = "not-ready"
+	// The service and endpoints followers are deleted
+	PolicyDelete = "delete"
+
+	defaultCheckInterval = 10 * time.Second
+)
+
+var (
+	logger = logging.Logger
+
+	ErrInvalidPolicy = errors.New("The remote expiry policy must be keep, not-ready or delete.")
+
+	// What happens to the followers under each policy, for the events
+	policyAction = map[string]string{
+		PolicyKeep:     "kept as it is",
+		PolicyNotReady: "marked not ready",
+		PolicyDelete:   "deleted",
+	}
+)
+
+// Expiry checks that the remote cluster can be reached, and applies the policy to the followers once it's been
+// unreachable for long enough. Once it can be reached again, the followers are synced back
+type Expiry struct {
+	LocalClient    kubernetes.Interface
+	RemoteClient   kubernetes.Interface
+	EndpointWriter chan *k8.EndpointsRequest
+	ServiceWriter  chan *k8.ServiceRequest
+	Policy         string
+	// How long the remote cluster has to be unreachable before the policy is applied
+	After time.Duration
+	// How often the remote cluster is checked
+	CheckInterval time.Duration
+	// Only followers in namespaces in the shard are expired. The zero value expires everything
+	Shard k8.Shard
+	// Optional. The transitions are recorded as events on the followers
+	Recorder record.EventRecorder
+	// Optional. Called once the remote cluster can be reached again after the followers expired, and returns once
+	// they've been synced back. It should give up in good time, since checks wait for it. If it fails, the
+	// followers stay expired and it's called again on the next check
+	Recovered func(context.Context) error
+
+	mu               sync.Mutex
+	unreachableSince time.Time
+	// The followers the policy was applied to, so the recovery can be recorded on them. Nil until it's applied
+	expired []runtime.Object
+	paused  bool
+	now     func() time.Time
+}
+
+func New(localClient, remoteClient kubernetes.Interface, endpointWriter chan *k8.EndpointsRequest, serviceWriter chan *k8.ServiceRequest, policy string, after time.Duration) (*Expiry, error) {
+	if err := ValidatePolicy(policy); err != nil {
+		return nil, err
+	}
+	return &Expiry{
+		LocalClient:    localClient,
+		RemoteClient:   remoteClient,
+		EndpointWriter: endpointWriter,
+		ServiceWriter:  serviceWriter,
+		Policy:         policy,
+		After:          after,
+		CheckInterval:  defaultCheckInterval,
+		now:            time.Now,
+	}, nil
+}
+
+// ValidatePolicy checks that the policy is one of keep, not-ready or delete
+func ValidatePolicy(policy string) error {
+	if _, ok := policyAction[policy]; !ok {
+		return ErrInvalidPolicy
+	}
+	return nil
+}
+
+// Paused reports whether remote events should be held back. Once the followers are marked not ready or deleted, an
+// event replayed from a stale watch cache would undo it, and everything is synced on recovery anyway
+func (e *Expiry) Paused() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.paused
+}
+
+// Run checks the remote cluster every interval until the context is done
+func (e *Expiry) Run(ctx context.Context) {
+	logger.Info("Starting remote expiry", zap.String("policy", e.Policy), zap.Duration("after", e.After))
+	metrics.RemoteReachable.Set(1)
+	ticker := time.NewTicker(e.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.check(ctx)
+		}
+	}
+}
+
+func (e *Expiry) check(ctx context.Context) {
+	err := e.ping()
+	if err == nil {
+		e.reachable(ctx)
+		return
+	}
+	now := e.now()
+	e.mu.Lock()
+	if e.unreachableSince.IsZero() {
+		e.unreachableSince = now
+		logger.Warn("Remote cluster is unreachable", zap.Error(err), zap.Duration("expiresAfter", e.After))
+		metrics.RemoteReachable.Set(0)
+		metrics.RemoteTransitions.Add("unreachable", 1)
+	}
+	since := e.unreachableSince
+	expire := e.expired == nil && now.Sub(since) >= e.After
+	e.mu.Unlock()
+	if expire {
+		e.expire(ctx, since)
+	}
+}
+
+// Lists a single export, which is enough to know the remote API server is up and the controller can still read it
+func (e *Expiry) ping() error {
+	opts := &metav1.ListOptions{}
+	k8.RemoteFilter(opts)
+	opts.Limit = 1
+	_, err := e.RemoteClient.CoreV1().Services(metav1.NamespaceAll).List(*opts)
+	return err
+}
+
+func (e *Expiry) reachable(ctx context.Context) {
+	e.mu.Lock()
+	since, expired, paused := e.unreachableSince, e.expired, e.paused
+	e.unreachableSince, e.paused = time.Time{}, false
+	e.mu.Unlock()
+	if !since.IsZero() {
+		logger.Info("Remote cluster is reachable again", zap.Duration("unreachableFor", e.now().Sub(since)))
+		metrics.RemoteReachable.Set(1)
+		metrics.RemoteTransitions.Add("reachable", 1)
+	}
+	if expired == nil {
+		return
+	}
+
+	// Remote events flow again while the followers are synced back, so none are missed in between
+	logger.Info("Syncing expired followers back", zap.Int("followers", len(expired)))
+	if e.Recovered != nil {
+		if err := e.Recovered(ctx); err != nil {
+			logger.Error("Could not sync expired followers back, trying again on the next check", zap.Error(err))
+			e.mu.Lock()
+			e.paused = paused
+			e.mu.Unlock()
+			return
+		}
+	}
+	e.mu.Lock()
+	e.expired = nil
+	e.mu.Unlock()
+	for _, follower := range expired {
+		e.record(follower, v1.EventTypeNormal, "RemoteRecovered", "Remote cluster is reachable again, follower was synced back")
+	}
+	metrics.RemoteTransitions.Add("recovered", 1)
+}
+
+// Applies the policy to every follower in the shard, once per outage. If the followers can't be listed, it's tried
+// again on the next check
+func (e *Expiry) expire(ctx context.Context, since time.Time) {
+	logger.Warn("Remote cluster has been unreachable too long, expiring followers", zap.String("policy", e.Policy),
+		zap.Time("since", since))
+	message := fmt.Sprintf("Remote cluster unreachable since %s, follower %s", since.UTC().Format(time.RFC3339),
+		policyAction[e.Policy])
+	expired := []runtime.Object{}
+
+	endpoints, err := e.LocalClient.CoreV1().Endpoints(metav1.NamespaceAll).List(k8.LocalFilter)
+	if err != nil {
+		ferrors.Error(err)
+		return
+	}
+	services, err := e.LocalClient.CoreV1().Services(metav1.NamespaceAll).List(k8.LocalFilter)
+	if err != nil {
+		ferrors.Error(err)
+		return
+	}
+	// Paused before the requests are sent, so a remote event can't undo them in between
+	if e.Policy != PolicyKeep {
+		e.setPaused(true)
+	}
+	for i := range endpoints.Items {
+		follower := &endpoints.Items[i]
+		if namespace, _ := k8.RemoteLocation(follower.ObjectMeta); !e.Shard.Contains(namespace) {
+			continue
+		}
+		if !e.expireEndpoints(ctx, follower) {
+			// Nothing is recorded as expired, so nothing would unpause it
+			e.setPaused(false)
+			return
+		}
+		expired = append(expired, follower)
+	}
+	for i := range services.Items {
+		follower := &services.Items[i]
+		if namespace, _ := k8.RemoteLocation(follower.ObjectMeta); !e.Shard.Contains(namespace) {
+			continue
+		}
+		if !e.expireService(ctx, follower) {
+			e.setPaused(false)
+			return
+		}
+		expired = append(expired, follower)
+	}
+	for _, follower := range expired {
+		e.record(follower, v1.EventTypeWarning, "RemoteUnreachable", message)
+	}
+	metrics.RemoteTransitions.Add("expired", 1)
+	metrics.ExpiredFollowers.Add(e.Policy, int64(len(expired)))
+	e.mu.Lock()
+	e.expired = expired
+	e.mu.Unlock()
+}
+
+func (e *Expiry) setPaused(paused bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.paused = paused
+}
+
+// Sends the request the policy needs for the endpoints, and returns false if the context was done first
+func (e *Expiry) expireEndpoints(ctx context.Context, follower *v1.Endpoints) bool {
+	var req *k8.EndpointsRequest
+	switch e.Policy {
+	case PolicyNotReady:
+		req = &k8.EndpointsRequest{Type: k8.RequestTypeUpdate, LocalEndpoints: NotReady(follower)}
+	case PolicyDelete:
+		req = &k8.EndpointsRequest{Type: k8.RequestTypeDelete, LocalEndpoints: follower}
+	default:
+		return true
+	}
+	// The remote endpoints are still there, so their finalizer is left alone
+	req.KeepFinalizer = true
+	req.NoRetry = true
+	state.Default.Enqueue(k8.K8Endpoints, k8.RequestTypeMap[req.Type], follower.ObjectMeta.Namespace, follower.Name)
+	select {
+	case e.EndpointWriter <- req:
+		return true
+	case <-ctx.Done():
+		state.Default.Dequeue(k8.K8Endpoints, follower.ObjectMeta.Namespace, follower.Name)
+		return false
+	}
+}
+
+// Sends the request the policy needs for the service, and returns false if the context was done first. Only the
+// delete policy touches services
+func (e *Expiry) expireService(ctx context.Context, follower *v1.Service) bool {
+	if e.Policy != PolicyDelete {
+		return true
+	}
+	// The remote service is still there, so its finalizer stays until the follower is really gone
+	req := &k8.ServiceRequest{Type: k8.RequestTypeDelete, LocalService: follower, KeepFinalizer: true, NoRetry: true}
+	state.Default.Enqueue(k8.K8Services, k8.RequestTypeMap[req.Type], follower.ObjectMeta.Namespace, follower.Name)
+	select {
+	case e.ServiceWriter <- req:
+		return true
+	case <-ctx.Done():
+		state.Default.Dequeue(k8.K8Services, follower.ObjectMeta.Namespace, follower.Name)
+		return false
+	}
+}
+
+// NotReady moves every ready address of the endpoints to the not ready addresses
+func NotReady(endpoints *v1.Endpoints) *v1.Endpoints {
+	endpoints = endpoints.DeepCopy()
+	for i := range endpoints.Subsets {
+		subset := &endpoints.Subsets[i]
+		subset.NotReadyAddresses = append(subset.NotReadyAddresses, subset.Addresses...)
+		subset.Addresses = nil
+	}
+	return endpoints
+}
+
+func (e *Expiry) record(follower runtime.Object, eventType, reason, message string) {
+	if e.Recorder == nil {
+		return
+	}
+	e.Recorder.Event(follower, eventType, reason, message)
+}
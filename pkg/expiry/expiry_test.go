@@ -0,0 +1,153 @@
+package expiry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8testing "k8s.io/client-go/testing"
+)
+
+func TestExpiry(t *testing.T) {
+	testCases := []struct {
+		Policy string
+		// The type of the request sent for the endpoints follower, or -1 for none
+		EndpointsRequest k8.RequestType
+		ServiceRequests  int
+		Paused           bool
+	}{
+		// The followers are left alone, but the outage is still reported and synced back
+		{Policy: PolicyKeep, EndpointsRequest: -1, ServiceRequests: 0, Paused: false},
+		// Only the endpoints are updated, with every address not ready
+		{Policy: PolicyNotReady, EndpointsRequest: k8.RequestTypeUpdate, ServiceRequests: 0, Paused: true},
+		// Both followers are deleted
+		{Policy: PolicyDelete, EndpointsRequest: k8.RequestTypeDelete, ServiceRequests: 1, Paused: true},
+	}
+
+	for _, testCase := range testCases {
+		follower := map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceLocalLabelValue}
+		localClient := fake.NewSimpleClientset(
+			&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: follower}},
+			&v1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: follower},
+				Subsets:    []v1.EndpointSubset{{Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}}}},
+			},
+		)
+		unreachable := true
+		remoteClient := fake.NewSimpleClientset()
+		remoteClient.PrependReactor("list", "services", func(k8testing.Action) (bool, runtime.Object, error) {
+			if unreachable {
+				return true, nil, errors.New("unreachable")
+			}
+			return false, nil, nil
+		})
+		endpointsWriter := make(chan *k8.EndpointsRequest, 2)
+		serviceWriter := make(chan *k8.ServiceRequest, 2)
+		expiry, err := New(localClient, remoteClient, endpointsWriter, serviceWriter, testCase.Policy, time.Minute)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		now := time.Now()
+		expiry.now = func() time.Time { return now }
+		// The first sync back fails
+		recoveries := 0
+		expiry.Recovered = func(context.Context) error {
+			recoveries++
+			if recoveries == 1 {
+				return errors.New("oh no")
+			}
+			return nil
+		}
+
+		// Nothing happens until the remote cluster has been unreachable for long enough
+		expiry.check(context.Background())
+		if len(endpointsWriter) != 0 || len(serviceWriter) != 0 {
+			t.Errorf("Expected no requests for %s before the expiry period", testCase.Policy)
+		}
+		now = now.Add(2 * time.Minute)
+		expiry.check(context.Background())
+		// The policy is only applied once per outage
+		expiry.check(context.Background())
+
+		if testCase.EndpointsRequest < 0 {
+			if len(endpointsWriter) != 0 {
+				t.Errorf("Expected no endpoints requests for %s\ngot: %d", testCase.Policy, len(endpointsWriter))
+			}
+		} else if len(endpointsWriter) != 1 {
+			t.Errorf("Expected 1 endpoints request for %s\ngot: %d", testCase.Policy, len(endpointsWriter))
+		} else {
+			req := <-endpointsWriter
+			if req.Type != testCase.EndpointsRequest {
+				t.Errorf("Expected endpoints request type for %s: %s\ngot: %s", testCase.Policy,
+					k8.RequestTypeMap[testCase.EndpointsRequest], k8.RequestTypeMap[req.Type])
+			}
+			if req.Type == k8.RequestTypeUpdate {
+				subset := req.LocalEndpoints.Subsets[0]
+				if len(subset.Addresses) != 0 || len(subset.NotReadyAddresses) != 1 {
+					t.Errorf("Expected every address to be not ready\ngot: %+v", subset)
+				}
+			}
+		}
+		if len(serviceWriter) != testCase.ServiceRequests {
+			t.Errorf("Expected %d service requests for %s\ngot: %d", testCase.ServiceRequests, testCase.Policy,
+				len(serviceWriter))
+		} else if testCase.ServiceRequests > 0 {
+			// The remote service is still there, so the finalizer isn't removed, and a retry could come after the
+			// recovery
+			if req := <-serviceWriter; !req.KeepFinalizer || !req.NoRetry {
+				t.Errorf("Expected the service delete to keep the finalizer and not be retried")
+			}
+		}
+		if paused := expiry.Paused(); paused != testCase.Paused {
+			t.Errorf("Expected paused for %s: %v\ngot: %v", testCase.Policy, testCase.Paused, paused)
+		}
+
+		// Once the remote cluster is back, the followers are synced and remote events flow again. Until the sync
+		// succeeds, the followers stay expired and it's tried again on every check
+		unreachable = false
+		expiry.check(context.Background())
+		if paused := expiry.Paused(); paused != testCase.Paused {
+			t.Errorf("Expected paused for %s after a failed sync: %v\ngot: %v", testCase.Policy, testCase.Paused, paused)
+		}
+		expiry.check(context.Background())
+		expiry.check(context.Background())
+		if recoveries != 2 {
+			t.Errorf("Expected the followers to be synced back for %s after 2 attempts\ngot: %d", testCase.Policy, recoveries)
+		}
+		if expiry.Paused() {
+			t.Errorf("Expected remote events not to be paused after recovery for %s", testCase.Policy)
+		}
+	}
+
+	if _, err := New(nil, nil, nil, nil, "drop", time.Minute); err != ErrInvalidPolicy {
+		t.Errorf("Expected error: %v\ngot: %v", ErrInvalidPolicy, err)
+	}
+}
+
+func TestExpiryCancelled(t *testing.T) {
+	follower := map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceLocalLabelValue}
+	localClient := fake.NewSimpleClientset(
+		&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: follower}},
+	)
+	// Nothing picks up the requests
+	expiry, err := New(localClient, fake.NewSimpleClientset(), make(chan *k8.EndpointsRequest), make(chan *k8.ServiceRequest),
+		PolicyDelete, time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A context that's done before every request is sent leaves nothing expired, so remote events aren't held back
+	expiry.expire(ctx, time.Now())
+	if expiry.Paused() {
+		t.Errorf("Expected remote events not to be paused after a cancelled expiry")
+	}
+}
@@ -0,0 +1,267 @@
+package k8
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// CrossClusterAppliedAnnotationKey records the labels and annotations the controller last applied to a follower,
+	// so it only ever changes or removes those
+	CrossClusterAppliedAnnotationKey = "fair.com/cross-cluster-applied"
+)
+
+// The labels and annotations the controller last applied to a follower
+type appliedMeta struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Server side apply needs the apply patch type and field managers, which the client-go and API server versions this
+// is built against don't have. Until they're bumped, followers are merge patched with the fields the controller owns
+// instead, and what it owns is tracked in the applied annotation. The controller owns the spec fields it copies over,
+// and the labels and annotations it has applied before. Anything else on the follower is left alone, so other tools
+// can annotate it.
+// The patch is worked out against the current follower, which is read from the API server if it isn't given. A
+// stale follower from the watch cache fails the patch with a conflict, and the caller retries with a fresh read
+func applyService(client kubernetes.Interface, current, desired *v1.Service) error {
+	if current == nil {
+		var err error
+		current, err = client.CoreV1().Services(desired.ObjectMeta.Namespace).Get(desired.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	metadata, conflicts, err := metaPatch(current.ObjectMeta, desired.ObjectMeta)
+	if err != nil {
+		return err
+	}
+	reportConflicts(K8Services, desired.ObjectMeta, conflicts)
+	spec := map[string]interface{}{"ports": desired.Spec.Ports}
+	// Left for the API server to default if it's not set
+	if desired.Spec.SessionAffinity != "" {
+		spec["sessionAffinity"] = desired.Spec.SessionAffinity
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": metadata, "spec": spec})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Services(desired.ObjectMeta.Namespace).Patch(desired.Name, types.MergePatchType, patch)
+	return err
+}
+
+func applyEndpoints(client kubernetes.Interface, current, desired *v1.Endpoints) error {
+	if current == nil {
+		var err error
+		current, err = client.CoreV1().Endpoints(desired.ObjectMeta.Namespace).Get(desired.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	metadata, conflicts, err := metaPatch(current.ObjectMeta, desired.ObjectMeta)
+	if err != nil {
+		return err
+	}
+	reportConflicts(K8Endpoints, desired.ObjectMeta, conflicts)
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": metadata,
+		"subsets":  desired.Subsets,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Endpoints(desired.ObjectMeta.Namespace).Patch(desired.Name, types.MergePatchType, patch)
+	return err
+}
+
+// Checks if applying the desired service would change anything about the current one. Only the fields the
+// controller owns are compared, and the last sync time and remote resource version are ignored
+func serviceUpToDate(current, desired *v1.Service) (bool, error) {
+	if len(current.Spec.Ports)+len(desired.Spec.Ports) > 0 && !sameJSON(current.Spec.Ports, desired.Spec.Ports) {
+		return false, nil
+	}
+	if desired.Spec.SessionAffinity != "" && desired.Spec.SessionAffinity != current.Spec.SessionAffinity {
+		return false, nil
+	}
+	return metaUpToDate(current.ObjectMeta, desired.ObjectMeta)
+}
+
+func endpointsUpToDate(current, desired *v1.Endpoints) (bool, error) {
+	if len(current.Subsets)+len(desired.Subsets) > 0 && !sameJSON(current.Subsets, desired.Subsets) {
+		return false, nil
+	}
+	return metaUpToDate(current.ObjectMeta, desired.ObjectMeta)
+}
+
+// The remote resource version changes with every change to the remote object, including the ones that aren't
+// propagated, so like the last sync time it's ignored
+func metaUpToDate(current, desired metav1.ObjectMeta) (bool, error) {
+	desired = *desired.DeepCopy()
+	for _, key := range []string{CrossClusterLastSyncAnnotationKey, CrossClusterRemoteResourceVersionAnnotationKey} {
+		if value, ok := current.Annotations[key]; ok {
+			if _, ok := desired.Annotations[key]; ok {
+				desired.Annotations[key] = value
+			}
+		}
+	}
+	metadata, _, err := metaPatch(current, desired)
+	if err != nil {
+		return false, err
+	}
+	labels := metadata["labels"].(map[string]interface{})
+	annotations := metadata["annotations"].(map[string]interface{})
+	// The patch always rewrites the applied annotation, so it's up to date if that's all it does and the
+	// annotation comes out the same
+	return len(labels) == 0 && len(annotations) == 1 &&
+		annotations[CrossClusterAppliedAnnotationKey] == current.Annotations[CrossClusterAppliedAnnotationKey], nil
+}
+
+// Compares the fields as they'd be sent to the API server, so nested fields that are nil on one side and empty on
+// the other are the same
+func sameJSON(a, b interface{}) bool {
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aJSON, bJSON)
+}
+
+// Records every label and annotation of a new follower as applied by the controller
+func setApplied(meta *metav1.ObjectMeta) error {
+	applied, err := json.Marshal(&appliedMeta{Labels: meta.Labels, Annotations: withoutApplied(meta.Annotations)})
+	if err != nil {
+		return err
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[CrossClusterAppliedAnnotationKey] = string(applied)
+	return nil
+}
+
+// Works out the metadata part of the patch, and the fields that someone else changed since the controller last
+// applied them. The resource version is included, so the patch fails with a conflict if the follower changes in
+// the meantime
+func metaPatch(current, desired metav1.ObjectMeta) (map[string]interface{}, []FieldChange, error) {
+	applied := lastApplied(current)
+	labels, labelsApplied, labelConflicts := mapPatch("labels", current.Labels, desired.Labels, applied.Labels)
+	annotations, annotationsApplied, annotationConflicts := mapPatch("annotations", withoutApplied(current.Annotations),
+		withoutApplied(desired.Annotations), applied.Annotations)
+
+	record, err := json.Marshal(&appliedMeta{Labels: labelsApplied, Annotations: annotationsApplied})
+	if err != nil {
+		return nil, nil, err
+	}
+	annotations[CrossClusterAppliedAnnotationKey] = string(record)
+	metadata := map[string]interface{}{
+		"resourceVersion": current.ResourceVersion,
+		"labels":          labels,
+		"annotations":     annotations,
+	}
+	return metadata, append(labelConflicts, annotationConflicts...), nil
+}
+
+// Followers written before the controller kept track of what it applied had all their labels replaced on every
+// write, and only the controller writes its own annotations, so those are what it owns
+func lastApplied(current metav1.ObjectMeta) *appliedMeta {
+	applied := &appliedMeta{}
+	if record, ok := current.Annotations[CrossClusterAppliedAnnotationKey]; ok {
+		if err := json.Unmarshal([]byte(record), applied); err == nil {
+			return applied
+		}
+	}
+	applied.Labels = current.Labels
+	applied.Annotations = map[string]string{}
+	for key, value := range current.Annotations {
+		if strings.HasPrefix(key, CrossClusterAnnotationPrefix) {
+			applied.Annotations[key] = value
+		}
+	}
+	return applied
+}
+
+// Keys the controller applied before are owned, and so are keys nothing else has set. Keys something else set, or
+// owned keys something else changed since, are left alone and reported as conflicts if the controller wants them to
+// be different. The follower label and the controller's annotations are the exception, they're always set back since
+// followers are tracked by them. Owned keys the controller no longer wants are removed, unless something else has
+// changed them since
+func mapPatch(field string, current, desired, applied map[string]string) (map[string]interface{}, map[string]string, []FieldChange) {
+	patch := map[string]interface{}{}
+	nowApplied := map[string]string{}
+	conflicts := []FieldChange{}
+	for key, value := range desired {
+		currentValue, exists := current[key]
+		appliedValue, owned := applied[key]
+		switch {
+		case owned:
+			if exists && currentValue != appliedValue && currentValue != value {
+				conflicts = append(conflicts, FieldChange{Field: fmt.Sprintf("%s[%s]", field, key), Old: currentValue, New: value})
+				if !controllerKey(field, key) {
+					continue
+				}
+			}
+		case !exists:
+		case currentValue == value:
+			continue
+		default:
+			conflicts = append(conflicts, FieldChange{Field: fmt.Sprintf("%s[%s]", field, key), Old: currentValue, New: value})
+			continue
+		}
+		nowApplied[key] = value
+		if !exists || currentValue != value {
+			patch[key] = value
+		}
+	}
+	for key, appliedValue := range applied {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		if currentValue, exists := current[key]; exists && currentValue == appliedValue {
+			// A null removes the key in a merge patch
+			patch[key] = nil
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Field < conflicts[j].Field })
+	return patch, nowApplied, conflicts
+}
+
+func controllerKey(field, key string) bool {
+	if field == "labels" {
+		return key == CrossClusterServiceLabelKey
+	}
+	return strings.HasPrefix(key, CrossClusterAnnotationPrefix)
+}
+
+func withoutApplied(annotations map[string]string) map[string]string {
+	filtered := map[string]string{}
+	for key, value := range annotations {
+		if key != CrossClusterAppliedAnnotationKey {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+func reportConflicts(kind string, meta metav1.ObjectMeta, conflicts []FieldChange) {
+	if len(conflicts) == 0 {
+		return
+	}
+	metrics.FieldConflicts.Add(kind, int64(len(conflicts)))
+	logger.Warn("Follower fields were changed by another writer", zap.String("kind", kind), zap.String("name", meta.Name),
+		zap.String("namespace", meta.Namespace), zap.Any("fields", conflicts))
+}
@@ -0,0 +1,249 @@
+package k8
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMetaPatch(t *testing.T) {
+	testCases := []struct {
+		Current           metav1.ObjectMeta
+		Desired           metav1.ObjectMeta
+		ExpectedLabels    map[string]interface{}
+		ExpectedApplied   string
+		ExpectedConflicts []FieldChange
+	}{
+		// Followers from before the applied annotation own all their labels, so stale ones are removed
+		{
+			Current: metav1.ObjectMeta{
+				ResourceVersion: "1",
+				Labels:          map[string]string{"foo": "bar", "gone": "soon"},
+			},
+			Desired: metav1.ObjectMeta{
+				Labels: map[string]string{"foo": "baz"},
+			},
+			ExpectedLabels:    map[string]interface{}{"foo": "baz", "gone": nil},
+			ExpectedApplied:   `{"labels":{"foo":"baz"}}`,
+			ExpectedConflicts: []FieldChange{},
+		},
+		// Labels someone else added are left alone, even once the controller stops setting its own labels
+		{
+			Current: metav1.ObjectMeta{
+				ResourceVersion: "1",
+				Labels:          map[string]string{"foo": "bar", "team": "infra"},
+				Annotations:     map[string]string{CrossClusterAppliedAnnotationKey: `{"labels":{"foo":"bar"}}`},
+			},
+			Desired: metav1.ObjectMeta{
+				Labels: map[string]string{},
+			},
+			ExpectedLabels:    map[string]interface{}{"foo": nil},
+			ExpectedApplied:   `{}`,
+			ExpectedConflicts: []FieldChange{},
+		},
+		// Labels someone else set aren't taken over, and owned labels someone else changed are left as they are
+		{
+			Current: metav1.ObjectMeta{
+				ResourceVersion: "1",
+				Labels:          map[string]string{"foo": "changed", "team": "infra"},
+				Annotations:     map[string]string{CrossClusterAppliedAnnotationKey: `{"labels":{"foo":"bar"}}`},
+			},
+			Desired: metav1.ObjectMeta{
+				Labels: map[string]string{"foo": "bar", "team": "web"},
+			},
+			ExpectedLabels:  map[string]interface{}{},
+			ExpectedApplied: `{}`,
+			ExpectedConflicts: []FieldChange{
+				FieldChange{Field: "labels[foo]", Old: "changed", New: "bar"},
+				FieldChange{Field: "labels[team]", Old: "infra", New: "web"},
+			},
+		},
+		// Except for the follower label, which followers are tracked by
+		{
+			Current: metav1.ObjectMeta{
+				ResourceVersion: "1",
+				Labels:          map[string]string{CrossClusterServiceLabelKey: "changed"},
+				Annotations: map[string]string{
+					CrossClusterAppliedAnnotationKey: `{"labels":{"fair.com/cross-cluster":"follower"}}`,
+				},
+			},
+			Desired: metav1.ObjectMeta{
+				Labels: map[string]string{CrossClusterServiceLabelKey: "follower"},
+			},
+			ExpectedLabels:  map[string]interface{}{CrossClusterServiceLabelKey: "follower"},
+			ExpectedApplied: `{"labels":{"fair.com/cross-cluster":"follower"}}`,
+			ExpectedConflicts: []FieldChange{
+				FieldChange{Field: "labels[fair.com/cross-cluster]", Old: "changed", New: "follower"},
+			},
+		},
+		// Owned labels someone else changed aren't removed
+		{
+			Current: metav1.ObjectMeta{
+				ResourceVersion: "1",
+				Labels:          map[string]string{"foo": "changed"},
+				Annotations:     map[string]string{CrossClusterAppliedAnnotationKey: `{"labels":{"foo":"bar"}}`},
+			},
+			Desired:           metav1.ObjectMeta{},
+			ExpectedLabels:    map[string]interface{}{},
+			ExpectedApplied:   `{}`,
+			ExpectedConflicts: []FieldChange{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		metadata, conflicts, err := metaPatch(testCase.Current, testCase.Desired)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if metadata["resourceVersion"] != testCase.Current.ResourceVersion {
+			t.Errorf("Expected resource version: %s\ngot: %v", testCase.Current.ResourceVersion, metadata["resourceVersion"])
+		}
+		if !reflect.DeepEqual(testCase.ExpectedLabels, metadata["labels"]) {
+			t.Errorf("Expected labels: %+v\ngot: %+v", testCase.ExpectedLabels, metadata["labels"])
+		}
+		annotations := metadata["annotations"].(map[string]interface{})
+		if annotations[CrossClusterAppliedAnnotationKey] != testCase.ExpectedApplied {
+			t.Errorf("Expected applied: %s\ngot: %v", testCase.ExpectedApplied, annotations[CrossClusterAppliedAnnotationKey])
+		}
+		if !reflect.DeepEqual(testCase.ExpectedConflicts, conflicts) {
+			t.Errorf("Expected conflicts: %+v\ngot: %+v", testCase.ExpectedConflicts, conflicts)
+		}
+	}
+}
+
+func TestServiceUpToDate(t *testing.T) {
+	applied := `{"labels":{"foo":"bar"},"annotations":{"fair.com/cross-cluster-last-sync":"2018-01-01T00:00:00Z"}}`
+	ports := []v1.ServicePort{v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}
+	current := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{"foo": "bar", "team": "infra"},
+			Annotations: map[string]string{
+				CrossClusterLastSyncAnnotationKey: "2018-01-01T00:00:00Z",
+				CrossClusterAppliedAnnotationKey:  applied,
+			},
+		},
+		Spec: v1.ServiceSpec{Ports: ports},
+	}
+	testCases := []struct {
+		Desired  *v1.Service
+		Expected bool
+	}{
+		// Only the last sync time changed, and labels someone else set are ignored
+		{
+			Desired: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      map[string]string{"foo": "bar"},
+					Annotations: map[string]string{CrossClusterLastSyncAnnotationKey: "2018-01-01T00:00:30Z"},
+				},
+				Spec: v1.ServiceSpec{Ports: ports},
+			},
+			Expected: true,
+		},
+		// A label changed
+		{
+			Desired: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      map[string]string{"foo": "baz"},
+					Annotations: map[string]string{CrossClusterLastSyncAnnotationKey: "2018-01-01T00:00:30Z"},
+				},
+				Spec: v1.ServiceSpec{Ports: ports},
+			},
+			Expected: false,
+		},
+		// A port changed
+		{
+			Desired: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      map[string]string{"foo": "bar"},
+					Annotations: map[string]string{CrossClusterLastSyncAnnotationKey: "2018-01-01T00:00:30Z"},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{v1.ServicePort{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}}},
+			},
+			Expected: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		upToDate, err := serviceUpToDate(current, testCase.Desired)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if upToDate != testCase.Expected {
+			t.Errorf("Expected up to date: %t\ngot: %t", testCase.Expected, upToDate)
+		}
+	}
+
+	// A new remote resource version on its own doesn't need a write
+	versioned := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				CrossClusterRemoteResourceVersionAnnotationKey: "1",
+				CrossClusterAppliedAnnotationKey:               `{"annotations":{"fair.com/cross-cluster-remote-resource-version":"1"}}`,
+			},
+		},
+		Spec: v1.ServiceSpec{Ports: ports},
+	}
+	desired := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{CrossClusterRemoteResourceVersionAnnotationKey: "2"},
+		},
+		Spec: v1.ServiceSpec{Ports: ports},
+	}
+	upToDate, err := serviceUpToDate(versioned, desired)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !upToDate {
+		t.Errorf("Expected a service whose remote resource version changed to be up to date")
+	}
+}
+
+func TestEndpointsUpToDate(t *testing.T) {
+	current := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{CrossClusterAppliedAnnotationKey: `{}`},
+		},
+		Subsets: []v1.EndpointSubset{
+			v1.EndpointSubset{Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}}},
+		},
+	}
+	testCases := []struct {
+		Desired  *v1.Endpoints
+		Expected bool
+	}{
+		// Empty and missing lists are the same
+		{
+			Desired: &v1.Endpoints{
+				Subsets: []v1.EndpointSubset{
+					v1.EndpointSubset{
+						Addresses:         []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}},
+						NotReadyAddresses: []v1.EndpointAddress{},
+					},
+				},
+			},
+			Expected: true,
+		},
+		// An address changed
+		{
+			Desired: &v1.Endpoints{
+				Subsets: []v1.EndpointSubset{
+					v1.EndpointSubset{Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.2"}}},
+				},
+			},
+			Expected: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		upToDate, err := endpointsUpToDate(current, testCase.Desired)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if upToDate != testCase.Expected {
+			t.Errorf("Expected up to date: %t\ngot: %t", testCase.Expected, upToDate)
+		}
+	}
+}
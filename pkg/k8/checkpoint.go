@@ -0,0 +1,328 @@
+package k8
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	goerrors "errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Configmaps are limited to 1MB, which leaves room for the metadata
+const maxCheckpointSize = 1000 * 1000
+
+var (
+	ErrCheckpointLost     = goerrors.New("The sync checkpoint was saved by another leader.")
+	ErrCheckpointTooLarge = goerrors.New("The sync checkpoint is too large for a configmap.")
+)
+
+// CheckpointEntry is the last successful sync of a single follower
+type CheckpointEntry struct {
+	RemoteNamespace string `json:"remoteNamespace"`
+	RemoteName      string `json:"remoteName"`
+	// Resource version of the remote object the follower was synced from
+	ResourceVersion string `json:"resourceVersion"`
+	// Hash of the follower as it was written, see ContentHash
+	Hash string `json:"hash"`
+}
+
+// Checkpoint keeps the last successful sync of every follower in a local configmap, so a new leader can skip the
+// followers that are already up to date, and find the remote objects that were deleted while nobody was leading.
+// Syncs are recorded in memory, and saved by Run. Saves are made against the configmap version that was loaded or
+// last saved, so once another leader has saved it, this one never overwrites it again
+type Checkpoint struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Name      string
+
+	mu      sync.Mutex
+	entries map[string]*CheckpointEntry
+	dirty   bool
+	// Whether the configmap exists, and its resource version as it was loaded or last saved. Only known once
+	// loaded, a checkpoint that couldn't be loaded replaces whatever's saved
+	exists          bool
+	resourceVersion string
+	loaded          bool
+	// Set once another leader has saved the configmap
+	lost bool
+	// Whether the saved checkpoint was emptied because it got too large
+	cleared bool
+}
+
+func NewCheckpoint(clientset kubernetes.Interface, namespace, name string) *Checkpoint {
+	return &Checkpoint{
+		Client:    clientset,
+		Namespace: namespace,
+		Name:      name,
+		entries:   map[string]*CheckpointEntry{},
+	}
+}
+
+// Configmap keys can't have slashes. Namespaces and names can't have dots, so they're used to join the parts instead
+func checkpointKey(kind, namespace, name string) string {
+	return metrics.Key(kind, namespace, name)
+}
+
+// ContentHash hashes a follower, leaving out what changes on every sync without the follower itself changing
+func ContentHash(meta metav1.ObjectMeta, obj interface{}) (string, error) {
+	meta = *meta.DeepCopy()
+	meta.ResourceVersion = ""
+	delete(meta.Annotations, CrossClusterLastSyncAnnotationKey)
+	content, err := json.Marshal([]interface{}{meta, obj})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// ServiceHash is the content hash of a service follower
+func ServiceHash(svc *v1.Service) (string, error) {
+	return ContentHash(svc.ObjectMeta, svc.Spec)
+}
+
+// EndpointsHash is the content hash of an endpoints follower
+func EndpointsHash(endpoints *v1.Endpoints) (string, error) {
+	return ContentHash(endpoints.ObjectMeta, endpoints.Subsets)
+}
+
+// Load reads the saved checkpoint, replacing what's in memory. A checkpoint that was never saved is empty
+func (c *Checkpoint) Load() error {
+	configMap, err := c.Client.CoreV1().ConfigMaps(c.Namespace).Get(c.Name, metav1.GetOptions{})
+	if err != nil && !ResourceNotExist(err) {
+		return err
+	}
+	entries := map[string]*CheckpointEntry{}
+	resourceVersion := ""
+	if err == nil {
+		resourceVersion = configMap.ObjectMeta.ResourceVersion
+		for key, value := range configMap.Data {
+			entry := &CheckpointEntry{}
+			if err := json.Unmarshal([]byte(value), entry); err != nil {
+				logger.Warn("Skipping invalid checkpoint entry", zap.String("key", key), zap.Error(err))
+				continue
+			}
+			entries[key] = entry
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = entries
+	c.dirty = false
+	c.exists = err == nil
+	c.resourceVersion = resourceVersion
+	c.loaded = true
+	c.lost = false
+	metrics.CheckpointEntries.Set(int64(len(entries)))
+	logger.Info("Loaded sync checkpoint", zap.String("name", c.Name), zap.Int("entries", len(entries)))
+	return nil
+}
+
+// Record marks the follower as synced from the remote resource version, with the content hash it was written with
+func (c *Checkpoint) Record(kind string, local metav1.ObjectMeta, resourceVersion, hash string) {
+	remoteNamespace, remoteName := RemoteLocation(local)
+	entry := &CheckpointEntry{
+		RemoteNamespace: remoteNamespace,
+		RemoteName:      remoteName,
+		ResourceVersion: resourceVersion,
+		Hash:            hash,
+	}
+	key := checkpointKey(kind, local.Namespace, local.Name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if current, ok := c.entries[key]; ok && *current == *entry {
+		return
+	}
+	c.entries[key] = entry
+	c.dirty = true
+	metrics.CheckpointEntries.Set(int64(len(c.entries)))
+}
+
+// Forget drops a follower that was deleted
+func (c *Checkpoint) Forget(kind string, local metav1.ObjectMeta) {
+	key := checkpointKey(kind, local.Namespace, local.Name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		return
+	}
+	delete(c.entries, key)
+	c.dirty = true
+	metrics.CheckpointEntries.Set(int64(len(c.entries)))
+}
+
+// Synced checks if the follower was last synced from the same remote resource version with the same content
+func (c *Checkpoint) Synced(kind string, local metav1.ObjectMeta, resourceVersion, hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[checkpointKey(kind, local.Namespace, local.Name)]
+	return ok && entry.ResourceVersion == resourceVersion && entry.Hash == hash
+}
+
+// Followers returns the metadata of every recorded follower of the kind, sorted by key. The metadata points back at
+// the remote object with the same annotations the follower has, so it can be passed to RemoteLocation
+func (c *Checkpoint) Followers(kind string) []metav1.ObjectMeta {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := []string{}
+	for key := range c.entries {
+		if strings.HasPrefix(key, kind+".") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	followers := []metav1.ObjectMeta{}
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, kind+"."), ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		entry := c.entries[key]
+		followers = append(followers, metav1.ObjectMeta{
+			Namespace: parts[0],
+			Name:      parts[1],
+			Annotations: map[string]string{
+				CrossClusterRemoteNamespaceAnnotationKey: entry.RemoteNamespace,
+				CrossClusterRemoteNameAnnotationKey:      entry.RemoteName,
+			},
+		})
+	}
+	return followers
+}
+
+// Save writes the checkpoint to the configmap if anything changed since it was loaded or last saved. It returns
+// ErrCheckpointLost once another leader has saved it. A checkpoint too large for a configmap is saved empty instead,
+// so the next leader syncs everything rather than trusting an old one, and ErrCheckpointTooLarge is returned
+func (c *Checkpoint) Save() error {
+	c.mu.Lock()
+	if c.lost {
+		c.mu.Unlock()
+		return ErrCheckpointLost
+	}
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	data := map[string]string{}
+	size := 0
+	for key, entry := range c.entries {
+		value, err := json.Marshal(entry)
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		data[key] = string(value)
+		size += len(key) + len(value)
+	}
+	c.dirty = false
+	cleared := c.cleared
+	c.mu.Unlock()
+
+	tooLarge := size > maxCheckpointSize
+	if tooLarge {
+		if cleared {
+			metrics.CheckpointSaves.Add("too_large", 1)
+			return ErrCheckpointTooLarge
+		}
+		data = map[string]string{}
+	}
+	err := c.write(data)
+	result := metrics.Result(err)
+	switch {
+	case err == ErrCheckpointLost:
+		result = "lost"
+	case err == nil && tooLarge:
+		result = "too_large"
+	}
+	metrics.CheckpointSaves.Add(result, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == ErrCheckpointLost {
+		c.lost = true
+		return err
+	}
+	if err != nil {
+		// Whatever was recorded in the meantime is saved along with it next time
+		c.dirty = true
+		return err
+	}
+	c.cleared = tooLarge
+	if tooLarge {
+		return ErrCheckpointTooLarge
+	}
+	return nil
+}
+
+func (c *Checkpoint) write(data map[string]string) error {
+	configMaps := c.Client.CoreV1().ConfigMaps(c.Namespace)
+	c.mu.Lock()
+	exists, resourceVersion, loaded := c.exists, c.resourceVersion, c.loaded
+	c.mu.Unlock()
+	if !loaded {
+		current, err := configMaps.Get(c.Name, metav1.GetOptions{})
+		if err != nil && !ResourceNotExist(err) {
+			return err
+		}
+		if err == nil {
+			exists, resourceVersion = true, current.ObjectMeta.ResourceVersion
+		}
+	}
+
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: c.Name, Namespace: c.Namespace, ResourceVersion: resourceVersion},
+		Data:       data,
+	}
+	var err error
+	if !exists {
+		configMap, err = configMaps.Create(configMap)
+	} else {
+		configMap, err = configMaps.Update(configMap)
+	}
+	// Someone else created or saved the configmap since this leader read it, which only the next leader does
+	if errors.IsAlreadyExists(err) || errors.IsConflict(err) {
+		return ErrCheckpointLost
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.exists = true
+	c.resourceVersion = configMap.ObjectMeta.ResourceVersion
+	c.loaded = true
+	c.mu.Unlock()
+	return nil
+}
+
+// Run saves the checkpoint every interval until the context is done, or another leader has saved it. Callers save
+// it one last time once the writers have drained, as long as they're still the leader
+func (c *Checkpoint) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := c.Save()
+			if err == ErrCheckpointLost {
+				logger.Error("Another leader saved the sync checkpoint, no longer saving it", zap.String("name", c.Name))
+				return
+			}
+			if err != nil {
+				logger.Error("Could not save sync checkpoint", zap.Error(err))
+			}
+		}
+	}
+}
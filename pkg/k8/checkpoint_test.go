@@ -0,0 +1,152 @@
+package k8
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckpoint(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	checkpoint := NewCheckpoint(client, "fair-system", "checkpoint")
+	moved := metav1.ObjectMeta{Name: "foo", Namespace: "local", Annotations: map[string]string{
+		CrossClusterRemoteNamespaceAnnotationKey: "bar",
+		CrossClusterRemoteNameAnnotationKey:      "remote-foo",
+	}}
+	checkpoint.Record(K8Services, moved, "1", "hash")
+	checkpoint.Record(K8Services, metav1.ObjectMeta{Name: "baz", Namespace: "bar"}, "2", "hash")
+	checkpoint.Record(K8Endpoints, metav1.ObjectMeta{Name: "baz", Namespace: "bar"}, "3", "hash")
+	checkpoint.Forget(K8Endpoints, metav1.ObjectMeta{Name: "baz", Namespace: "bar"})
+	if err := checkpoint.Save(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	loaded := NewCheckpoint(client, "fair-system", "checkpoint")
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	testCases := []struct {
+		Meta            metav1.ObjectMeta
+		ResourceVersion string
+		Hash            string
+		Expected        bool
+	}{
+		// Same remote version and content
+		{Meta: moved, ResourceVersion: "1", Hash: "hash", Expected: true},
+		// The remote object changed
+		{Meta: moved, ResourceVersion: "4", Hash: "hash", Expected: false},
+		// The follower would come out different, like after a pipeline config change
+		{Meta: moved, ResourceVersion: "1", Hash: "other", Expected: false},
+		// Never synced
+		{Meta: metav1.ObjectMeta{Name: "qux", Namespace: "bar"}, ResourceVersion: "1", Hash: "hash", Expected: false},
+	}
+	for _, testCase := range testCases {
+		synced := loaded.Synced(K8Services, testCase.Meta, testCase.ResourceVersion, testCase.Hash)
+		if synced != testCase.Expected {
+			t.Errorf("Expected synced for %s/%s at %s: %v\ngot: %v", testCase.Meta.Namespace, testCase.Meta.Name,
+				testCase.ResourceVersion, testCase.Expected, synced)
+		}
+	}
+
+	// The followers point back at their remote objects, and deleted ones are gone
+	expected := []string{"bar/baz", "bar/remote-foo"}
+	remotes := []string{}
+	for _, meta := range loaded.Followers(K8Services) {
+		namespace, name := RemoteLocation(meta)
+		remotes = append(remotes, namespace+"/"+name)
+	}
+	if !reflect.DeepEqual(expected, remotes) {
+		t.Errorf("Expected remote objects: %v\ngot: %v", expected, remotes)
+	}
+	if followers := loaded.Followers(K8Endpoints); len(followers) != 0 {
+		t.Errorf("Expected no endpoints followers\ngot: %v", followers)
+	}
+
+	// A checkpoint that was never saved is empty
+	empty := NewCheckpoint(client, "fair-system", "missing")
+	if err := empty.Load(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if followers := empty.Followers(K8Services); len(followers) != 0 {
+		t.Errorf("Expected no followers\ngot: %v", followers)
+	}
+}
+
+func TestCheckpointLost(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	previous := NewCheckpoint(client, "fair-system", "checkpoint")
+	next := NewCheckpoint(client, "fair-system", "checkpoint")
+	for _, checkpoint := range []*Checkpoint{previous, next} {
+		if err := checkpoint.Load(); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	next.Record(K8Services, metav1.ObjectMeta{Name: "foo", Namespace: "bar"}, "2", "hash")
+	if err := next.Save(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// The previous leader's save would overwrite the next leader's, so it's given up on for good
+	previous.Record(K8Services, metav1.ObjectMeta{Name: "foo", Namespace: "bar"}, "1", "hash")
+	for i := 0; i < 2; i++ {
+		if err := previous.Save(); err != ErrCheckpointLost {
+			t.Errorf("Expected error: %v\ngot: %v", ErrCheckpointLost, err)
+		}
+	}
+	loaded := NewCheckpoint(client, "fair-system", "checkpoint")
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !loaded.Synced(K8Services, metav1.ObjectMeta{Name: "foo", Namespace: "bar"}, "2", "hash") {
+		t.Errorf("Expected the next leader's checkpoint to be kept")
+	}
+}
+
+func TestCheckpointTooLarge(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	checkpoint := NewCheckpoint(client, "fair-system", "checkpoint")
+	checkpoint.Record(K8Services, metav1.ObjectMeta{Name: "foo", Namespace: "bar"}, "1", strings.Repeat("a", maxCheckpointSize))
+	if err := checkpoint.Save(); err != ErrCheckpointTooLarge {
+		t.Errorf("Expected error: %v\ngot: %v", ErrCheckpointTooLarge, err)
+	}
+
+	// It's saved empty, so the next leader syncs everything
+	loaded := NewCheckpoint(client, "fair-system", "checkpoint")
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if followers := loaded.Followers(K8Services); len(followers) != 0 {
+		t.Errorf("Expected no followers\ngot: %v", followers)
+	}
+}
+
+func TestServiceHash(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", ResourceVersion: "1", Annotations: map[string]string{
+			CrossClusterLastSyncAnnotationKey: "2018-01-01T00:00:00Z",
+		}},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
+	}
+	hash, err := ServiceHash(svc)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// The last sync time and resource version change without the follower changing
+	resynced := svc.DeepCopy()
+	resynced.ObjectMeta.ResourceVersion = "2"
+	resynced.ObjectMeta.Annotations[CrossClusterLastSyncAnnotationKey] = "2018-01-02T00:00:00Z"
+	if resyncedHash, _ := ServiceHash(resynced); resyncedHash != hash {
+		t.Errorf("Expected hash: %s\ngot: %s", hash, resyncedHash)
+	}
+
+	changed := svc.DeepCopy()
+	changed.Spec.Ports[0].Port = 8080
+	if changedHash, _ := ServiceHash(changed); changedHash == hash {
+		t.Errorf("Expected the hash to change with the ports\ngot: %s", changedHash)
+	}
+}
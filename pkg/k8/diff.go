@@ -0,0 +1,186 @@
+package k8
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Change is a write that would be made to a local follower
+type Change struct {
+	Action    string        `json:"action"`
+	Kind      string        `json:"kind"`
+	Namespace string        `json:"namespace"`
+	Name      string        `json:"name"`
+	Fields    []FieldChange `json:"fields,omitempty"`
+}
+
+// FieldChange is a single field that differs between the current and desired follower. An empty old
+// value means the field is being added, and an empty new value means it's being removed
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// Noop is true if the change is an update that doesn't change anything
+func (c *Change) Noop() bool {
+	return c.Action == RequestTypeMap[RequestTypeUpdate] && len(c.Fields) == 0
+}
+
+func (c *Change) String() string {
+	lines := []string{fmt.Sprintf("%s %s %s/%s", c.Action, c.Kind, c.Namespace, c.Name)}
+	for _, field := range c.Fields {
+		lines = append(lines, fmt.Sprintf("  %s: %q -> %q", field.Field, field.Old, field.New))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PlanService works out the change a service request would make to the local cluster, without writing it
+func PlanService(client kubernetes.Interface, requestType RequestType, svc *v1.Service) (*Change, error) {
+	change := &Change{
+		Action:    RequestTypeMap[requestType],
+		Kind:      K8Services,
+		Namespace: svc.ObjectMeta.Namespace,
+		Name:      svc.Name,
+	}
+	if requestType == RequestTypeDelete {
+		return change, nil
+	}
+	current, err := client.CoreV1().Services(svc.ObjectMeta.Namespace).Get(svc.Name, metav1.GetOptions{})
+	if err != nil {
+		if !ResourceNotExist(err) {
+			return nil, err
+		}
+		change.Action = RequestTypeMap[RequestTypeAdd]
+		current = &v1.Service{}
+	} else {
+		change.Action = RequestTypeMap[RequestTypeUpdate]
+	}
+	change.Fields = DiffServices(current, svc)
+	return change, nil
+}
+
+// PlanEndpoints works out the change an endpoints request would make to the local cluster, without writing it
+func PlanEndpoints(client kubernetes.Interface, requestType RequestType, endpoints *v1.Endpoints) (*Change, error) {
+	change := &Change{
+		Action:    RequestTypeMap[requestType],
+		Kind:      K8Endpoints,
+		Namespace: endpoints.ObjectMeta.Namespace,
+		Name:      endpoints.Name,
+	}
+	if requestType == RequestTypeDelete {
+		return change, nil
+	}
+	current, err := client.CoreV1().Endpoints(endpoints.ObjectMeta.Namespace).Get(endpoints.Name, metav1.GetOptions{})
+	if err != nil {
+		if !ResourceNotExist(err) {
+			return nil, err
+		}
+		change.Action = RequestTypeMap[RequestTypeAdd]
+		current = &v1.Endpoints{}
+	} else {
+		change.Action = RequestTypeMap[RequestTypeUpdate]
+	}
+	change.Fields = DiffEndpoints(current, endpoints)
+	return change, nil
+}
+
+// DiffServices compares the labels and ports of two services
+func DiffServices(current, desired *v1.Service) []FieldChange {
+	changes := diffMaps("labels", current.ObjectMeta.Labels, desired.ObjectMeta.Labels)
+	return append(changes, diffMaps("ports", servicePorts(current), servicePorts(desired))...)
+}
+
+// DiffEndpoints compares the labels and subsets of two endpoints
+func DiffEndpoints(current, desired *v1.Endpoints) []FieldChange {
+	changes := diffMaps("labels", current.ObjectMeta.Labels, desired.ObjectMeta.Labels)
+	return append(changes, diffSets("subsets", subsetAddresses(current), subsetAddresses(desired))...)
+}
+
+// Ports are keyed by name, since that's how the service and endpoints ports are matched up
+func servicePorts(svc *v1.Service) map[string]string {
+	ports := map[string]string{}
+	for _, port := range svc.Spec.Ports {
+		ports[port.Name] = fmt.Sprintf("%d/%s->%s", port.Port, port.Protocol, port.TargetPort.String())
+	}
+	return ports
+}
+
+// Flattens the subsets into one entry per address and port, since the grouping of subsets isn't meaningful
+func subsetAddresses(endpoints *v1.Endpoints) map[string]bool {
+	addresses := map[string]bool{}
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			for _, entry := range addressPorts(address.IP, subset.Ports) {
+				addresses[entry] = true
+			}
+		}
+		for _, address := range subset.NotReadyAddresses {
+			for _, entry := range addressPorts(address.IP, subset.Ports) {
+				addresses[entry+" (not ready)"] = true
+			}
+		}
+	}
+	return addresses
+}
+
+func addressPorts(ip string, ports []v1.EndpointPort) []string {
+	if len(ports) == 0 {
+		return []string{ip}
+	}
+	entries := []string{}
+	for _, port := range ports {
+		entries = append(entries, fmt.Sprintf("%s:%d/%s", ip, port.Port, port.Protocol))
+	}
+	return entries
+}
+
+func diffMaps(field string, current, desired map[string]string) []FieldChange {
+	keys := map[string]bool{}
+	for key := range current {
+		keys[key] = true
+	}
+	for key := range desired {
+		keys[key] = true
+	}
+	changes := []FieldChange{}
+	for _, key := range sortedKeys(keys) {
+		if current[key] != desired[key] {
+			changes = append(changes, FieldChange{
+				Field: fmt.Sprintf("%s[%s]", field, key),
+				Old:   current[key],
+				New:   desired[key],
+			})
+		}
+	}
+	return changes
+}
+
+func diffSets(field string, current, desired map[string]bool) []FieldChange {
+	changes := []FieldChange{}
+	for _, entry := range sortedKeys(current) {
+		if !desired[entry] {
+			changes = append(changes, FieldChange{Field: field, Old: entry})
+		}
+	}
+	for _, entry := range sortedKeys(desired) {
+		if !current[entry] {
+			changes = append(changes, FieldChange{Field: field, New: entry})
+		}
+	}
+	return changes
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
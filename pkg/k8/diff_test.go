@@ -0,0 +1,137 @@
+package k8
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDiffServices(t *testing.T) {
+	testCases := []struct {
+		Current  *v1.Service
+		Desired  *v1.Service
+		Expected []FieldChange
+	}{
+		// Identical services have no changes
+		{
+			Current: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"foo": "bar"}},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
+					},
+				},
+			},
+			Desired: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"foo": "bar"}},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
+					},
+				},
+			},
+			Expected: []FieldChange{},
+		},
+		// Changed, added, and removed labels and ports all show up
+		{
+			Current: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"foo": "bar", "gone": "soon"}},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
+						v1.ServicePort{Name: "metrics", Port: 9090, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(9090)},
+					},
+				},
+			},
+			Desired: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"foo": "baz", "new": "label"}},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8081)},
+					},
+				},
+			},
+			Expected: []FieldChange{
+				FieldChange{Field: "labels[foo]", Old: "bar", New: "baz"},
+				FieldChange{Field: "labels[gone]", Old: "soon"},
+				FieldChange{Field: "labels[new]", New: "label"},
+				FieldChange{Field: "ports[http]", Old: "80/TCP->8080", New: "80/TCP->8081"},
+				FieldChange{Field: "ports[metrics]", Old: "9090/TCP->9090"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		changes := DiffServices(testCase.Current, testCase.Desired)
+		if !reflect.DeepEqual(testCase.Expected, changes) {
+			t.Errorf("Expected changes: %+v\ngot: %+v", testCase.Expected, changes)
+		}
+	}
+}
+
+func TestDiffEndpoints(t *testing.T) {
+	ports := []v1.EndpointPort{
+		v1.EndpointPort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+	}
+	testCases := []struct {
+		Current  *v1.Endpoints
+		Desired  *v1.Endpoints
+		Expected []FieldChange
+	}{
+		// Regrouping the same addresses into different subsets isn't a change
+		{
+			Current: &v1.Endpoints{
+				Subsets: []v1.EndpointSubset{
+					v1.EndpointSubset{
+						Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}, v1.EndpointAddress{IP: "10.0.0.2"}},
+						Ports:     ports,
+					},
+				},
+			},
+			Desired: &v1.Endpoints{
+				Subsets: []v1.EndpointSubset{
+					v1.EndpointSubset{Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.2"}}, Ports: ports},
+					v1.EndpointSubset{Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}}, Ports: ports},
+				},
+			},
+			Expected: []FieldChange{},
+		},
+		// Removed addresses show up as old values and added addresses as new values
+		{
+			Current: &v1.Endpoints{
+				Subsets: []v1.EndpointSubset{
+					v1.EndpointSubset{
+						Addresses:         []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}},
+						NotReadyAddresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.2"}},
+						Ports:             ports,
+					},
+				},
+			},
+			Desired: &v1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"foo": "bar"}},
+				Subsets: []v1.EndpointSubset{
+					v1.EndpointSubset{
+						Addresses: []v1.EndpointAddress{v1.EndpointAddress{IP: "10.0.0.1"}, v1.EndpointAddress{IP: "10.0.0.2"}},
+						Ports:     ports,
+					},
+				},
+			},
+			Expected: []FieldChange{
+				FieldChange{Field: "labels[foo]", New: "bar"},
+				FieldChange{Field: "subsets", Old: "10.0.0.2:80/TCP (not ready)"},
+				FieldChange{Field: "subsets", New: "10.0.0.2:80/TCP"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		changes := DiffEndpoints(testCase.Current, testCase.Desired)
+		if !reflect.DeepEqual(testCase.Expected, changes) {
+			t.Errorf("Expected changes: %+v\ngot: %+v", testCase.Expected, changes)
+		}
+	}
+}
@@ -2,29 +2,64 @@ package k8
 
 import (
 	"context"
+	"time"
 
 	"go.uber.org/zap"
 
 	"k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/cenkalti/backoff"
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/retry"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/state"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type EndpointsReader struct {
 	Events chan *EndpointsRequest
+	// Only objects in namespaces in the shard are sent on. The zero value sends everything
+	Shard Shard
+	// Optional. Events are dropped while it returns true, like while the followers are expired
+	Paused func() bool
+	// The informer's handlers don't take a context, so the reader holds on to it to stop sending once it's done
+	ctx context.Context
 }
 
 type EndpointsWriter struct {
 	Events chan *EndpointsRequest
 	Client kubernetes.Interface
+	// Optional. If set, the outcome of every write is sent along so it can be recorded on the remote service
+	Status chan *StatusRequest
+	// If set, the changes are logged instead of written
+	DryRun bool
+	// How long queued and in flight requests get to finish once the writer is stopped
+	DrainTimeout time.Duration
+	// Optional. Once closed, queued and in flight requests are dropped without waiting for the drain timeout, like
+	// when leadership is lost
+	Abort <-chan struct{}
+	// Optional. Low priority requests, like the initial sync's and the cleaner's. They're only written once nothing on
+	// Events is waiting
+	Bulk chan *EndpointsRequest
+	// Optional. If set, failed writes are retried with growing delays until they're dead lettered
+	Retries *retry.Tracker
+	// Optional. Local followers, as watched by WatchLocalEndpoints. Updates that wouldn't change the cached follower
+	// are skipped
+	Cache cache.Store
+	// Optional. If set, successful writes are recorded so the next leader can skip followers that are up to date
+	Checkpoint *Checkpoint
+	// Optional. If set, remote endpoints get a finalizer once their follower is written, which is removed once the
+	// follower is deleted
+	Finalizers *FinalizerWriter
 }
 
-func NewEndpointsReader(events chan *EndpointsRequest) *EndpointsReader {
+func NewEndpointsReader(ctx context.Context, events chan *EndpointsRequest) *EndpointsReader {
 	return &EndpointsReader{
 		Events: events,
+		ctx:    ctx,
 	}
 }
 
@@ -42,13 +77,26 @@ func (e *EndpointsReader) Delete(obj interface{}) {
 
 func (e *EndpointsReader) sendRequest(obj interface{}, requestType RequestType) {
 	endpoints := obj.(*v1.Endpoints)
+	if !e.Shard.Contains(endpoints.ObjectMeta.Namespace) || (e.Paused != nil && e.Paused()) {
+		return
+	}
+	// Remote endpoints that are only waiting on finalizers are as good as deleted
+	if Terminating(endpoints.ObjectMeta) {
+		requestType = RequestTypeDelete
+	}
 	logger.Info("Sending endpoints request", zap.String("requestType", RequestTypeMap[requestType]),
 		zap.String("name", endpoints.Name), zap.String("namespace", endpoints.ObjectMeta.Namespace))
 	req := &EndpointsRequest{
 		Type:            requestType,
 		RemoteEndpoints: endpoints,
 	}
-	e.Events <- req
+	state.Default.RecordExport(K8Endpoints, RequestTypeMap[requestType], endpoints.ObjectMeta.Namespace, endpoints.Name,
+		endpoints.ObjectMeta.ResourceVersion, requestType == RequestTypeDelete)
+	metrics.RemoteEvents.Add(metrics.Key(K8Endpoints, RequestTypeMap[requestType]), 1)
+	select {
+	case e.Events <- req:
+	case <-e.ctx.Done():
+	}
 }
 
 func NewEndpointsWriter(clientset kubernetes.Interface, events chan *EndpointsRequest) *EndpointsWriter {
@@ -58,23 +106,45 @@ func NewEndpointsWriter(clientset kubernetes.Interface, events chan *EndpointsRe
 	}
 }
 
-func (e *EndpointsWriter) add(endpoints *v1.Endpoints) {
-	logger.Info("Creating endpoints", zap.String("name", endpoints.Name),
-		zap.String("namespace", endpoints.ObjectMeta.Namespace))
-	e.create(endpoints)
+// Returns whether the write was skipped because the follower is already up to date
+func (e *EndpointsWriter) add(ctx context.Context, endpoints *v1.Endpoints) (bool, error) {
+	// Followers that already exist are updated instead, which skips the write if nothing changed. Every export is
+	// an add when a leader starts, and most of them will already have followers
+	if e.cached(endpoints) {
+		return e.update(ctx, endpoints)
+	}
+	return false, e.create(ctx, endpoints)
 }
 
-func (e *EndpointsWriter) update(endpoints *v1.Endpoints) {
+// Returns whether the write was skipped because the follower is already up to date
+func (e *EndpointsWriter) update(ctx context.Context, endpoints *v1.Endpoints) (bool, error) {
+	if e.UpToDate(endpoints) {
+		metrics.Updates.Add(metrics.Key(K8Endpoints, "skipped"), 1)
+		return true, nil
+	}
+	metrics.Updates.Add(metrics.Key(K8Endpoints, "applied"), 1)
+	// The create has its own backoff, so its result is kept separately from the update's
+	var createErr error
+	current := e.current(endpoints)
 	update := func() error {
 		logger.Info("Updating endpoints", zap.String("name", endpoints.Name),
 			zap.String("namespace", endpoints.ObjectMeta.Namespace))
-		_, err := e.Client.CoreV1().Endpoints(endpoints.ObjectMeta.Namespace).Update(endpoints)
+		err := applyEndpoints(e.Client, current, endpoints)
 		if err != nil {
+			// Anything that went wrong may have been down to the cached follower, so the retry reads it
+			current = nil
 			// If the endpoint doesn't exist, attempt to create it
 			if ResourceNotExist(err) {
-				e.create(endpoints)
+				createErr = e.create(ctx, endpoints)
 				return nil
 			}
+			// The endpoints changed between reading and patching them, so the patch is worked out again
+			if errors.IsConflict(err) {
+				logger.Warn("Endpoints changed while they were being updated, retrying", zap.String("name", endpoints.Name),
+					zap.String("namespace", endpoints.ObjectMeta.Namespace))
+				metrics.WriteConflicts.Add(K8Endpoints, 1)
+				return err
+			}
 			if PermanentError(err) {
 				return backoff.Permanent(err)
 			}
@@ -82,10 +152,48 @@ func (e *EndpointsWriter) update(endpoints *v1.Endpoints) {
 		}
 		return nil
 	}
-	exponentialBackOff(context.Background(), update)
+	if err := exponentialBackOff(ctx, update); err != nil {
+		return false, err
+	}
+	return false, createErr
+}
+
+func (e *EndpointsWriter) cached(endpoints *v1.Endpoints) bool {
+	return e.current(endpoints) != nil
+}
+
+// The follower as the watch cache has it, or nil if it's not cached
+func (e *EndpointsWriter) current(endpoints *v1.Endpoints) *v1.Endpoints {
+	if e.Cache == nil {
+		return nil
+	}
+	obj, exists, err := e.Cache.Get(endpoints)
+	if err != nil || !exists {
+		return nil
+	}
+	return obj.(*v1.Endpoints)
+}
+
+// UpToDate checks if the follower in the watch cache already matches the desired one. It's false if the follower
+// isn't cached
+func (e *EndpointsWriter) UpToDate(endpoints *v1.Endpoints) bool {
+	current := e.current(endpoints)
+	if current == nil {
+		return false
+	}
+	upToDate, err := endpointsUpToDate(current, endpoints)
+	if err != nil {
+		ferrors.Error(err)
+		return false
+	}
+	return upToDate
 }
 
-func (e *EndpointsWriter) create(endpoints *v1.Endpoints) {
+func (e *EndpointsWriter) create(ctx context.Context, endpoints *v1.Endpoints) error {
+	endpoints = endpoints.DeepCopy()
+	if err := setApplied(&endpoints.ObjectMeta); err != nil {
+		return err
+	}
 	create := func() error {
 		logger.Info("Creating endpoints", zap.String("name", endpoints.Name),
 			zap.String("namespace", endpoints.ObjectMeta.Namespace))
@@ -102,10 +210,10 @@ func (e *EndpointsWriter) create(endpoints *v1.Endpoints) {
 		}
 		return nil
 	}
-	exponentialBackOff(context.Background(), create)
+	return exponentialBackOff(ctx, create)
 }
 
-func (e *EndpointsWriter) delete(endpoints *v1.Endpoints) {
+func (e *EndpointsWriter) delete(ctx context.Context, endpoints *v1.Endpoints) error {
 	delete := func() error {
 		logger.Info("Deleting endpoints", zap.String("name", endpoints.Name),
 			zap.String("namespace", endpoints.ObjectMeta.Namespace))
@@ -119,19 +227,228 @@ func (e *EndpointsWriter) delete(endpoints *v1.Endpoints) {
 		}
 		return nil
 	}
-	exponentialBackOff(context.Background(), delete)
+	return exponentialBackOff(ctx, delete)
 }
 
-func (e *EndpointsWriter) Run() {
+// Run writes requests until the context is done, picking the one with the highest priority out of those waiting.
+// Requests that are in flight or already queued by then are given the drain timeout to finish before their retries
+// are cut off
+func (e *EndpointsWriter) Run(ctx context.Context) {
+	writeCtx, cancel := drainContext(ctx, e.Abort, e.DrainTimeout)
+	defer cancel()
+	queue := &writeQueue{}
 	for {
-		request := <-e.Events
-		switch request.Type {
-		case RequestTypeAdd:
-			e.add(request.LocalEndpoints)
-		case RequestTypeUpdate:
-			e.update(request.LocalEndpoints)
-		case RequestTypeDelete:
-			e.delete(request.LocalEndpoints)
+		e.fill(queue)
+		if queue.Len() == 0 {
+			select {
+			case <-ctx.Done():
+				e.drain(writeCtx, queue)
+				return
+			case request := <-e.Events:
+				e.enqueue(queue, request, false)
+			case request := <-e.Bulk:
+				e.enqueue(queue, request, true)
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			e.drain(writeCtx, queue)
+			return
+		default:
+		}
+		request := queue.next().(*EndpointsRequest)
+		state.Default.Dequeue(K8Endpoints, request.LocalEndpoints.ObjectMeta.Namespace, request.LocalEndpoints.Name)
+		e.Write(writeCtx, request)
+	}
+}
+
+// Queues a request. A request it replaces for the same follower is never written, so it's taken off the state
+// tracker's queue and reported as done
+func (e *EndpointsWriter) enqueue(queue *writeQueue, request *EndpointsRequest, bulk bool) {
+	dropped := queue.add(writeKey(request.LocalEndpoints.ObjectMeta), request, requestPriority(request.Type, bulk))
+	if dropped == nil {
+		return
+	}
+	replaced := dropped.(*EndpointsRequest)
+	state.Default.Dequeue(K8Endpoints, replaced.LocalEndpoints.ObjectMeta.Namespace, replaced.LocalEndpoints.Name)
+	if replaced.Done != nil {
+		replaced.Done(nil)
+	}
+}
+
+// Pulls the requests that are waiting on the channels into the queue, up to its limit
+func (e *EndpointsWriter) fill(queue *writeQueue) {
+	for queue.Len() < maxQueuedWrites {
+		select {
+		case request := <-e.Events:
+			e.enqueue(queue, request, false)
+		case request := <-e.Bulk:
+			e.enqueue(queue, request, true)
+		default:
+			return
 		}
 	}
 }
+
+func (e *EndpointsWriter) drain(ctx context.Context, queue *writeQueue) {
+	for {
+		e.fill(queue)
+		if queue.Len() == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			logger.Info("Drain timeout reached, dropping queued requests", zap.String("kind", K8Endpoints))
+			return
+		default:
+		}
+		request := queue.next().(*EndpointsRequest)
+		state.Default.Dequeue(K8Endpoints, request.LocalEndpoints.ObjectMeta.Namespace, request.LocalEndpoints.Name)
+		e.Write(ctx, request)
+	}
+}
+
+// Write makes a single request against the local cluster, and returns once it's done. Retries stop when the
+// context is done. It's only called by Run, or by commands that don't run the writer, since writes to the same
+// follower mustn't overlap
+func (e *EndpointsWriter) Write(ctx context.Context, request *EndpointsRequest) error {
+	err := e.write(ctx, request)
+	if request.Done != nil {
+		request.Done(err)
+	}
+	return err
+}
+
+func (e *EndpointsWriter) write(ctx context.Context, request *EndpointsRequest) error {
+	if e.DryRun {
+		return e.plan(request)
+	}
+	var err error
+	var skipped bool
+	switch request.Type {
+	case RequestTypeAdd:
+		skipped, err = e.add(ctx, request.LocalEndpoints)
+	case RequestTypeUpdate:
+		skipped, err = e.update(ctx, request.LocalEndpoints)
+	case RequestTypeDelete:
+		err = e.delete(ctx, request.LocalEndpoints)
+	}
+	e.reportStatus(request, err)
+	e.reportFinalizer(request, err)
+	e.recordCheckpoint(request, err)
+	e.trackRetry(ctx, request, err)
+	state.Default.RecordWrite(K8Endpoints, RequestTypeMap[request.Type], request.LocalEndpoints.ObjectMeta.Namespace,
+		request.LocalEndpoints.Name, request.Type == RequestTypeDelete, err)
+	result := metrics.Result(err)
+	if skipped {
+		result = "skipped"
+	}
+	metrics.Writes.Add(metrics.Key(K8Endpoints, RequestTypeMap[request.Type], result), 1)
+	return err
+}
+
+func (e *EndpointsWriter) plan(request *EndpointsRequest) error {
+	change, err := PlanEndpoints(e.Client, request.Type, request.LocalEndpoints)
+	if err != nil {
+		return ferrors.Error(err)
+	}
+	logger.Info("Dry run, skipping endpoints write", zap.String("action", change.Action),
+		zap.String("name", change.Name), zap.String("namespace", change.Namespace), zap.Any("fields", change.Fields))
+	return nil
+}
+
+func (e *EndpointsWriter) reportStatus(request *EndpointsRequest, err error) {
+	if e.Status == nil {
+		return
+	}
+	// The status is written to the remote service, which can be somewhere else if the follower was moved
+	namespace, name := RemoteLocation(request.LocalEndpoints.ObjectMeta)
+	sendStatus(e.Status, &StatusRequest{
+		Type:      request.Type,
+		Kind:      K8Endpoints,
+		Namespace: namespace,
+		Name:      name,
+		Endpoints: CountAddresses(request.LocalEndpoints),
+		Err:       err,
+	})
+}
+
+func (e *EndpointsWriter) reportFinalizer(request *EndpointsRequest, err error) {
+	if e.Finalizers == nil || request.KeepFinalizer {
+		return
+	}
+	// A follower that's already gone counts as deleted
+	if err != nil && !(request.Type == RequestTypeDelete && ResourceNotExist(err)) {
+		return
+	}
+	// The finalizer is on the remote endpoints, which can be somewhere else if the follower was moved
+	namespace, name := RemoteLocation(request.LocalEndpoints.ObjectMeta)
+	var remote *metav1.ObjectMeta
+	if request.RemoteEndpoints != nil {
+		remote = &request.RemoteEndpoints.ObjectMeta
+	}
+	e.Finalizers.Send(remote, &FinalizerRequest{
+		Kind:      K8Endpoints,
+		Namespace: namespace,
+		Name:      name,
+		Remove:    request.Type == RequestTypeDelete,
+	})
+}
+
+func (e *EndpointsWriter) recordCheckpoint(request *EndpointsRequest, err error) {
+	if e.Checkpoint == nil {
+		return
+	}
+	if request.Type == RequestTypeDelete {
+		// There's nothing left to delete
+		if err == nil || ResourceNotExist(err) {
+			e.Checkpoint.Forget(K8Endpoints, request.LocalEndpoints.ObjectMeta)
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	// Writes that weren't synced from a remote object, like the expiry's, leave the follower different from the
+	// last sync
+	if request.RemoteEndpoints == nil {
+		e.Checkpoint.Forget(K8Endpoints, request.LocalEndpoints.ObjectMeta)
+		return
+	}
+	hash, err := EndpointsHash(request.LocalEndpoints)
+	if err != nil {
+		ferrors.Error(err)
+		return
+	}
+	e.Checkpoint.Record(K8Endpoints, request.LocalEndpoints.ObjectMeta, request.RemoteEndpoints.ObjectMeta.ResourceVersion, hash)
+}
+
+func (e *EndpointsWriter) trackRetry(ctx context.Context, request *EndpointsRequest, err error) {
+	if e.Retries == nil || request.NoRetry {
+		return
+	}
+	namespace, name := request.LocalEndpoints.ObjectMeta.Namespace, request.LocalEndpoints.Name
+	// There's nothing left to delete
+	if err == nil || (request.Type == RequestTypeDelete && ResourceNotExist(err)) {
+		e.Retries.Succeeded(K8Endpoints, namespace, name)
+		return
+	}
+	remoteNamespace, remoteName := RemoteLocation(request.LocalEndpoints.ObjectMeta)
+	e.Retries.FailedFrom(K8Endpoints, namespace, name, remoteNamespace, remoteName, err, func() {
+		state.Default.Enqueue(K8Endpoints, RequestTypeMap[request.Type], namespace, name)
+		select {
+		case e.Events <- retryEndpointsRequest(request):
+		case <-ctx.Done():
+		}
+	})
+}
+
+// The follower may have changed since the request was made, and the controller owns it, so the retry overwrites it
+// whatever its resource version
+func retryEndpointsRequest(request *EndpointsRequest) *EndpointsRequest {
+	local := request.LocalEndpoints.DeepCopy()
+	local.ObjectMeta.ResourceVersion = ""
+	return &EndpointsRequest{Type: request.Type, RemoteEndpoints: request.RemoteEndpoints, LocalEndpoints: local,
+		KeepFinalizer: request.KeepFinalizer}
+}
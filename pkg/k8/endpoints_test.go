@@ -1,6 +1,7 @@
 package k8
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
@@ -44,6 +45,9 @@ func TestEndpointsWriterUpdate(t *testing.T) {
 					Labels: map[string]string{
 						"not": "solabel",
 					},
+					Annotations: map[string]string{
+						CrossClusterAppliedAnnotationKey: `{"labels":{"not":"solabel"}}`,
+					},
 				},
 			},
 		},
@@ -65,6 +69,9 @@ func TestEndpointsWriterUpdate(t *testing.T) {
 					Labels: map[string]string{
 						"not": "solabel",
 					},
+					Annotations: map[string]string{
+						CrossClusterAppliedAnnotationKey: `{"labels":{"not":"solabel"}}`,
+					},
 				},
 			},
 		},
@@ -81,7 +88,7 @@ func TestEndpointsWriterUpdate(t *testing.T) {
 				t.Fatalf("Something went wrong creating fake endpoint against fake clientset %v", err)
 			}
 		}
-		writer.update(testCase.UpdateEndpoints)
+		writer.update(context.Background(), testCase.UpdateEndpoints)
 		endpoints, err := fakeClientSet.CoreV1().
 			Endpoints(testCase.ExpectedEndpoints.ObjectMeta.Namespace).
 			Get(testCase.ExpectedEndpoints.ObjectMeta.Name, metav1.GetOptions{})
@@ -0,0 +1,219 @@
+package k8
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cenkalti/backoff"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Each consuming cluster adds its own finalizer, so a remote object isn't deleted until every cluster has
+	// deleted its follower
+	CrossClusterFinalizerPrefix = "fair.com/cross-cluster-"
+)
+
+// FinalizerRequest adds or removes the finalizer on an exported remote service or endpoints
+type FinalizerRequest struct {
+	// K8Services or K8Endpoints
+	Kind      string
+	Namespace string
+	Name      string
+	Remove    bool
+}
+
+// FinalizerWriter keeps a finalizer on the exported remote services and endpoints that have a local follower, so a
+// remote object can't be deleted without the controller seeing it. The finalizer is removed once the follower has
+// been deleted. Like the StatusWriter, it uses its own remote client with write access
+type FinalizerWriter struct {
+	Client  kubernetes.Interface
+	Cluster string
+
+	// Requests waiting to be written, at most one per remote object, in the order they were first sent
+	mu      sync.Mutex
+	pending map[string]*FinalizerRequest
+	order   []string
+	wake    chan struct{}
+}
+
+func NewFinalizerWriter(clientset kubernetes.Interface, cluster string) *FinalizerWriter {
+	return &FinalizerWriter{
+		Client:  clientset,
+		Cluster: cluster,
+		pending: map[string]*FinalizerRequest{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// FinalizerName is the finalizer a cluster adds to the remote objects it follows
+func FinalizerName(cluster string) string {
+	return CrossClusterFinalizerPrefix + cluster
+}
+
+// Run writes finalizers until the context is done. Requests still pending by then are dropped, the next sync of the
+// remote object sends them again
+func (f *FinalizerWriter) Run(ctx context.Context) {
+	for {
+		request := f.next()
+		if request == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.wake:
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		f.Write(ctx, request)
+	}
+}
+
+// Write adds or removes the finalizer, and returns once it's done
+func (f *FinalizerWriter) Write(ctx context.Context, request *FinalizerRequest) error {
+	finalizer := FinalizerName(f.Cluster)
+	write := func() error {
+		var err error
+		if request.Kind == K8Endpoints {
+			err = f.writeEndpoints(request, finalizer)
+		} else {
+			err = f.writeService(request, finalizer)
+		}
+		if err != nil && !errors.IsConflict(err) {
+			// There's nothing to finalize once the remote object is gone
+			if ResourceNotExist(err) {
+				return nil
+			}
+			if PermanentError(err) {
+				return backoff.Permanent(err)
+			}
+		}
+		return err
+	}
+	err := exponentialBackOff(ctx, write)
+	action := "add"
+	if request.Remove {
+		action = "remove"
+	}
+	metrics.Finalizers.Add(metrics.Key(request.Kind, action, metrics.Result(err)), 1)
+	return err
+}
+
+// The update carries the resource version it read, so a conflict means the object changed in between and it's read
+// again
+func (f *FinalizerWriter) writeService(request *FinalizerRequest, finalizer string) error {
+	svc, err := f.Client.CoreV1().Services(request.Namespace).Get(request.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if !changeFinalizer(K8Services, &svc.ObjectMeta, finalizer, request.Remove) {
+		return nil
+	}
+	_, err = f.Client.CoreV1().Services(request.Namespace).Update(svc)
+	return err
+}
+
+func (f *FinalizerWriter) writeEndpoints(request *FinalizerRequest, finalizer string) error {
+	endpoints, err := f.Client.CoreV1().Endpoints(request.Namespace).Get(request.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if !changeFinalizer(K8Endpoints, &endpoints.ObjectMeta, finalizer, request.Remove) {
+		return nil
+	}
+	_, err = f.Client.CoreV1().Endpoints(request.Namespace).Update(endpoints)
+	return err
+}
+
+// Adds or removes the finalizer, and returns whether anything changed. Finalizers can't be added to an object that's
+// being deleted
+func changeFinalizer(kind string, meta *metav1.ObjectMeta, finalizer string, remove bool) bool {
+	has := HasFinalizer(*meta, finalizer)
+	if remove && !has {
+		return false
+	}
+	if !remove && (has || Terminating(*meta)) {
+		return false
+	}
+	if remove {
+		logger.Info("Removing finalizer from remote object", zap.String("kind", kind), zap.String("name", meta.Name),
+			zap.String("namespace", meta.Namespace))
+		meta.Finalizers = withoutFinalizer(meta.Finalizers, finalizer)
+	} else {
+		logger.Info("Adding finalizer to remote object", zap.String("kind", kind), zap.String("name", meta.Name),
+			zap.String("namespace", meta.Namespace))
+		meta.Finalizers = append(meta.Finalizers, finalizer)
+	}
+	return true
+}
+
+// Send queues the request without waiting, so a slow remote cluster never holds up the local writes. Unlike status,
+// finalizers aren't best effort, so nothing is dropped: a request for an object that already has one pending
+// replaces it, since only the latest is worth writing. Adds are skipped if the remote object already has the
+// finalizer, so synced objects don't cost a remote read
+func (f *FinalizerWriter) Send(remote *metav1.ObjectMeta, req *FinalizerRequest) {
+	if !req.Remove && remote != nil && HasFinalizer(*remote, FinalizerName(f.Cluster)) {
+		return
+	}
+	key := req.Kind + "/" + req.Namespace + "/" + req.Name
+	f.mu.Lock()
+	if _, ok := f.pending[key]; !ok {
+		f.order = append(f.order, key)
+	}
+	f.pending[key] = req
+	metrics.FinalizersPending.Set(int64(len(f.pending)))
+	f.mu.Unlock()
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Takes the oldest pending request, or returns nil if there isn't one
+func (f *FinalizerWriter) next() *FinalizerRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.order) == 0 {
+		return nil
+	}
+	key := f.order[0]
+	f.order = f.order[1:]
+	request := f.pending[key]
+	delete(f.pending, key)
+	metrics.FinalizersPending.Set(int64(len(f.pending)))
+	return request
+}
+
+// Terminating checks if the remote object is being deleted, and only waiting on finalizers
+func Terminating(meta metav1.ObjectMeta) bool {
+	return meta.DeletionTimestamp != nil
+}
+
+// HasFinalizer checks if the object has the finalizer
+func HasFinalizer(meta metav1.ObjectMeta, finalizer string) bool {
+	for _, f := range meta.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutFinalizer(finalizers []string, finalizer string) []string {
+	filtered := []string{}
+	for _, f := range finalizers {
+		if f != finalizer {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
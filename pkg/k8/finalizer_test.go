@@ -0,0 +1,118 @@
+package k8
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFinalizerWriter(t *testing.T) {
+	finalizer := FinalizerName("local")
+	deleted := metav1.Now()
+	testCases := []struct {
+		Object   runtime.Object
+		Kind     string
+		Remove   bool
+		Expected []string
+	}{
+		// The finalizer is added next to the ones that are already there
+		{
+			Object:   &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Finalizers: []string{"other"}}},
+			Kind:     K8Services,
+			Expected: []string{"other", finalizer},
+		},
+		// Adding it again doesn't duplicate it
+		{
+			Object:   &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Finalizers: []string{finalizer}}},
+			Kind:     K8Services,
+			Expected: []string{finalizer},
+		},
+		// Services that are being deleted don't get it
+		{
+			Object:   &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", DeletionTimestamp: &deleted}},
+			Kind:     K8Services,
+			Expected: nil,
+		},
+		// Removing it leaves the other finalizers alone
+		{
+			Object:   &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Finalizers: []string{finalizer, "other"}}},
+			Kind:     K8Services,
+			Remove:   true,
+			Expected: []string{"other"},
+		},
+		// Endpoints get it too
+		{
+			Object:   &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar"}},
+			Kind:     K8Endpoints,
+			Expected: []string{finalizer},
+		},
+		// And have it removed
+		{
+			Object:   &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Finalizers: []string{finalizer}}},
+			Kind:     K8Endpoints,
+			Remove:   true,
+			Expected: []string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		client := fake.NewSimpleClientset(testCase.Object)
+		writer := NewFinalizerWriter(client, "local")
+		err := writer.Write(context.Background(), &FinalizerRequest{Kind: testCase.Kind, Namespace: "bar", Name: "foo", Remove: testCase.Remove})
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		var finalizers []string
+		if testCase.Kind == K8Endpoints {
+			endpoints, err := client.CoreV1().Endpoints("bar").Get("foo", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Could not get endpoints %v", err)
+			}
+			finalizers = endpoints.ObjectMeta.Finalizers
+		} else {
+			svc, err := client.CoreV1().Services("bar").Get("foo", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Could not get service %v", err)
+			}
+			finalizers = svc.ObjectMeta.Finalizers
+		}
+		if !reflect.DeepEqual(testCase.Expected, finalizers) {
+			t.Errorf("Expected finalizers: %v\ngot: %v", testCase.Expected, finalizers)
+		}
+	}
+
+	// A remote service that's already gone has nothing to finalize
+	writer := NewFinalizerWriter(fake.NewSimpleClientset(), "local")
+	if err := writer.Write(context.Background(), &FinalizerRequest{Kind: K8Services, Namespace: "bar", Name: "foo", Remove: true}); err != nil {
+		t.Errorf("Expected no error for a missing service\ngot: %v", err)
+	}
+}
+
+func TestFinalizerWriterSend(t *testing.T) {
+	writer := NewFinalizerWriter(fake.NewSimpleClientset(), "local")
+	synced := &metav1.ObjectMeta{Finalizers: []string{FinalizerName("local")}}
+
+	// Sending never waits on the writer, and only the latest request for an object is kept, in its first place
+	writer.Send(nil, &FinalizerRequest{Kind: K8Services, Namespace: "bar", Name: "foo"})
+	writer.Send(nil, &FinalizerRequest{Kind: K8Endpoints, Namespace: "bar", Name: "foo"})
+	writer.Send(nil, &FinalizerRequest{Kind: K8Services, Namespace: "bar", Name: "foo", Remove: true})
+	// Adds to objects that already have the finalizer are skipped
+	writer.Send(synced, &FinalizerRequest{Kind: K8Services, Namespace: "bar", Name: "synced"})
+
+	expected := []FinalizerRequest{
+		{Kind: K8Services, Namespace: "bar", Name: "foo", Remove: true},
+		{Kind: K8Endpoints, Namespace: "bar", Name: "foo"},
+	}
+	pending := []FinalizerRequest{}
+	for request := writer.next(); request != nil; request = writer.next() {
+		pending = append(pending, *request)
+	}
+	if !reflect.DeepEqual(expected, pending) {
+		t.Errorf("Expected pending: %+v\ngot: %+v", expected, pending)
+	}
+}
@@ -25,6 +25,17 @@ const (
 	CrossClusterServiceLabelKey         = "fair.com/cross-cluster"
 	CrossClusterServiceLocalLabelValue  = "follower"
 	CrossClusterServiceRemoteLabelValue = "true"
+	// Annotations with this prefix are written by the controller itself
+	CrossClusterAnnotationPrefix = "fair.com/cross-cluster-"
+	// Records the remote cluster a follower was created from
+	CrossClusterSourceAnnotationKey = "fair.com/cross-cluster-source"
+	// Record the remote object a follower was last synced from, and when
+	CrossClusterRemoteUIDAnnotationKey             = "fair.com/cross-cluster-remote-uid"
+	CrossClusterRemoteResourceVersionAnnotationKey = "fair.com/cross-cluster-remote-resource-version"
+	CrossClusterLastSyncAnnotationKey              = "fair.com/cross-cluster-last-sync"
+	// Set on followers that were moved to a different namespace or name from their remote object
+	CrossClusterRemoteNamespaceAnnotationKey = "fair.com/cross-cluster-remote-namespace"
+	CrossClusterRemoteNameAnnotationKey      = "fair.com/cross-cluster-remote-name"
 )
 
 var (
@@ -51,12 +62,46 @@ type ServiceRequest struct {
 	Type          RequestType
 	RemoteService *v1.Service
 	LocalService  *v1.Service
+	// How many times the request has been tried again after a retryable error
+	Attempt int
+	// Set on deletes that don't mean the remote service is gone, like when the followers expire. The remote
+	// finalizer is left in place
+	KeepFinalizer bool
+	// Set on writes that mustn't be retried later, like the expiry's. A retry could land after the followers were
+	// synced back and expire them again
+	NoRetry bool
+	// Optional. Called with the result once the request is written, or with nil if a newer request for the same
+	// follower replaced it first
+	Done func(error)
 }
 
 type EndpointsRequest struct {
 	Type            RequestType
 	RemoteEndpoints *v1.Endpoints
 	LocalEndpoints  *v1.Endpoints
+	// How many times the request has been tried again after a retryable error
+	Attempt int
+	// Set on writes that don't come from a change to the remote endpoints, like when the followers expire. The remote
+	// finalizer is left as it is
+	KeepFinalizer bool
+	// Set on writes that mustn't be retried later, like the expiry's. A retry could land after the followers were
+	// synced back and expire them again
+	NoRetry bool
+	// Optional. Called with the result once the request is written, or with nil if a newer request for the same
+	// follower replaced it first
+	Done func(error)
+}
+
+// RemoteLocation is the namespace and name of the remote object a follower was created from
+func RemoteLocation(meta metav1.ObjectMeta) (string, string) {
+	namespace, name := meta.Namespace, meta.Name
+	if remoteNamespace, ok := meta.Annotations[CrossClusterRemoteNamespaceAnnotationKey]; ok {
+		namespace = remoteNamespace
+	}
+	if remoteName, ok := meta.Annotations[CrossClusterRemoteNameAnnotationKey]; ok {
+		name = remoteName
+	}
+	return namespace, name
 }
 
 func ResourceNotExist(err error) bool {
@@ -67,13 +112,39 @@ func PermanentError(err error) bool {
 	return ResourceNotExist(err) || errors.IsConflict(err)
 }
 
-func exponentialBackOff(ctx context.Context, retryFunc func() error) {
+// Retries the func with exponential backoff. The final error is reported, and returned so callers can record it
+func exponentialBackOff(ctx context.Context, retryFunc func() error) error {
 	// Get settings and then override the ones we don't want
 	settings := backoff.NewExponentialBackOff()
 	settings.MaxInterval = backOffMaxInterval
 	settings.MaxElapsedTime = backOffMaxElapsedTime
-	err := backoff.Retry(retryFunc, settings)
+	err := backoff.Retry(retryFunc, backoff.WithContext(settings, ctx))
 	if err != nil {
-		ferrors.Error(err)
+		return ferrors.Error(err)
 	}
+	return nil
+}
+
+// Returns a context that's done once the timeout has passed after the parent is done, or as soon as abort is closed.
+// It lets work that's already started finish up after a stop, without letting it hold up the stop forever
+func drainContext(parent context.Context, abort <-chan struct{}, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-abort:
+			cancel()
+			return
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-time.After(timeout):
+			cancel()
+		case <-abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
 }
@@ -1,8 +1,10 @@
 package k8
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"time"
 
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -46,3 +48,36 @@ func TestResourceNotExist(t *testing.T) {
 		}
 	}
 }
+
+func TestDrainContext(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := drainContext(parent, nil, 50*time.Millisecond)
+	defer cancel()
+
+	cancelParent()
+	// Still running straight after the parent is done, so queued requests can finish
+	if ctx.Err() != nil {
+		t.Fatalf("Expected drain context to outlive its parent\ngot: %v", ctx.Err())
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("Expected drain context to be done after the timeout")
+	}
+}
+
+func TestDrainContextAbort(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	abort := make(chan struct{})
+	ctx, cancel := drainContext(parent, abort, time.Hour)
+	defer cancel()
+
+	cancelParent()
+	// Nothing is drained once aborted, even though the timeout is far off
+	close(abort)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("Expected drain context to be done once aborted")
+	}
+}
@@ -0,0 +1,116 @@
+package k8
+
+import (
+	"container/heap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Updates and deletes of live objects go first, since they're what keeps traffic flowing
+	PriorityLive = iota
+	// Creates come next, since a new export has no follower that traffic depends on yet
+	PriorityCreate
+	// Requests from the bulk channel, like the initial sync's and the cleaner's, go last
+	PriorityBulk
+
+	// How many requests the writers pull off their channels to pick the next write from. The rest wait on the
+	// channels, so the readers still get backpressure
+	maxQueuedWrites = 64
+)
+
+// Priority of a request, lower goes first
+func requestPriority(requestType RequestType, bulk bool) int {
+	switch {
+	case bulk:
+		return PriorityBulk
+	case requestType == RequestTypeAdd:
+		return PriorityCreate
+	}
+	return PriorityLive
+}
+
+// Requests for the same follower share a key in the queue
+func writeKey(meta metav1.ObjectMeta) string {
+	return meta.Namespace + "/" + meta.Name
+}
+
+type queuedWrite struct {
+	priority int
+	// Keeps requests of the same priority in the order they came in
+	seq     int
+	key     string
+	request interface{}
+	// Position in the heap, so a write can be moved when it's replaced
+	index int
+}
+
+// Requests waiting for a writer, by priority and then in the order they came in. There's at most one request per
+// object, so writes to the same object can't be reordered, only writes to different objects
+type writeQueue struct {
+	writes []*queuedWrite
+	queued map[string]*queuedWrite
+	seq    int
+}
+
+// Queues the request for the object with the key. If the object already has a request waiting, only the latest state
+// needs writing, so the new request replaces it. It keeps the earlier place in the queue and the higher of the two
+// priorities. A bulk request doesn't replace a live one, since it's usually worked out from an older list. Returns
+// the request that was dropped, if any
+func (q *writeQueue) add(key string, request interface{}, priority int) interface{} {
+	if q.queued == nil {
+		q.queued = map[string]*queuedWrite{}
+	}
+	if queued, ok := q.queued[key]; ok {
+		if priority == PriorityBulk && queued.priority != PriorityBulk {
+			return request
+		}
+		replaced := queued.request
+		queued.request = request
+		if priority < queued.priority {
+			queued.priority = priority
+			heap.Fix(q, queued.index)
+		}
+		return replaced
+	}
+	q.seq++
+	write := &queuedWrite{priority: priority, seq: q.seq, key: key, request: request}
+	q.queued[key] = write
+	heap.Push(q, write)
+	return nil
+}
+
+func (q *writeQueue) next() interface{} {
+	write := heap.Pop(q).(*queuedWrite)
+	delete(q.queued, write.key)
+	return write.request
+}
+
+func (q *writeQueue) Len() int {
+	return len(q.writes)
+}
+
+func (q *writeQueue) Less(i, j int) bool {
+	if q.writes[i].priority != q.writes[j].priority {
+		return q.writes[i].priority < q.writes[j].priority
+	}
+	return q.writes[i].seq < q.writes[j].seq
+}
+
+func (q *writeQueue) Swap(i, j int) {
+	q.writes[i], q.writes[j] = q.writes[j], q.writes[i]
+	q.writes[i].index = i
+	q.writes[j].index = j
+}
+
+func (q *writeQueue) Push(x interface{}) {
+	write := x.(*queuedWrite)
+	write.index = len(q.writes)
+	q.writes = append(q.writes, write)
+}
+
+func (q *writeQueue) Pop() interface{} {
+	last := q.writes[len(q.writes)-1]
+	q.writes = q.writes[:len(q.writes)-1]
+	return last
+}
@@ -0,0 +1,84 @@
+package k8
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWriteQueue(t *testing.T) {
+	type write struct {
+		// Defaults to the name
+		Key  string
+		Name string
+		Type RequestType
+		Bulk bool
+	}
+	testCases := []struct {
+		Writes   []write
+		Expected []string
+	}{
+		// Live updates and deletes go before creates, which go before bulk requests
+		{
+			Writes: []write{
+				{Name: "cleaner", Type: RequestTypeDelete, Bulk: true},
+				{Name: "create", Type: RequestTypeAdd},
+				{Name: "update", Type: RequestTypeUpdate},
+				{Name: "delete", Type: RequestTypeDelete},
+			},
+			Expected: []string{"update", "delete", "create", "cleaner"},
+		},
+		// Requests of the same priority keep their order
+		{
+			Writes: []write{
+				{Name: "first", Type: RequestTypeUpdate},
+				{Name: "second", Type: RequestTypeDelete},
+				{Name: "third", Type: RequestTypeUpdate},
+			},
+			Expected: []string{"first", "second", "third"},
+		},
+		// A later request for the same object replaces the queued one, keeping its place and the higher priority
+		{
+			Writes: []write{
+				{Name: "other-create", Type: RequestTypeAdd},
+				{Key: "foo", Name: "foo-create", Type: RequestTypeAdd},
+				{Name: "other-update", Type: RequestTypeUpdate},
+				{Key: "foo", Name: "foo-update", Type: RequestTypeUpdate},
+			},
+			Expected: []string{"foo-update", "other-update", "other-create"},
+		},
+		// A live delete isn't overtaken by an earlier create of the same object
+		{
+			Writes: []write{
+				{Key: "foo", Name: "foo-create", Type: RequestTypeAdd},
+				{Key: "foo", Name: "foo-delete", Type: RequestTypeDelete},
+			},
+			Expected: []string{"foo-delete"},
+		},
+		// A bulk request doesn't replace a live one for the same object
+		{
+			Writes: []write{
+				{Key: "foo", Name: "foo-update", Type: RequestTypeUpdate},
+				{Key: "foo", Name: "foo-cleaner", Type: RequestTypeDelete, Bulk: true},
+			},
+			Expected: []string{"foo-update"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		queue := &writeQueue{}
+		for _, w := range testCase.Writes {
+			key := w.Key
+			if key == "" {
+				key = w.Name
+			}
+			queue.add(key, w.Name, requestPriority(w.Type, w.Bulk))
+		}
+		order := []string{}
+		for queue.Len() > 0 {
+			order = append(order, queue.next().(string))
+		}
+		if !reflect.DeepEqual(testCase.Expected, order) {
+			t.Errorf("Expected order: %v\ngot: %v", testCase.Expected, order)
+		}
+	}
+}
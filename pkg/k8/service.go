@@ -2,28 +2,63 @@ package k8
 
 import (
 	"context"
+	"time"
 
 	"github.com/cenkalti/backoff"
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/retry"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/state"
 	"go.uber.org/zap"
 
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
 type ServiceReader struct {
 	Events chan *ServiceRequest
+	// Only objects in namespaces in the shard are sent on. The zero value sends everything
+	Shard Shard
+	// Optional. Events are dropped while it returns true, like while the followers are expired
+	Paused func() bool
+	// The informer's handlers don't take a context, so the reader holds on to it to stop sending once it's done
+	ctx context.Context
 }
 
 type ServiceWriter struct {
 	Events chan *ServiceRequest
 	Client kubernetes.Interface
+	// Optional. If set, the outcome of every write is sent along so it can be recorded on the remote service
+	Status chan *StatusRequest
+	// If set, the changes are logged instead of written
+	DryRun bool
+	// How long queued and in flight requests get to finish once the writer is stopped
+	DrainTimeout time.Duration
+	// Optional. Once closed, queued and in flight requests are dropped without waiting for the drain timeout, like
+	// when leadership is lost
+	Abort <-chan struct{}
+	// Optional. Low priority requests, like the initial sync's and the cleaner's. They're only written once nothing on
+	// Events is waiting
+	Bulk chan *ServiceRequest
+	// Optional. If set, failed writes are retried with growing delays until they're dead lettered
+	Retries *retry.Tracker
+	// Optional. If set, remote services get a finalizer once their follower is written, which is removed once the
+	// follower is deleted
+	Finalizers *FinalizerWriter
+	// Optional. Local followers, as watched by WatchLocalServices. Updates that wouldn't change the cached follower
+	// are skipped
+	Cache cache.Store
+	// Optional. If set, successful writes are recorded so the next leader can skip followers that are up to date
+	Checkpoint *Checkpoint
 }
 
-func NewServiceReader(events chan *ServiceRequest) *ServiceReader {
+func NewServiceReader(ctx context.Context, events chan *ServiceRequest) *ServiceReader {
 	return &ServiceReader{
 		Events: events,
+		ctx:    ctx,
 	}
 }
 
@@ -31,7 +66,11 @@ func (s *ServiceReader) Add(obj interface{}) {
 	s.sendRequest(obj, RequestTypeAdd)
 }
 
-func (s *ServiceReader) Update(_, newObj interface{}) {
+func (s *ServiceReader) Update(oldObj, newObj interface{}) {
+	// Sync status written back to the remote service doesn't change the follower
+	if statusOnlyChange(oldObj.(*v1.Service), newObj.(*v1.Service)) {
+		return
+	}
 	s.sendRequest(newObj, RequestTypeUpdate)
 }
 
@@ -41,13 +80,26 @@ func (s *ServiceReader) Delete(obj interface{}) {
 
 func (s *ServiceReader) sendRequest(obj interface{}, requestType RequestType) {
 	service := obj.(*v1.Service)
+	if !s.Shard.Contains(service.ObjectMeta.Namespace) || (s.Paused != nil && s.Paused()) {
+		return
+	}
+	// A remote service that's only waiting on finalizers is as good as deleted
+	if Terminating(service.ObjectMeta) {
+		requestType = RequestTypeDelete
+	}
 	logger.Info("Sending service request", zap.String("requestType", RequestTypeMap[requestType]),
 		zap.String("name", service.Name), zap.String("namespace", service.ObjectMeta.Namespace))
 	req := &ServiceRequest{
 		Type:          requestType,
 		RemoteService: service,
 	}
-	s.Events <- req
+	state.Default.RecordExport(K8Services, RequestTypeMap[requestType], service.ObjectMeta.Namespace, service.Name,
+		service.ObjectMeta.ResourceVersion, requestType == RequestTypeDelete)
+	metrics.RemoteEvents.Add(metrics.Key(K8Services, RequestTypeMap[requestType]), 1)
+	select {
+	case s.Events <- req:
+	case <-s.ctx.Done():
+	}
 }
 
 func NewServiceWriter(clientset kubernetes.Interface, events chan *ServiceRequest) *ServiceWriter {
@@ -57,21 +109,44 @@ func NewServiceWriter(clientset kubernetes.Interface, events chan *ServiceReques
 	}
 }
 
-func (s *ServiceWriter) add(svc *v1.Service) {
-	logger.Info("Creating service", zap.String("name", svc.Name), zap.String("namespace", svc.ObjectMeta.Namespace))
-	s.create(svc)
+// Returns whether the write was skipped because the follower is already up to date
+func (s *ServiceWriter) add(ctx context.Context, svc *v1.Service) (bool, error) {
+	// Followers that already exist are updated instead, which skips the write if nothing changed. Every export is
+	// an add when a leader starts, and most of them will already have followers
+	if s.cached(svc) {
+		return s.update(ctx, svc)
+	}
+	return false, s.create(ctx, svc)
 }
 
-func (s *ServiceWriter) update(svc *v1.Service) {
+// Returns whether the write was skipped because the follower is already up to date
+func (s *ServiceWriter) update(ctx context.Context, svc *v1.Service) (bool, error) {
+	if s.UpToDate(svc) {
+		metrics.Updates.Add(metrics.Key(K8Services, "skipped"), 1)
+		return true, nil
+	}
+	metrics.Updates.Add(metrics.Key(K8Services, "applied"), 1)
 	logger.Info("Updating service", zap.String("name", svc.Name), zap.String("namespace", svc.ObjectMeta.Namespace))
+	// The create has its own backoff, so its result is kept separately from the update's
+	var createErr error
+	current := s.current(svc)
 	update := func() error {
-		_, err := s.Client.CoreV1().Services(svc.ObjectMeta.Namespace).Update(svc)
+		err := applyService(s.Client, current, svc)
 		if err != nil {
+			// Anything that went wrong may have been down to the cached follower, so the retry reads it
+			current = nil
 			// If the service doesn't exist for some reason, attempt to create it
 			if ResourceNotExist(err) {
-				s.create(svc)
+				createErr = s.create(ctx, svc)
 				return nil
 			}
+			// The service changed between reading and patching it, so the patch is worked out again
+			if errors.IsConflict(err) {
+				logger.Warn("Service changed while it was being updated, retrying", zap.String("name", svc.Name),
+					zap.String("namespace", svc.ObjectMeta.Namespace))
+				metrics.WriteConflicts.Add(K8Services, 1)
+				return err
+			}
 			if PermanentError(err) {
 				return backoff.Permanent(err)
 			}
@@ -79,10 +154,48 @@ func (s *ServiceWriter) update(svc *v1.Service) {
 		}
 		return nil
 	}
-	exponentialBackOff(context.Background(), update)
+	if err := exponentialBackOff(ctx, update); err != nil {
+		return false, err
+	}
+	return false, createErr
+}
+
+func (s *ServiceWriter) cached(svc *v1.Service) bool {
+	return s.current(svc) != nil
+}
+
+// The follower as the watch cache has it, or nil if it's not cached
+func (s *ServiceWriter) current(svc *v1.Service) *v1.Service {
+	if s.Cache == nil {
+		return nil
+	}
+	obj, exists, err := s.Cache.Get(svc)
+	if err != nil || !exists {
+		return nil
+	}
+	return obj.(*v1.Service)
+}
+
+// UpToDate checks if the follower in the watch cache already matches the desired one. It's false if the follower
+// isn't cached
+func (s *ServiceWriter) UpToDate(svc *v1.Service) bool {
+	current := s.current(svc)
+	if current == nil {
+		return false
+	}
+	upToDate, err := serviceUpToDate(current, svc)
+	if err != nil {
+		ferrors.Error(err)
+		return false
+	}
+	return upToDate
 }
 
-func (s *ServiceWriter) create(svc *v1.Service) {
+func (s *ServiceWriter) create(ctx context.Context, svc *v1.Service) error {
+	svc = svc.DeepCopy()
+	if err := setApplied(&svc.ObjectMeta); err != nil {
+		return err
+	}
 	create := func() error {
 		logger.Info("Creating service", zap.String("name", svc.Name), zap.String("namespace", svc.ObjectMeta.Namespace))
 		_, err := s.Client.CoreV1().Services(svc.ObjectMeta.Namespace).Create(svc)
@@ -98,10 +211,10 @@ func (s *ServiceWriter) create(svc *v1.Service) {
 		}
 		return nil
 	}
-	exponentialBackOff(context.Background(), create)
+	return exponentialBackOff(ctx, create)
 }
 
-func (s *ServiceWriter) delete(svc *v1.Service) {
+func (s *ServiceWriter) delete(ctx context.Context, svc *v1.Service) error {
 	delete := func() error {
 		logger.Info("Deleting service", zap.String("name", svc.Name), zap.String("namespace", svc.ObjectMeta.Namespace))
 		err := s.Client.CoreV1().Services(svc.ObjectMeta.Namespace).Delete(svc.Name, &metav1.DeleteOptions{})
@@ -113,19 +226,227 @@ func (s *ServiceWriter) delete(svc *v1.Service) {
 		}
 		return nil
 	}
-	exponentialBackOff(context.Background(), delete)
+	return exponentialBackOff(ctx, delete)
+}
+
+// Run writes requests until the context is done, picking the one with the highest priority out of those waiting.
+// Requests that are in flight or already queued by then are given the drain timeout to finish before their retries
+// are cut off
+func (s *ServiceWriter) Run(ctx context.Context) {
+	writeCtx, cancel := drainContext(ctx, s.Abort, s.DrainTimeout)
+	defer cancel()
+	queue := &writeQueue{}
+	for {
+		s.fill(queue)
+		if queue.Len() == 0 {
+			select {
+			case <-ctx.Done():
+				s.drain(writeCtx, queue)
+				return
+			case request := <-s.Events:
+				s.enqueue(queue, request, false)
+			case request := <-s.Bulk:
+				s.enqueue(queue, request, true)
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			s.drain(writeCtx, queue)
+			return
+		default:
+		}
+		request := queue.next().(*ServiceRequest)
+		state.Default.Dequeue(K8Services, request.LocalService.ObjectMeta.Namespace, request.LocalService.Name)
+		s.Write(writeCtx, request)
+	}
+}
+
+// Queues a request. A request it replaces for the same follower is never written, so it's taken off the state
+// tracker's queue and reported as done
+func (s *ServiceWriter) enqueue(queue *writeQueue, request *ServiceRequest, bulk bool) {
+	dropped := queue.add(writeKey(request.LocalService.ObjectMeta), request, requestPriority(request.Type, bulk))
+	if dropped == nil {
+		return
+	}
+	replaced := dropped.(*ServiceRequest)
+	state.Default.Dequeue(K8Services, replaced.LocalService.ObjectMeta.Namespace, replaced.LocalService.Name)
+	if replaced.Done != nil {
+		replaced.Done(nil)
+	}
+}
+
+// Pulls the requests that are waiting on the channels into the queue, up to its limit
+func (s *ServiceWriter) fill(queue *writeQueue) {
+	for queue.Len() < maxQueuedWrites {
+		select {
+		case request := <-s.Events:
+			s.enqueue(queue, request, false)
+		case request := <-s.Bulk:
+			s.enqueue(queue, request, true)
+		default:
+			return
+		}
+	}
 }
 
-func (s *ServiceWriter) Run() {
+func (s *ServiceWriter) drain(ctx context.Context, queue *writeQueue) {
 	for {
-		request := <-s.Events
-		switch request.Type {
-		case RequestTypeAdd:
-			s.add(request.LocalService)
-		case RequestTypeUpdate:
-			s.update(request.LocalService)
-		case RequestTypeDelete:
-			s.delete(request.LocalService)
+		s.fill(queue)
+		if queue.Len() == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			logger.Info("Drain timeout reached, dropping queued requests", zap.String("kind", K8Services))
+			return
+		default:
+		}
+		request := queue.next().(*ServiceRequest)
+		state.Default.Dequeue(K8Services, request.LocalService.ObjectMeta.Namespace, request.LocalService.Name)
+		s.Write(ctx, request)
+	}
+}
+
+// Write makes a single request against the local cluster, and returns once it's done. Retries stop when the
+// context is done. It's only called by Run, or by commands that don't run the writer, since writes to the same
+// follower mustn't overlap
+func (s *ServiceWriter) Write(ctx context.Context, request *ServiceRequest) error {
+	err := s.write(ctx, request)
+	if request.Done != nil {
+		request.Done(err)
+	}
+	return err
+}
+
+func (s *ServiceWriter) write(ctx context.Context, request *ServiceRequest) error {
+	if s.DryRun {
+		return s.plan(request)
+	}
+	var err error
+	var skipped bool
+	switch request.Type {
+	case RequestTypeAdd:
+		skipped, err = s.add(ctx, request.LocalService)
+	case RequestTypeUpdate:
+		skipped, err = s.update(ctx, request.LocalService)
+	case RequestTypeDelete:
+		err = s.delete(ctx, request.LocalService)
+	}
+	s.reportStatus(request, err)
+	s.reportFinalizer(request, err)
+	s.recordCheckpoint(request, err)
+	s.trackRetry(ctx, request, err)
+	state.Default.RecordWrite(K8Services, RequestTypeMap[request.Type], request.LocalService.ObjectMeta.Namespace,
+		request.LocalService.Name, request.Type == RequestTypeDelete, err)
+	result := metrics.Result(err)
+	if skipped {
+		result = "skipped"
+	}
+	metrics.Writes.Add(metrics.Key(K8Services, RequestTypeMap[request.Type], result), 1)
+	return err
+}
+
+func (s *ServiceWriter) plan(request *ServiceRequest) error {
+	change, err := PlanService(s.Client, request.Type, request.LocalService)
+	if err != nil {
+		return ferrors.Error(err)
+	}
+	logger.Info("Dry run, skipping service write", zap.String("action", change.Action),
+		zap.String("name", change.Name), zap.String("namespace", change.Namespace), zap.Any("fields", change.Fields))
+	return nil
+}
+
+func (s *ServiceWriter) reportStatus(request *ServiceRequest, err error) {
+	if s.Status == nil {
+		return
+	}
+	// The status is written to the remote service, which can be somewhere else if the follower was moved
+	namespace, name := RemoteLocation(request.LocalService.ObjectMeta)
+	sendStatus(s.Status, &StatusRequest{
+		Type:      request.Type,
+		Kind:      K8Services,
+		Namespace: namespace,
+		Name:      name,
+		Err:       err,
+	})
+}
+
+func (s *ServiceWriter) reportFinalizer(request *ServiceRequest, err error) {
+	if s.Finalizers == nil || request.KeepFinalizer {
+		return
+	}
+	// A follower that's already gone counts as deleted
+	if err != nil && !(request.Type == RequestTypeDelete && ResourceNotExist(err)) {
+		return
+	}
+	// The finalizer is on the remote service, which can be somewhere else if the follower was moved
+	namespace, name := RemoteLocation(request.LocalService.ObjectMeta)
+	var remote *metav1.ObjectMeta
+	if request.RemoteService != nil {
+		remote = &request.RemoteService.ObjectMeta
+	}
+	s.Finalizers.Send(remote, &FinalizerRequest{
+		Kind:      K8Services,
+		Namespace: namespace,
+		Name:      name,
+		Remove:    request.Type == RequestTypeDelete,
+	})
+}
+
+func (s *ServiceWriter) recordCheckpoint(request *ServiceRequest, err error) {
+	if s.Checkpoint == nil {
+		return
+	}
+	if request.Type == RequestTypeDelete {
+		// There's nothing left to delete
+		if err == nil || ResourceNotExist(err) {
+			s.Checkpoint.Forget(K8Services, request.LocalService.ObjectMeta)
 		}
+		return
+	}
+	if err != nil {
+		return
 	}
+	// Writes that weren't synced from a remote object, like the expiry's, leave the follower different from the
+	// last sync
+	if request.RemoteService == nil {
+		s.Checkpoint.Forget(K8Services, request.LocalService.ObjectMeta)
+		return
+	}
+	hash, err := ServiceHash(request.LocalService)
+	if err != nil {
+		ferrors.Error(err)
+		return
+	}
+	s.Checkpoint.Record(K8Services, request.LocalService.ObjectMeta, request.RemoteService.ObjectMeta.ResourceVersion, hash)
+}
+
+func (s *ServiceWriter) trackRetry(ctx context.Context, request *ServiceRequest, err error) {
+	if s.Retries == nil || request.NoRetry {
+		return
+	}
+	namespace, name := request.LocalService.ObjectMeta.Namespace, request.LocalService.Name
+	// There's nothing left to delete
+	if err == nil || (request.Type == RequestTypeDelete && ResourceNotExist(err)) {
+		s.Retries.Succeeded(K8Services, namespace, name)
+		return
+	}
+	remoteNamespace, remoteName := RemoteLocation(request.LocalService.ObjectMeta)
+	s.Retries.FailedFrom(K8Services, namespace, name, remoteNamespace, remoteName, err, func() {
+		state.Default.Enqueue(K8Services, RequestTypeMap[request.Type], namespace, name)
+		select {
+		case s.Events <- retryServiceRequest(request):
+		case <-ctx.Done():
+		}
+	})
+}
+
+// The follower may have changed since the request was made, and the controller owns it, so the retry overwrites it
+// whatever its resource version
+func retryServiceRequest(request *ServiceRequest) *ServiceRequest {
+	local := request.LocalService.DeepCopy()
+	local.ObjectMeta.ResourceVersion = ""
+	return &ServiceRequest{Type: request.Type, RemoteService: request.RemoteService, LocalService: local,
+		KeepFinalizer: request.KeepFinalizer}
 }
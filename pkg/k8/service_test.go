@@ -1,11 +1,13 @@
 package k8
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
 	"k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -44,6 +46,9 @@ func TestServicesWriterUpdate(t *testing.T) {
 					Labels: map[string]string{
 						"not": "solabel",
 					},
+					Annotations: map[string]string{
+						CrossClusterAppliedAnnotationKey: `{"labels":{"not":"solabel"}}`,
+					},
 				},
 			},
 		},
@@ -65,6 +70,9 @@ func TestServicesWriterUpdate(t *testing.T) {
 					Labels: map[string]string{
 						"not": "solabel",
 					},
+					Annotations: map[string]string{
+						CrossClusterAppliedAnnotationKey: `{"labels":{"not":"solabel"}}`,
+					},
 				},
 			},
 		},
@@ -81,7 +89,7 @@ func TestServicesWriterUpdate(t *testing.T) {
 				t.Fatalf("Something went wrong creating fake service against fake clientset %v", err)
 			}
 		}
-		writer.update(testCase.UpdateService)
+		writer.update(context.Background(), testCase.UpdateService)
 		service, err := fakeClientSet.CoreV1().
 			Services(testCase.ExpectedService.ObjectMeta.Namespace).
 			Get(testCase.ExpectedService.ObjectMeta.Name, metav1.GetOptions{})
@@ -93,3 +101,73 @@ func TestServicesWriterUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestServicesWriterSkipsUpToDate(t *testing.T) {
+	fakeClientSet := fake.NewSimpleClientset()
+	cached := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "dead space",
+			Labels:      map[string]string{"not": "solabel"},
+			Annotations: map[string]string{CrossClusterAppliedAnnotationKey: `{"labels":{"not":"solabel"}}`},
+		},
+	}
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	store.Add(cached)
+	writer := &ServiceWriter{
+		Events: make(chan *ServiceRequest, 4),
+		Client: fakeClientSet,
+		Cache:  store,
+	}
+	desired := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "dead space",
+			Labels:    map[string]string{"not": "solabel"},
+		},
+	}
+	skipped, err := writer.update(context.Background(), desired)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !skipped {
+		t.Errorf("Expected the update to be skipped")
+	}
+	if actions := fakeClientSet.Actions(); len(actions) != 0 {
+		t.Errorf("Expected no API calls\ngot: %+v", actions)
+	}
+}
+
+func TestServicesWriterPatchesCached(t *testing.T) {
+	cached := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "dead space",
+			Labels:      map[string]string{"wow": "solabel"},
+			Annotations: map[string]string{CrossClusterAppliedAnnotationKey: `{"labels":{"wow":"solabel"}}`},
+		},
+	}
+	fakeClientSet := fake.NewSimpleClientset(cached)
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	store.Add(cached)
+	writer := &ServiceWriter{
+		Events: make(chan *ServiceRequest, 4),
+		Client: fakeClientSet,
+		Cache:  store,
+	}
+	desired := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "dead space",
+			Labels:    map[string]string{"not": "solabel"},
+		},
+	}
+	if _, err := writer.update(context.Background(), desired); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	// The patch is worked out against the cached follower, so it isn't read first
+	actions := fakeClientSet.Actions()
+	if len(actions) != 1 || actions[0].GetVerb() != "patch" {
+		t.Errorf("Expected a single patch\ngot: %+v", actions)
+	}
+}
@@ -0,0 +1,22 @@
+package k8
+
+import (
+	"hash/fnv"
+)
+
+// Shard is a slice of the namespaces, picked by hashing the namespace name. Every namespace is in exactly one
+// shard, so replicas leading different shards never write the same objects. The zero value contains everything
+type Shard struct {
+	Index int
+	Count int
+}
+
+// Contains checks if the namespace hashes into the shard
+func (s Shard) Contains(namespace string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	return int(h.Sum32()%uint32(s.Count)) == s.Index
+}
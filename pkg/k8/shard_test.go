@@ -0,0 +1,38 @@
+package k8
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardContains(t *testing.T) {
+	testCases := []struct {
+		Count int
+	}{
+		// Sharding disabled
+		{Count: 0},
+		// A single shard
+		{Count: 1},
+		// Several shards
+		{Count: 4},
+	}
+
+	for _, testCase := range testCases {
+		shards := testCase.Count
+		if shards == 0 {
+			shards = 1
+		}
+		for i := 0; i < 100; i++ {
+			namespace := fmt.Sprintf("namespace-%d", i)
+			matches := 0
+			for index := 0; index < shards; index++ {
+				if (Shard{Index: index, Count: testCase.Count}).Contains(namespace) {
+					matches++
+				}
+			}
+			if matches != 1 {
+				t.Errorf("Expected %s to be in exactly 1 of %d shards\ngot: %d", namespace, testCase.Count, matches)
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package k8
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"go.uber.org/zap"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Each consuming cluster writes its own annotation, so the set of clusters that have a follower
+	// can be read off the remote service without the controllers clobbering each other
+	CrossClusterStatusAnnotationPrefix = "fair.com/cross-cluster-status-"
+
+	// A status whose only change is the sync time is still written once this much time has passed since the last
+	// write, so lastSync doesn't go stale
+	defaultStatusRefresh = 10 * time.Minute
+)
+
+// SyncStatus is what gets written back to the exported remote service for a single consuming cluster
+type SyncStatus struct {
+	Cluster   string    `json:"cluster"`
+	Follower  bool      `json:"follower"`
+	LastSync  time.Time `json:"lastSync"`
+	Endpoints int       `json:"endpoints"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// StatusRequest is the outcome of a single local write
+type StatusRequest struct {
+	Type      RequestType
+	Kind      string
+	Namespace string
+	Name      string
+	Endpoints int
+	Err       error
+}
+
+// StatusWriter records the sync status of local followers as an annotation on the exported remote service.
+// It uses its own remote client, since the one the watchers use is only expected to have read access
+type StatusWriter struct {
+	Events  chan *StatusRequest
+	Client  kubernetes.Interface
+	Cluster string
+	// How long a status that only has a new sync time waits to be written
+	Refresh time.Duration
+
+	statuses map[string]*SyncStatus
+	// The status last written to every remote service
+	written map[string]SyncStatus
+	now     func() time.Time
+}
+
+func NewStatusWriter(clientset kubernetes.Interface, cluster string, events chan *StatusRequest) *StatusWriter {
+	return &StatusWriter{
+		Events:   events,
+		Client:   clientset,
+		Cluster:  cluster,
+		Refresh:  defaultStatusRefresh,
+		statuses: map[string]*SyncStatus{},
+		written:  map[string]SyncStatus{},
+		now:      time.Now,
+	}
+}
+
+// StatusAnnotationKey is the annotation a cluster writes its sync status to on the remote service
+func StatusAnnotationKey(cluster string) string {
+	return CrossClusterStatusAnnotationPrefix + cluster
+}
+
+// CountAddresses counts the ready addresses across all subsets of the endpoints
+func CountAddresses(endpoints *v1.Endpoints) int {
+	count := 0
+	for _, subset := range endpoints.Subsets {
+		count += len(subset.Addresses)
+	}
+	return count
+}
+
+// Run writes sync status until the context is done. Status is best effort, so anything still queued is dropped
+func (s *StatusWriter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case request := <-s.Events:
+			s.record(ctx, request)
+		}
+	}
+}
+
+func (s *StatusWriter) record(ctx context.Context, request *StatusRequest) {
+	key := fmt.Sprintf("%s/%s", request.Namespace, request.Name)
+	status, ok := s.statuses[key]
+	if !ok {
+		status = &SyncStatus{Cluster: s.Cluster}
+		s.statuses[key] = status
+	}
+
+	if request.Err != nil {
+		status.LastError = request.Err.Error()
+	} else {
+		status.LastError = ""
+		status.LastSync = s.now().UTC()
+		switch request.Kind {
+		case K8Services:
+			status.Follower = request.Type != RequestTypeDelete
+		case K8Endpoints:
+			status.Endpoints = request.Endpoints
+			if request.Type == RequestTypeDelete {
+				status.Endpoints = 0
+			}
+		}
+	}
+
+	changed := s.changed(key, status)
+	// Once the follower service is gone there's nothing left to track. The remote service is most likely gone too
+	gone := request.Kind == K8Services && request.Type == RequestTypeDelete && request.Err == nil
+	if gone {
+		delete(s.statuses, key)
+		delete(s.written, key)
+	}
+	if !changed {
+		return
+	}
+	if s.write(ctx, request.Namespace, request.Name, status) == nil && !gone {
+		s.written[key] = *status
+	}
+}
+
+// Checks if the status is different from the one last written. A new sync time on its own only counts once the
+// refresh interval has passed, since every resync would otherwise write the remote service
+func (s *StatusWriter) changed(key string, status *SyncStatus) bool {
+	written, ok := s.written[key]
+	if !ok {
+		return true
+	}
+	current := *status
+	current.LastSync = written.LastSync
+	if current != written {
+		return true
+	}
+	return !status.LastSync.Before(written.LastSync.Add(s.Refresh))
+}
+
+func (s *StatusWriter) write(ctx context.Context, namespace, name string, status *SyncStatus) error {
+	value, err := json.Marshal(status)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	// A merge patch only touches this cluster's annotation, so it won't conflict with other writers
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				StatusAnnotationKey(s.Cluster): string(value),
+			},
+		},
+	})
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	write := func() error {
+		logger.Info("Writing sync status to remote service", zap.String("name", name), zap.String("namespace", namespace))
+		_, err := s.Client.CoreV1().Services(namespace).Patch(name, types.MergePatchType, patch)
+		if err != nil {
+			// If the remote service is gone, there's nothing to write the status to
+			if ResourceNotExist(err) {
+				logger.Info("Remote service no longer exists, skipping sync status",
+					zap.String("name", name), zap.String("namespace", namespace))
+				return nil
+			}
+			if PermanentError(err) {
+				return backoff.Permanent(err)
+			}
+			return err
+		}
+		return nil
+	}
+	return exponentialBackOff(ctx, write)
+}
+
+// Checks if the only change to a remote service is to the sync status annotations, which the controllers write
+// themselves. Resyncs, where the resource version is the same, aren't status changes
+func statusOnlyChange(old, new *v1.Service) bool {
+	if old.ObjectMeta.ResourceVersion == new.ObjectMeta.ResourceVersion {
+		return false
+	}
+	return reflect.DeepEqual(withoutStatus(old), withoutStatus(new))
+}
+
+func withoutStatus(svc *v1.Service) *v1.Service {
+	svc = svc.DeepCopy()
+	svc.ObjectMeta.ResourceVersion = ""
+	for key := range svc.ObjectMeta.Annotations {
+		if strings.HasPrefix(key, CrossClusterStatusAnnotationPrefix) {
+			delete(svc.ObjectMeta.Annotations, key)
+		}
+	}
+	if len(svc.ObjectMeta.Annotations) == 0 {
+		svc.ObjectMeta.Annotations = nil
+	}
+	return svc
+}
+
+// Sync status is best effort, so a slow remote shouldn't hold up local writes
+func sendStatus(events chan *StatusRequest, req *StatusRequest) {
+	select {
+	case events <- req:
+	default:
+		logger.Info("Sync status queue is full, dropping status", zap.String("kind", req.Kind),
+			zap.String("name", req.Name), zap.String("namespace", req.Namespace))
+	}
+}
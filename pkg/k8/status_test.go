@@ -0,0 +1,182 @@
+package k8
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStatusWriterRecord(t *testing.T) {
+	syncTime := time.Date(2018, time.August, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		Requests []*StatusRequest
+		Expected SyncStatus
+	}{
+		// Service and endpoints created, the follower exists and has the endpoint count
+		{
+			Requests: []*StatusRequest{
+				&StatusRequest{Type: RequestTypeAdd, Kind: K8Services, Namespace: "bar", Name: "foo"},
+				&StatusRequest{Type: RequestTypeAdd, Kind: K8Endpoints, Namespace: "bar", Name: "foo", Endpoints: 3},
+			},
+			Expected: SyncStatus{
+				Cluster:   "local",
+				Follower:  true,
+				LastSync:  syncTime,
+				Endpoints: 3,
+			},
+		},
+		// Endpoints update fails, the last error is recorded but the rest of the status is kept
+		{
+			Requests: []*StatusRequest{
+				&StatusRequest{Type: RequestTypeAdd, Kind: K8Services, Namespace: "bar", Name: "foo"},
+				&StatusRequest{Type: RequestTypeAdd, Kind: K8Endpoints, Namespace: "bar", Name: "foo", Endpoints: 3},
+				&StatusRequest{Type: RequestTypeUpdate, Kind: K8Endpoints, Namespace: "bar", Name: "foo", Endpoints: 1, Err: errors.New("oh no")},
+			},
+			Expected: SyncStatus{
+				Cluster:   "local",
+				Follower:  true,
+				LastSync:  syncTime,
+				Endpoints: 3,
+				LastError: "oh no",
+			},
+		},
+		// Follower deleted
+		{
+			Requests: []*StatusRequest{
+				&StatusRequest{Type: RequestTypeAdd, Kind: K8Services, Namespace: "bar", Name: "foo"},
+				&StatusRequest{Type: RequestTypeDelete, Kind: K8Endpoints, Namespace: "bar", Name: "foo"},
+				&StatusRequest{Type: RequestTypeDelete, Kind: K8Services, Namespace: "bar", Name: "foo"},
+			},
+			Expected: SyncStatus{
+				Cluster:  "local",
+				LastSync: syncTime,
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		fakeClientSet := fake.NewSimpleClientset(&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "bar",
+			},
+		})
+		writer := NewStatusWriter(fakeClientSet, "local", make(chan *StatusRequest, 4))
+		writer.now = func() time.Time { return syncTime }
+		for _, req := range testCase.Requests {
+			writer.record(context.Background(), req)
+		}
+		service, err := fakeClientSet.CoreV1().Services("bar").Get("foo", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Could not get service %v", err)
+		}
+		status := SyncStatus{}
+		if err := json.Unmarshal([]byte(service.Annotations[StatusAnnotationKey("local")]), &status); err != nil {
+			t.Fatalf("Could not unmarshal sync status %v", err)
+		}
+		if !reflect.DeepEqual(testCase.Expected, status) {
+			t.Errorf("Expected sync status: %+v\ngot: %+v", testCase.Expected, status)
+		}
+	}
+}
+
+func TestStatusWriterSkipsUnchanged(t *testing.T) {
+	fakeClientSet := fake.NewSimpleClientset(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+	writer := NewStatusWriter(fakeClientSet, "local", make(chan *StatusRequest, 4))
+	syncTime := time.Date(2018, time.August, 1, 0, 0, 0, 0, time.UTC)
+	writer.now = func() time.Time {
+		syncTime = syncTime.Add(time.Minute)
+		return syncTime
+	}
+	requests := []*StatusRequest{
+		&StatusRequest{Type: RequestTypeAdd, Kind: K8Services, Namespace: "bar", Name: "foo"},
+		// Only the sync time is new, so nothing is written
+		&StatusRequest{Type: RequestTypeUpdate, Kind: K8Services, Namespace: "bar", Name: "foo"},
+		&StatusRequest{Type: RequestTypeAdd, Kind: K8Endpoints, Namespace: "bar", Name: "foo", Endpoints: 3},
+		&StatusRequest{Type: RequestTypeUpdate, Kind: K8Endpoints, Namespace: "bar", Name: "foo", Endpoints: 3},
+	}
+	for _, req := range requests {
+		writer.record(context.Background(), req)
+	}
+
+	patches := 0
+	for _, action := range fakeClientSet.Actions() {
+		if action.GetVerb() == "patch" {
+			patches++
+		}
+	}
+	if patches != 2 {
+		t.Errorf("Expected 2 status patches\ngot: %d", patches)
+	}
+
+	// Once the refresh interval has passed, a new sync time is written on its own
+	syncTime = syncTime.Add(writer.Refresh)
+	writer.record(context.Background(), &StatusRequest{Type: RequestTypeUpdate, Kind: K8Services, Namespace: "bar", Name: "foo"})
+	service, err := fakeClientSet.CoreV1().Services("bar").Get("foo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Could not get service %v", err)
+	}
+	status := SyncStatus{}
+	if err := json.Unmarshal([]byte(service.Annotations[StatusAnnotationKey("local")]), &status); err != nil {
+		t.Fatalf("Could not unmarshal sync status %v", err)
+	}
+	if !status.LastSync.Equal(syncTime) {
+		t.Errorf("Expected last sync: %v\ngot: %v", syncTime, status.LastSync)
+	}
+}
+
+func TestStatusOnlyChange(t *testing.T) {
+	service := func(resourceVersion string, annotations map[string]string, port int32) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", ResourceVersion: resourceVersion, Annotations: annotations},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: port}}},
+		}
+	}
+	status := map[string]string{StatusAnnotationKey("local"): `{"cluster":"local"}`}
+	testCases := []struct {
+		Old      *v1.Service
+		New      *v1.Service
+		Expected bool
+	}{
+		// Status annotation added
+		{
+			Old:      service("1", nil, 80),
+			New:      service("2", status, 80),
+			Expected: true,
+		},
+		// Status annotation added along with a port change
+		{
+			Old: service("1", nil, 80),
+			New: service("2", status, 8080),
+		},
+		// Other annotation added
+		{
+			Old: service("1", nil, 80),
+			New: service("2", map[string]string{"wow": "such"}, 80),
+		},
+		// Resync, nothing changed
+		{
+			Old: service("1", status, 80),
+			New: service("1", status, 80),
+		},
+	}
+
+	for _, testCase := range testCases {
+		if actual := statusOnlyChange(testCase.Old, testCase.New); actual != testCase.Expected {
+			t.Errorf("Expected status only change to be %t for %+v -> %+v", testCase.Expected, testCase.Old, testCase.New)
+		}
+	}
+}
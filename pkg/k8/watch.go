@@ -1,6 +1,7 @@
 package k8
 
 import (
+	"context"
 	"time"
 
 	"k8s.io/api/core/v1"
@@ -13,6 +14,10 @@ const (
 	defaultResyncPeriod = 30 * time.Second
 	K8Endpoints         = "endpoints"
 	K8Services          = "services"
+	// Retries of the transformer pipeline are tracked under the kind with this suffix. They're keyed by the remote
+	// object, which can have a different namespace and name than its follower, so they're kept apart from the
+	// writers' retries
+	TransformKindSuffix = "-transform"
 )
 
 type Watcher interface {
@@ -21,8 +26,8 @@ type Watcher interface {
 	Delete(interface{})
 }
 
-// WatchEndpoints watches for endpoint update and delete events
-func WatchEndpoints(clientset kubernetes.Interface, w Watcher, stopChan <-chan struct{}) {
+// WatchEndpoints watches for endpoint update and delete events until the context is done
+func WatchEndpoints(ctx context.Context, clientset kubernetes.Interface, w Watcher) {
 	restClient := clientset.CoreV1().RESTClient()
 	watchlist := cache.NewFilteredListWatchFromClient(restClient, K8Endpoints, metav1.NamespaceAll, RemoteFilter)
 	_, informer := cache.NewInformer(watchlist, &v1.Endpoints{}, defaultResyncPeriod,
@@ -32,11 +37,11 @@ func WatchEndpoints(clientset kubernetes.Interface, w Watcher, stopChan <-chan s
 			DeleteFunc: w.Delete,
 		},
 	)
-	go informer.Run(stopChan)
+	go informer.Run(ctx.Done())
 }
 
-// WatchServices watches for service add, update, and delete events
-func WatchServices(clientset kubernetes.Interface, w Watcher, stopChan <-chan struct{}) {
+// WatchServices watches for service add, update, and delete events until the context is done
+func WatchServices(ctx context.Context, clientset kubernetes.Interface, w Watcher) {
 	restClient := clientset.CoreV1().RESTClient()
 	watchlist := cache.NewFilteredListWatchFromClient(restClient, K8Services, metav1.NamespaceAll, RemoteFilter)
 	_, informer := cache.NewInformer(watchlist, &v1.Service{}, defaultResyncPeriod,
@@ -46,5 +51,29 @@ func WatchServices(clientset kubernetes.Interface, w Watcher, stopChan <-chan st
 			DeleteFunc: w.Delete,
 		},
 	)
-	go informer.Run(stopChan)
+	go informer.Run(ctx.Done())
+}
+
+// WatchLocalServices caches the local follower services until the context is done. The returned func reports whether
+// the cache has synced
+func WatchLocalServices(ctx context.Context, clientset kubernetes.Interface) (cache.Store, cache.InformerSynced) {
+	restClient := clientset.CoreV1().RESTClient()
+	watchlist := cache.NewFilteredListWatchFromClient(restClient, K8Services, metav1.NamespaceAll, localFilter)
+	store, informer := cache.NewInformer(watchlist, &v1.Service{}, 0, cache.ResourceEventHandlerFuncs{})
+	go informer.Run(ctx.Done())
+	return store, informer.HasSynced
+}
+
+// WatchLocalEndpoints caches the local follower endpoints until the context is done. The returned func reports whether
+// the cache has synced
+func WatchLocalEndpoints(ctx context.Context, clientset kubernetes.Interface) (cache.Store, cache.InformerSynced) {
+	restClient := clientset.CoreV1().RESTClient()
+	watchlist := cache.NewFilteredListWatchFromClient(restClient, K8Endpoints, metav1.NamespaceAll, localFilter)
+	store, informer := cache.NewInformer(watchlist, &v1.Endpoints{}, 0, cache.ResourceEventHandlerFuncs{})
+	go informer.Run(ctx.Done())
+	return store, informer.HasSynced
+}
+
+func localFilter(options *metav1.ListOptions) {
+	options.LabelSelector = CrossClusterLocalLabel
 }
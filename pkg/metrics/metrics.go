@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"expvar"
+	"strings"
+)
+
+// Metrics are published with expvar, and served as JSON by the admin server
+var (
+	// Events received from the remote watchers, keyed by kind and request type
+	RemoteEvents = expvar.NewMap("remote_events")
+	// Writes to the local cluster, keyed by kind, request type and result. The result is skipped for adds and updates
+	// that would not have changed the follower
+	Writes = expvar.NewMap("writes")
+	// Number of cleaner passes
+	CleanerRuns = expvar.NewInt("cleaner_runs")
+	// Followers deleted by the cleaner, keyed by kind
+	CleanerDeletes = expvar.NewMap("cleaner_deletes")
+	// Probes of remote addresses, keyed by remote cluster and result
+	Probes = expvar.NewMap("probes")
+	// Remote addresses left out of the local endpoints, keyed by reason
+	RejectedAddresses = expvar.NewMap("rejected_addresses")
+	// Webhook transformer calls, keyed by webhook name and result
+	Webhooks = expvar.NewMap("webhooks")
+	// Remote objects denied by the admission rules, keyed by rule name
+	AdmissionDenials = expvar.NewMap("admission_denials")
+	// Requests that failed in the pipeline, keyed by kind, transformer and whether they're retried
+	TransformerErrors = expvar.NewMap("transformer_errors")
+	// Failed writes that were scheduled to be tried again, keyed by kind
+	WriteRetries = expvar.NewMap("write_retries")
+	// Remote endpoints changes that were replaced by a later change before they were written
+	CoalescedEndpoints = expvar.NewInt("coalesced_endpoints")
+	// Endpoints requests sent on by the coalescer, keyed by why they were sent: the window closed, they were held for
+	// the max staleness, or they're a delete
+	CoalescerFlushes = expvar.NewMap("coalescer_flushes")
+	// Followers the leader's initial sync is writing, how many of them it's written, and how many of those writes failed
+	InitialSyncTotal  = expvar.NewInt("initial_sync_total")
+	InitialSyncDone   = expvar.NewInt("initial_sync_done")
+	InitialSyncErrors = expvar.NewInt("initial_sync_errors")
+	// Followers the initial sync skipped because the checkpoint has them synced from the same remote version
+	InitialSyncSkipped = expvar.NewInt("initial_sync_skipped")
+	// Followers in the sync checkpoint, and checkpoint saves, keyed by result. Saves another leader got to first are
+	// lost, and ones that were too large are saved empty
+	CheckpointEntries = expvar.NewInt("checkpoint_entries")
+	CheckpointSaves   = expvar.NewMap("checkpoint_saves")
+	// Followers in the checkpoint whose remote object was deleted while there was no leader, keyed by kind
+	CheckpointOrphans = expvar.NewMap("checkpoint_orphans")
+	// Finalizer writes to remote services and endpoints, keyed by kind, whether they add or remove it and result,
+	// and the finalizer writes waiting to be made
+	Finalizers        = expvar.NewMap("finalizers")
+	FinalizersPending = expvar.NewInt("finalizers_pending")
+	// Follower updates, keyed by kind and whether they were applied or skipped because they wouldn't change anything
+	Updates = expvar.NewMap("updates")
+	// Follower labels and annotations another writer changed, which the controller left alone or took back, keyed
+	// by kind
+	FieldConflicts = expvar.NewMap("field_conflicts")
+	// Follower updates that raced with another writer and were worked out again, keyed by kind
+	WriteConflicts = expvar.NewMap("write_conflicts")
+	// Whether the remote cluster could be reached on the last check, and its transitions between unreachable,
+	// expired, reachable and recovered, keyed by transition
+	RemoteReachable   = expvar.NewInt("remote_reachable")
+	RemoteTransitions = expvar.NewMap("remote_transitions")
+	// Followers the expiry policy was applied to, keyed by policy
+	ExpiredFollowers = expvar.NewMap("expired_followers")
+	// Number of objects whose writes failed too many times to keep retrying
+	DeadLetters = expvar.NewInt("dead_letters")
+)
+
+// Key joins the parts of a metric key, so that keys are consistent across metrics
+func Key(parts ...string) string {
+	return strings.Join(parts, ".")
+}
+
+// Result is the result part of a metric key for an error
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,138 @@
+package plan
+
+import (
+	"fmt"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/controller"
+	ferrors "github.com/wearefair/k8-cross-cluster-controller/pkg/errors"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Planner works out what the controller would change in the local cluster, without writing anything. It's meant
+// for validating a new remote or a config change before enabling writes
+type Planner struct {
+	LocalClient           kubernetes.Interface
+	RemoteClient          kubernetes.Interface
+	ServiceTransformers   []controller.ServiceTransformer
+	EndpointsTransformers []controller.EndpointsTransformer
+}
+
+func New(localClient, remoteClient kubernetes.Interface, serviceTransformers []controller.ServiceTransformer,
+	endpointsTransformers []controller.EndpointsTransformer) *Planner {
+	return &Planner{
+		LocalClient:           localClient,
+		RemoteClient:          remoteClient,
+		ServiceTransformers:   serviceTransformers,
+		EndpointsTransformers: endpointsTransformers,
+	}
+}
+
+// Plan lists both clusters, runs every export through the transformers, and returns the changes that would be made.
+// Updates that wouldn't change anything are left out
+func (p *Planner) Plan() ([]*k8.Change, error) {
+	serviceChanges, err := p.planServices()
+	if err != nil {
+		return nil, err
+	}
+	endpointsChanges, err := p.planEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	return append(serviceChanges, endpointsChanges...), nil
+}
+
+func (p *Planner) planServices() ([]*k8.Change, error) {
+	opts := &metav1.ListOptions{}
+	k8.RemoteFilter(opts)
+	remote, err := p.RemoteClient.CoreV1().Services(metav1.NamespaceAll).List(*opts)
+	if err != nil {
+		return nil, ferrors.Error(err)
+	}
+	local, err := p.LocalClient.CoreV1().Services(metav1.NamespaceAll).List(k8.LocalFilter)
+	if err != nil {
+		return nil, ferrors.Error(err)
+	}
+
+	changes := []*k8.Change{}
+	exported := map[string]bool{}
+	for i := range remote.Items {
+		req := &k8.ServiceRequest{
+			Type:          k8.RequestTypeUpdate,
+			RemoteService: &remote.Items[i],
+		}
+		exported[key(req.RemoteService.ObjectMeta)] = true
+		// Transformers report their own errors, so the export is just left out of the plan
+		if err := controller.TransformService(req, p.ServiceTransformers...); err != nil {
+			continue
+		}
+		change, err := k8.PlanService(p.LocalClient, req.Type, req.LocalService)
+		if err != nil {
+			return nil, ferrors.Error(err)
+		}
+		if !change.Noop() {
+			changes = append(changes, change)
+		}
+	}
+	for i := range local.Items {
+		if !exported[remoteKey(local.Items[i].ObjectMeta)] {
+			change, _ := k8.PlanService(p.LocalClient, k8.RequestTypeDelete, &local.Items[i])
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func (p *Planner) planEndpoints() ([]*k8.Change, error) {
+	opts := &metav1.ListOptions{}
+	k8.RemoteFilter(opts)
+	remote, err := p.RemoteClient.CoreV1().Endpoints(metav1.NamespaceAll).List(*opts)
+	if err != nil {
+		return nil, ferrors.Error(err)
+	}
+	local, err := p.LocalClient.CoreV1().Endpoints(metav1.NamespaceAll).List(k8.LocalFilter)
+	if err != nil {
+		return nil, ferrors.Error(err)
+	}
+
+	changes := []*k8.Change{}
+	exported := map[string]bool{}
+	for i := range remote.Items {
+		req := &k8.EndpointsRequest{
+			Type:            k8.RequestTypeUpdate,
+			RemoteEndpoints: &remote.Items[i],
+		}
+		exported[key(req.RemoteEndpoints.ObjectMeta)] = true
+		// Transformers report their own errors, so the export is just left out of the plan
+		if err := controller.TransformEndpoints(req, p.EndpointsTransformers...); err != nil {
+			continue
+		}
+		change, err := k8.PlanEndpoints(p.LocalClient, req.Type, req.LocalEndpoints)
+		if err != nil {
+			return nil, ferrors.Error(err)
+		}
+		if !change.Noop() {
+			changes = append(changes, change)
+		}
+	}
+	for i := range local.Items {
+		if !exported[remoteKey(local.Items[i].ObjectMeta)] {
+			change, _ := k8.PlanEndpoints(p.LocalClient, k8.RequestTypeDelete, &local.Items[i])
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func key(meta metav1.ObjectMeta) string {
+	return fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
+}
+
+// Followers moved by the namespace map or name template are matched to the remote object they record, rather than
+// their own namespace and name
+func remoteKey(meta metav1.ObjectMeta) string {
+	namespace, name := k8.RemoteLocation(meta)
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
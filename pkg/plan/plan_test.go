@@ -0,0 +1,127 @@
+package plan
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/controller"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/k8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPlan(t *testing.T) {
+	remoteLabels := func() map[string]string {
+		return map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceRemoteLabelValue}
+	}
+	localLabels := func() map[string]string {
+		return map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceLocalLabelValue}
+	}
+	testCases := []struct {
+		Remote   []runtime.Object
+		Local    []runtime.Object
+		Expected []*k8.Change
+	}{
+		// Exported service that doesn't exist locally is added
+		{
+			Remote: []runtime.Object{
+				&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: remoteLabels()}},
+			},
+			Expected: []*k8.Change{
+				&k8.Change{
+					Action:    "add",
+					Kind:      k8.K8Services,
+					Namespace: "bar",
+					Name:      "foo",
+					Fields: []k8.FieldChange{
+						k8.FieldChange{Field: "labels[" + k8.CrossClusterServiceLabelKey + "]", New: k8.CrossClusterServiceLocalLabelValue},
+					},
+				},
+			},
+		},
+		// Exported service that's already in sync is left out
+		{
+			Remote: []runtime.Object{
+				&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: remoteLabels()}},
+			},
+			Local: []runtime.Object{
+				&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: localLabels()}},
+			},
+			Expected: []*k8.Change{},
+		},
+		// Follower with no export is deleted
+		{
+			Local: []runtime.Object{
+				&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "bar", Labels: localLabels()}},
+			},
+			Expected: []*k8.Change{
+				&k8.Change{
+					Action:    "delete",
+					Kind:      k8.K8Endpoints,
+					Namespace: "bar",
+					Name:      "foo",
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		localClient := fake.NewSimpleClientset(testCase.Local...)
+		remoteClient := fake.NewSimpleClientset(testCase.Remote...)
+		augmenter := &controller.Augmenter{Client: localClient}
+		planner := New(
+			localClient,
+			remoteClient,
+			[]controller.ServiceTransformer{augmenter.Service, controller.ServiceWhitelist, controller.ServiceLabel},
+			[]controller.EndpointsTransformer{augmenter.Endpoints, controller.EndpointsWhitelist, controller.EndpointsLabel},
+		)
+		changes, err := planner.Plan()
+		if err != nil {
+			t.Fatalf("Unexpected error planning %v", err)
+		}
+		if !reflect.DeepEqual(testCase.Expected, changes) {
+			t.Errorf("Expected changes: %+v\ngot: %+v", testCase.Expected, changes)
+		}
+	}
+}
+
+func TestPlanMovedFollowers(t *testing.T) {
+	remote := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{
+		Name:      "foo",
+		Namespace: "bar",
+		Labels:    map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceRemoteLabelValue},
+	}}
+	moved := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{
+		Name:      "foo",
+		Namespace: "moved",
+		Labels:    map[string]string{k8.CrossClusterServiceLabelKey: k8.CrossClusterServiceLocalLabelValue},
+		Annotations: map[string]string{
+			k8.CrossClusterRemoteNamespaceAnnotationKey: "bar",
+			k8.CrossClusterRemoteNameAnnotationKey:      "foo",
+		},
+	}}
+	localClient := fake.NewSimpleClientset(moved)
+	remoteClient := fake.NewSimpleClientset(remote)
+	augmenter := &controller.Augmenter{Client: localClient}
+	namespaceMap := &controller.NamespaceMap{Namespaces: map[string]string{"bar": "moved"}, Client: localClient}
+	planner := New(
+		localClient,
+		remoteClient,
+		nil,
+		[]controller.EndpointsTransformer{augmenter.Endpoints, controller.EndpointsWhitelist, controller.EndpointsLabel, namespaceMap.Endpoints},
+	)
+
+	changes, err := planner.Plan()
+	if err != nil {
+		t.Fatalf("Unexpected error planning %v", err)
+	}
+	// The moved follower still has its export, so it isn't deleted
+	for _, change := range changes {
+		if change.Action == "delete" {
+			t.Errorf("Expected the moved follower to be kept\ngot: %+v", change)
+		}
+	}
+}
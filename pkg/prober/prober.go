@@ -0,0 +1,182 @@
+package prober
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/logging"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	ModeTCP  = "tcp"
+	ModeHTTP = "http"
+
+	defaultCacheDuration = 30 * time.Second
+	defaultEvictAfter    = 10 * time.Minute
+	defaultPath          = "/"
+)
+
+var (
+	logger = logging.Logger
+
+	ErrInvalidMode = errors.New("The probe mode must be tcp or http.")
+)
+
+// Prober checks that remote addresses can be reached from the local cluster. The API server only knows if pods are
+// ready in their own cluster, not whether the network between the clusters lets traffic through
+type Prober struct {
+	Mode    string
+	Timeout time.Duration
+	// Path requested by HTTP probes
+	Path string
+	// How long a result is reused before the address is probed again
+	CacheDuration time.Duration
+	// How long a result is kept after it was last asked for. Addresses that are gone from the remote endpoints are
+	// dropped once it runs out
+	EvictAfter time.Duration
+	// Name of the remote cluster, used in the metrics
+	Remote string
+
+	client     *http.Client
+	mu         sync.Mutex
+	results    map[string]*result
+	lastSweep  time.Time
+	refreshing sync.WaitGroup
+	now        func() time.Time
+}
+
+type result struct {
+	err        error
+	checked    time.Time
+	used       time.Time
+	refreshing bool
+}
+
+func New(mode, remote string, timeout time.Duration) (*Prober, error) {
+	if mode != ModeTCP && mode != ModeHTTP {
+		return nil, ErrInvalidMode
+	}
+	return &Prober{
+		Mode:          mode,
+		Timeout:       timeout,
+		Path:          defaultPath,
+		CacheDuration: defaultCacheDuration,
+		EvictAfter:    defaultEvictAfter,
+		Remote:        remote,
+		client:        &http.Client{Timeout: timeout},
+		results:       map[string]*result{},
+		now:           time.Now,
+	}, nil
+}
+
+// Reachable probes every port on every address at the same time. An address is reachable if all of its ports are
+func (p *Prober) Reachable(ips []string, ports []int32) map[string]bool {
+	reachable := map[string]bool{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, ip := range ips {
+		reachable[ip] = true
+		for _, port := range ports {
+			wg.Add(1)
+			go func(ip string, port int32) {
+				defer wg.Done()
+				if err := p.Probe(ip, port); err != nil {
+					mu.Lock()
+					reachable[ip] = false
+					mu.Unlock()
+				}
+			}(ip, port)
+		}
+	}
+	wg.Wait()
+	return reachable
+}
+
+// Probe checks a single address and port, reusing the last result if it's recent enough. Only addresses that haven't
+// been probed yet wait for the probe. Once a result is too old it's still returned while the address is probed again
+// in the background, so probes don't hold up the pipeline
+func (p *Prober) Probe(ip string, port int32) error {
+	address := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	now := p.now()
+	p.mu.Lock()
+	p.sweep(now)
+	cached, ok := p.results[address]
+	if ok {
+		cached.used = now
+		err := cached.err
+		stale := now.Sub(cached.checked) >= p.CacheDuration && !cached.refreshing
+		if stale {
+			cached.refreshing = true
+			p.refreshing.Add(1)
+		}
+		p.mu.Unlock()
+		if stale {
+			go func() {
+				defer p.refreshing.Done()
+				p.check(address)
+			}()
+		}
+		return err
+	}
+	p.mu.Unlock()
+	return p.check(address)
+}
+
+// Probes the address and stores the result
+func (p *Prober) check(address string) error {
+	err := p.probe(address)
+	metrics.Probes.Add(metrics.Key(p.Remote, metrics.Result(err)), 1)
+	if err != nil {
+		logger.Warn("Remote address is unreachable", zap.String("address", address), zap.Error(err))
+	}
+	now := p.now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	used := now
+	if cached, ok := p.results[address]; ok {
+		used = cached.used
+	}
+	p.results[address] = &result{err: err, checked: now, used: used}
+	return err
+}
+
+// Drops the results that haven't been asked for in EvictAfter. The whole cache is only walked once per cache
+// duration. Must be called with the lock held
+func (p *Prober) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < p.CacheDuration {
+		return
+	}
+	p.lastSweep = now
+	for address, cached := range p.results {
+		if now.Sub(cached.used) >= p.EvictAfter && !cached.refreshing {
+			delete(p.results, address)
+		}
+	}
+}
+
+func (p *Prober) probe(address string) error {
+	if p.Mode == ModeTCP {
+		conn, err := net.DialTimeout("tcp", address, p.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	resp, err := p.client.Get(fmt.Sprintf("http://%s%s", address, p.Path))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// Same as the kubelet's HTTP probes
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("Probe returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package prober
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+	defer listener.Close()
+	// Nothing is listening on a port once its listener is closed
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+	closed.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	testCases := []struct {
+		Mode     string
+		Address  string
+		Expected bool
+	}{
+		// TCP probe against a listener succeeds
+		{
+			Mode:     ModeTCP,
+			Address:  listener.Addr().String(),
+			Expected: true,
+		},
+		// TCP probe against a closed port fails
+		{
+			Mode:    ModeTCP,
+			Address: closed.Addr().String(),
+		},
+		// HTTP probe against a healthy server succeeds
+		{
+			Mode:     ModeHTTP,
+			Address:  healthy.Listener.Addr().String(),
+			Expected: true,
+		},
+		// HTTP probe against a server returning an error status fails
+		{
+			Mode:    ModeHTTP,
+			Address: unhealthy.Listener.Addr().String(),
+		},
+		// HTTP probe against a closed port fails
+		{
+			Mode:    ModeHTTP,
+			Address: closed.Addr().String(),
+		},
+	}
+
+	for _, testCase := range testCases {
+		prober, err := New(testCase.Mode, "remote", time.Second)
+		if err != nil {
+			t.Fatalf("Could not create prober %v", err)
+		}
+		ip, port := splitAddress(t, testCase.Address)
+		err = prober.Probe(ip, port)
+		if (err == nil) != testCase.Expected {
+			t.Errorf("Expected %s probe of %s to succeed: %t\ngot: %v", testCase.Mode, testCase.Address, testCase.Expected, err)
+		}
+	}
+}
+
+func TestReachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+	defer listener.Close()
+	_, port := splitAddress(t, listener.Addr().String())
+	prober, err := New(ModeTCP, "remote", time.Second)
+	if err != nil {
+		t.Fatalf("Could not create prober %v", err)
+	}
+
+	// Only 127.0.0.1 is listening, so the other loopback address is refused
+	reachable := prober.Reachable([]string{"127.0.0.1", "127.0.0.2"}, []int32{port})
+	expected := map[string]bool{"127.0.0.1": true, "127.0.0.2": false}
+	for ip, ok := range expected {
+		if reachable[ip] != ok {
+			t.Errorf("Expected %s reachable: %t\ngot: %t", ip, ok, reachable[ip])
+		}
+	}
+}
+
+func TestProbeCache(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+	ip, port := splitAddress(t, listener.Addr().String())
+	prober, err := New(ModeTCP, "remote", time.Second)
+	if err != nil {
+		t.Fatalf("Could not create prober %v", err)
+	}
+	now := time.Date(2018, time.August, 1, 0, 0, 0, 0, time.UTC)
+	prober.now = func() time.Time { return now }
+
+	if err := prober.Probe(ip, port); err != nil {
+		t.Fatalf("Expected first probe to succeed\ngot: %v", err)
+	}
+	listener.Close()
+	// The listener is gone, but the result is still cached
+	if err := prober.Probe(ip, port); err != nil {
+		t.Errorf("Expected cached probe to succeed\ngot: %v", err)
+	}
+	now = now.Add(prober.CacheDuration)
+	// The expired result is still returned while the address is probed again in the background
+	if err := prober.Probe(ip, port); err != nil {
+		t.Errorf("Expected expired probe to return the last result\ngot: %v", err)
+	}
+	prober.refreshing.Wait()
+	if err := prober.Probe(ip, port); err == nil {
+		t.Errorf("Expected probe to fail once the result was refreshed")
+	}
+}
+
+func TestProbeEviction(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+	defer listener.Close()
+	ip, port := splitAddress(t, listener.Addr().String())
+	prober, err := New(ModeTCP, "remote", time.Second)
+	if err != nil {
+		t.Fatalf("Could not create prober %v", err)
+	}
+	now := time.Date(2018, time.August, 1, 0, 0, 0, 0, time.UTC)
+	prober.now = func() time.Time { return now }
+
+	if err := prober.Probe(ip, port); err != nil {
+		t.Fatalf("Expected probe to succeed\ngot: %v", err)
+	}
+	// Asking for another address sweeps the cache, which drops the first one once it hasn't been asked for in a while
+	now = now.Add(prober.EvictAfter)
+	prober.Probe(ip, port+1)
+	prober.refreshing.Wait()
+	address := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	if _, ok := prober.results[address]; ok {
+		t.Errorf("Expected %s to be evicted", address)
+	}
+	if len(prober.results) != 1 {
+		t.Errorf("Expected 1 cached result\ngot: %d", len(prober.results))
+	}
+}
+
+func splitAddress(t *testing.T, address string) (string, int32) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatalf("Could not split address %v", err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("Could not parse port %v", err)
+	}
+	return host, int32(portNumber)
+}
@@ -0,0 +1,270 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/logging"
+	"github.com/wearefair/k8-cross-cluster-controller/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxFailures = 5
+	defaultBaseDelay   = 30 * time.Second
+	defaultMaxDelay    = 30 * time.Minute
+)
+
+var (
+	logger = logging.Logger
+
+	// Default is the tracker the writers record their failures to
+	Default = New(defaultMaxFailures)
+
+	ErrNotDeadLettered = errors.New("The object isn't dead lettered.")
+	ErrPaused          = errors.New("Dead letters aren't replayed while retries are paused.")
+)
+
+// DeadLetter is an object whose writes failed too many times in a row to keep retrying on their own
+type DeadLetter struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Where the object was synced from in the remote cluster
+	RemoteNamespace string    `json:"remoteNamespace"`
+	RemoteName      string    `json:"remoteName"`
+	Failures        int       `json:"failures"`
+	LastError       string    `json:"lastError"`
+	Since           time.Time `json:"since"`
+}
+
+type object struct {
+	DeadLetter
+	deadLettered bool
+	// Bumped on every failure and replay, so a scheduled retry can tell if it's been superseded
+	generation int
+	// Sends the last failed request to the writer again
+	resend func()
+}
+
+// Tracker keeps the retry state of every object whose last write failed, across reconciles. Failed writes are
+// retried with delays that grow with every failure, until the object is moved to the dead letters
+type Tracker struct {
+	// Failures in a row before an object is dead lettered
+	MaxFailures int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	mu      sync.Mutex
+	objects map[string]*object
+	// Optional. See SetPaused
+	pausedFunc func() bool
+	now        func() time.Time
+	// Schedules a retry. Replaced in tests so nothing runs in the background
+	after func(time.Duration, func())
+}
+
+func New(maxFailures int) *Tracker {
+	return &Tracker{
+		MaxFailures: maxFailures,
+		BaseDelay:   defaultBaseDelay,
+		MaxDelay:    defaultMaxDelay,
+		objects:     map[string]*object{},
+		now:         time.Now,
+		after: func(delay time.Duration, f func()) {
+			time.AfterFunc(delay, f)
+		},
+	}
+}
+
+// Failed records a failed write. The request is resent after a delay, unless the object has failed too many times
+// and is dead lettered. A newer failure or a success for the same object cancels the pending retry
+func (t *Tracker) Failed(kind, namespace, name string, err error, resend func()) {
+	t.FailedFrom(kind, namespace, name, namespace, name, err, resend)
+}
+
+// FailedFrom is Failed for an object that was synced from a remote object with a different namespace or name
+func (t *Tracker) FailedFrom(kind, namespace, name, remoteNamespace, remoteName string, err error, resend func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := objectKey(kind, namespace, name)
+	obj, ok := t.objects[key]
+	if !ok {
+		obj = &object{DeadLetter: DeadLetter{Kind: kind, Namespace: namespace, Name: name}}
+		t.objects[key] = obj
+	}
+	obj.RemoteNamespace = remoteNamespace
+	obj.RemoteName = remoteName
+	obj.Failures++
+	obj.LastError = err.Error()
+	obj.generation++
+	obj.resend = resend
+
+	if obj.deadLettered {
+		return
+	}
+	if obj.Failures >= t.MaxFailures {
+		obj.deadLettered = true
+		obj.Since = t.now().UTC()
+		metrics.DeadLetters.Add(1)
+		logger.Error("Write failed too many times, moving to dead letters", zap.String("kind", kind),
+			zap.String("name", name), zap.String("namespace", namespace), zap.Int("failures", obj.Failures), zap.Error(err))
+		return
+	}
+
+	delay := t.delay(obj.Failures)
+	generation := obj.generation
+	metrics.WriteRetries.Add(kind, 1)
+	logger.Warn("Write failed, retrying", zap.String("kind", kind), zap.String("name", name),
+		zap.String("namespace", namespace), zap.Int("failures", obj.Failures), zap.Duration("delay", delay))
+	var retry func()
+	retry = func() {
+		if !t.current(key, generation) {
+			return
+		}
+		if t.paused() {
+			t.after(delay, retry)
+			return
+		}
+		resend()
+	}
+	t.after(delay, retry)
+}
+
+// Succeeded forgets an object once it's written, taking it out of the dead letters
+func (t *Tracker) Succeeded(kind, namespace, name string) {
+	t.Forget(kind, namespace, name)
+}
+
+// Forget drops an object's failures and pending retry without resending it, for when there's nothing left to write
+func (t *Tracker) Forget(kind, namespace, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := objectKey(kind, namespace, name)
+	if obj, ok := t.objects[key]; ok && obj.deadLettered {
+		metrics.DeadLetters.Add(-1)
+	}
+	delete(t.objects, key)
+}
+
+// DeadLetters lists the dead lettered objects, sorted by object key
+func (t *Tracker) DeadLetters() []DeadLetter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	deadLetters := []DeadLetter{}
+	for _, obj := range t.objects {
+		if obj.deadLettered {
+			deadLetters = append(deadLetters, obj.DeadLetter)
+		}
+	}
+	sort.Slice(deadLetters, func(i, j int) bool {
+		a, b := deadLetters[i], deadLetters[j]
+		return objectKey(a.Kind, a.Namespace, a.Name) < objectKey(b.Kind, b.Namespace, b.Name)
+	})
+	return deadLetters
+}
+
+// Replay takes an object out of the dead letters and resends its last failed request, with its failures reset.
+// Nothing is replayed while paused
+func (t *Tracker) Replay(kind, namespace, name string) error {
+	if t.paused() {
+		return ErrPaused
+	}
+	t.mu.Lock()
+	obj, ok := t.objects[objectKey(kind, namespace, name)]
+	if !ok || !obj.deadLettered {
+		t.mu.Unlock()
+		return ErrNotDeadLettered
+	}
+	resend := t.revive(obj)
+	t.mu.Unlock()
+	resend()
+	return nil
+}
+
+// ReplayAll replays every dead lettered object, and returns how many there were. Nothing is replayed while paused
+func (t *Tracker) ReplayAll() int {
+	if t.paused() {
+		return 0
+	}
+	t.mu.Lock()
+	resends := []func(){}
+	for _, obj := range t.objects {
+		if obj.deadLettered {
+			resends = append(resends, t.revive(obj))
+		}
+	}
+	t.mu.Unlock()
+	// Resends block until the writer picks them up, so they're sent without holding the lock
+	for _, resend := range resends {
+		resend()
+	}
+	return len(resends)
+}
+
+// Reset forgets everything, for when the writers the requests would be resent to are thrown away
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, obj := range t.objects {
+		if obj.deadLettered {
+			metrics.DeadLetters.Add(-1)
+		}
+	}
+	t.objects = map[string]*object{}
+}
+
+func (t *Tracker) revive(obj *object) func() {
+	obj.deadLettered = false
+	obj.Failures = 0
+	obj.generation++
+	metrics.DeadLetters.Add(-1)
+	return obj.resend
+}
+
+// SetPaused sets what pauses the retries. While it returns true, retries that are due wait another delay and dead
+// letters aren't replayed, like while the followers are expired
+func (t *Tracker) SetPaused(paused func() bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pausedFunc = paused
+}
+
+// Paused reports whether retries are paused
+func (t *Tracker) Paused() bool {
+	return t.paused()
+}
+
+// Called without holding the lock, since what pauses the retries can take its own
+func (t *Tracker) paused() bool {
+	t.mu.Lock()
+	paused := t.pausedFunc
+	t.mu.Unlock()
+	return paused != nil && paused()
+}
+
+func (t *Tracker) current(key string, generation int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	obj, ok := t.objects[key]
+	return ok && obj.generation == generation && !obj.deadLettered
+}
+
+// The delay doubles with every failure, up to the max
+func (t *Tracker) delay(failures int) time.Duration {
+	delay := t.BaseDelay
+	for i := 1; i < failures && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.MaxDelay {
+		delay = t.MaxDelay
+	}
+	return delay
+}
+
+func objectKey(kind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
@@ -0,0 +1,163 @@
+package retry
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Scheduled retries are collected instead of run in the background
+type scheduled struct {
+	delays  []time.Duration
+	retries []func()
+}
+
+func newTestTracker(maxFailures int) (*Tracker, *scheduled) {
+	tracker := New(maxFailures)
+	tracker.BaseDelay = time.Second
+	tracker.MaxDelay = 3 * time.Second
+	tracker.now = func() time.Time { return time.Date(2018, time.August, 1, 0, 0, 0, 0, time.UTC) }
+	s := &scheduled{}
+	tracker.after = func(delay time.Duration, f func()) {
+		s.delays = append(s.delays, delay)
+		s.retries = append(s.retries, f)
+	}
+	return tracker, s
+}
+
+func TestTrackerFailed(t *testing.T) {
+	tracker, s := newTestTracker(4)
+	resent := 0
+	resend := func() { resent++ }
+	for i := 0; i < 4; i++ {
+		tracker.Failed("services", "bar", "foo", errors.New("oh no"), resend)
+	}
+
+	// The delay doubles with every failure up to the max, and the last failure dead letters the object
+	expectedDelays := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	if !reflect.DeepEqual(expectedDelays, s.delays) {
+		t.Errorf("Expected delays: %v\ngot: %v", expectedDelays, s.delays)
+	}
+	expected := []DeadLetter{
+		DeadLetter{
+			Kind:            "services",
+			Namespace:       "bar",
+			Name:            "foo",
+			RemoteNamespace: "bar",
+			RemoteName:      "foo",
+			Failures:        4,
+			LastError:       "oh no",
+			Since:           time.Date(2018, time.August, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	if !reflect.DeepEqual(expected, tracker.DeadLetters()) {
+		t.Errorf("Expected dead letters: %+v\ngot: %+v", expected, tracker.DeadLetters())
+	}
+
+	// Retries that were superseded by a newer failure, or by the object being dead lettered, don't resend
+	for _, retry := range s.retries {
+		retry()
+	}
+	if resent != 0 {
+		t.Errorf("Expected resends: 0\ngot: %d", resent)
+	}
+}
+
+func TestTrackerRetry(t *testing.T) {
+	tracker, s := newTestTracker(4)
+	resent := 0
+	tracker.Failed("services", "bar", "foo", errors.New("oh no"), func() { resent++ })
+	s.retries[0]()
+	if resent != 1 {
+		t.Errorf("Expected resends: 1\ngot: %d", resent)
+	}
+
+	// A success cancels the pending retry
+	tracker.Failed("services", "bar", "foo", errors.New("oh no"), func() { resent++ })
+	tracker.Succeeded("services", "bar", "foo")
+	s.retries[1]()
+	if resent != 1 {
+		t.Errorf("Expected resends: 1\ngot: %d", resent)
+	}
+}
+
+func TestTrackerReplay(t *testing.T) {
+	tracker, _ := newTestTracker(1)
+	resent := []string{}
+	tracker.Failed("services", "bar", "foo", errors.New("oh no"), func() { resent = append(resent, "foo") })
+	tracker.Failed("services", "bar", "baz", errors.New("oh no"), func() { resent = append(resent, "baz") })
+
+	// Only dead letters can be replayed
+	if err := tracker.Replay("services", "bar", "nope"); err != ErrNotDeadLettered {
+		t.Errorf("Expected replay of an unknown object to fail\ngot: %v", err)
+	}
+	if err := tracker.Replay("services", "bar", "foo"); err != nil {
+		t.Errorf("Expected replay of a dead letter to succeed\ngot: %v", err)
+	}
+	if replayed := tracker.ReplayAll(); replayed != 1 {
+		t.Errorf("Expected replayed: 1\ngot: %d", replayed)
+	}
+	if !reflect.DeepEqual([]string{"foo", "baz"}, resent) {
+		t.Errorf("Expected resends: [foo baz]\ngot: %v", resent)
+	}
+	if deadLetters := tracker.DeadLetters(); len(deadLetters) != 0 {
+		t.Errorf("Expected no dead letters\ngot: %+v", deadLetters)
+	}
+}
+
+func TestTrackerForget(t *testing.T) {
+	tracker, s := newTestTracker(2)
+	resent := 0
+	resend := func() { resent++ }
+	tracker.FailedFrom("services", "bar", "foo", "remote-bar", "remote-foo", errors.New("oh no"), resend)
+	tracker.FailedFrom("services", "bar", "baz", "remote-bar", "remote-baz", errors.New("oh no"), resend)
+	tracker.FailedFrom("services", "bar", "baz", "remote-bar", "remote-baz", errors.New("oh no"), resend)
+
+	deadLetters := tracker.DeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].RemoteNamespace != "remote-bar" || deadLetters[0].RemoteName != "remote-baz" {
+		t.Errorf("Expected the baz dead letter from remote-bar/remote-baz\ngot: %+v", deadLetters)
+	}
+
+	// Forgotten objects are neither retried nor replayed
+	tracker.Forget("services", "bar", "foo")
+	tracker.Forget("services", "bar", "baz")
+	for _, retry := range s.retries {
+		retry()
+	}
+	if replayed := tracker.ReplayAll(); replayed != 0 {
+		t.Errorf("Expected replayed: 0\ngot: %d", replayed)
+	}
+	if resent != 0 {
+		t.Errorf("Expected resends: 0\ngot: %d", resent)
+	}
+}
+
+func TestTrackerPaused(t *testing.T) {
+	tracker, s := newTestTracker(1)
+	paused := true
+	tracker.SetPaused(func() bool { return paused })
+	resent := []string{}
+	tracker.Failed("services", "bar", "dead", errors.New("oh no"), func() { resent = append(resent, "dead") })
+	tracker.MaxFailures = 2
+	tracker.Failed("services", "bar", "foo", errors.New("oh no"), func() { resent = append(resent, "foo") })
+
+	// A retry that's due while paused waits another delay, and dead letters aren't replayed
+	s.retries[0]()
+	if replayed := tracker.ReplayAll(); replayed != 0 {
+		t.Errorf("Expected replayed: 0\ngot: %d", replayed)
+	}
+	if err := tracker.Replay("services", "bar", "dead"); err != ErrPaused {
+		t.Errorf("Expected replay to be refused while paused\ngot: %v", err)
+	}
+	if len(resent) != 0 || len(s.retries) != 2 || s.delays[1] != s.delays[0] {
+		t.Errorf("Expected the retry to be scheduled again after %v\ngot resends: %v, delays: %v", s.delays[0], resent, s.delays)
+	}
+
+	paused = false
+	s.retries[1]()
+	tracker.ReplayAll()
+	if !reflect.DeepEqual([]string{"foo", "dead"}, resent) {
+		t.Errorf("Expected resends: [foo dead]\ngot: %v", resent)
+	}
+}
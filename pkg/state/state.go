@@ -0,0 +1,231 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCleanerHistory = 10
+)
+
+var (
+	// Default is the tracker the controller records its state to
+	Default = New(defaultCleanerHistory)
+)
+
+// Export is a remote object the controller is watching
+type Export struct {
+	Kind            string    `json:"kind"`
+	Namespace       string    `json:"namespace"`
+	Name            string    `json:"name"`
+	ResourceVersion string    `json:"resourceVersion"`
+	LastEvent       string    `json:"lastEvent"`
+	LastSeen        time.Time `json:"lastSeen"`
+}
+
+// Follower is a local object the controller has written
+type Follower struct {
+	Kind       string    `json:"kind"`
+	Namespace  string    `json:"namespace"`
+	Name       string    `json:"name"`
+	LastAction string    `json:"lastAction"`
+	LastSync   time.Time `json:"lastSync"`
+	Synced     bool      `json:"synced"`
+}
+
+// ObjectError is the last error writing a local object
+type ObjectError struct {
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Action    string    `json:"action"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+// QueueItem is a request waiting for a writer
+type QueueItem struct {
+	Action    string    `json:"action"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Enqueued  time.Time `json:"enqueued"`
+}
+
+// CleanerResult is the outcome of a single cleaner pass
+type CleanerResult struct {
+	Started          time.Time `json:"started"`
+	Finished         time.Time `json:"finished"`
+	DeletedServices  []string  `json:"deletedServices"`
+	DeletedEndpoints []string  `json:"deletedEndpoints"`
+	Errors           []string  `json:"errors,omitempty"`
+}
+
+// Snapshot is a point in time copy of everything the tracker knows
+type Snapshot struct {
+	Exports   []Export               `json:"exports"`
+	Followers []Follower             `json:"followers"`
+	Errors    []ObjectError          `json:"errors"`
+	Queues    map[string][]QueueItem `json:"queues"`
+	Cleaner   []CleanerResult        `json:"cleaner"`
+}
+
+// Tracker keeps track of what the controller is doing, so it can be looked at while debugging
+type Tracker struct {
+	mu             sync.RWMutex
+	exports        map[string]Export
+	followers      map[string]Follower
+	errors         map[string]ObjectError
+	queues         map[string][]QueueItem
+	cleaner        []CleanerResult
+	cleanerHistory int
+}
+
+func New(cleanerHistory int) *Tracker {
+	return &Tracker{
+		exports:        map[string]Export{},
+		followers:      map[string]Follower{},
+		errors:         map[string]ObjectError{},
+		queues:         map[string][]QueueItem{},
+		cleanerHistory: cleanerHistory,
+	}
+}
+
+// RecordExport records an event for a remote object. Deleted objects are no longer tracked
+func (t *Tracker) RecordExport(kind, action, namespace, name, resourceVersion string, deleted bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := objectKey(kind, namespace, name)
+	if deleted {
+		delete(t.exports, key)
+		return
+	}
+	t.exports[key] = Export{
+		Kind:            kind,
+		Namespace:       namespace,
+		Name:            name,
+		ResourceVersion: resourceVersion,
+		LastEvent:       action,
+		LastSeen:        time.Now().UTC(),
+	}
+}
+
+// RecordWrite records the outcome of a write to a local object. Followers that were deleted are no longer tracked,
+// but their last error is kept
+func (t *Tracker) RecordWrite(kind, action, namespace, name string, deleted bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := objectKey(kind, namespace, name)
+	now := time.Now().UTC()
+	if err != nil {
+		t.errors[key] = ObjectError{
+			Kind:      kind,
+			Namespace: namespace,
+			Name:      name,
+			Action:    action,
+			Error:     err.Error(),
+			Time:      now,
+		}
+	}
+	if deleted && err == nil {
+		delete(t.followers, key)
+		return
+	}
+	follower := t.followers[key]
+	follower.Kind = kind
+	follower.Namespace = namespace
+	follower.Name = name
+	follower.LastAction = action
+	follower.Synced = err == nil
+	if err == nil {
+		follower.LastSync = now
+	}
+	t.followers[key] = follower
+}
+
+// Enqueue records a request that's about to be sent to a queue
+func (t *Tracker) Enqueue(queue, action, namespace, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queues[queue] = append(t.queues[queue], QueueItem{
+		Action:    action,
+		Namespace: namespace,
+		Name:      name,
+		Enqueued:  time.Now().UTC(),
+	})
+}
+
+// Dequeue records that the oldest request for a follower in a queue was picked up or dropped. Writers reorder their
+// queues by priority, so it isn't necessarily the oldest request in the queue
+func (t *Tracker) Dequeue(queue, namespace, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	items := t.queues[queue]
+	for i, item := range items {
+		if item.Namespace == namespace && item.Name == name {
+			t.queues[queue] = append(items[:i:i], items[i+1:]...)
+			return
+		}
+	}
+}
+
+// ResetQueues forgets every queued request, for when the queues themselves are thrown away
+func (t *Tracker) ResetQueues() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queues = map[string][]QueueItem{}
+}
+
+// RecordCleaner records the result of a cleaner pass, keeping only the most recent ones
+func (t *Tracker) RecordCleaner(result CleanerResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cleaner = append(t.cleaner, result)
+	if len(t.cleaner) > t.cleanerHistory {
+		t.cleaner = t.cleaner[len(t.cleaner)-t.cleanerHistory:]
+	}
+}
+
+// Snapshot copies the current state, sorted by object key so it's stable between calls
+func (t *Tracker) Snapshot() *Snapshot {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	snapshot := &Snapshot{
+		Exports:   []Export{},
+		Followers: []Follower{},
+		Errors:    []ObjectError{},
+		Queues:    map[string][]QueueItem{},
+		Cleaner:   append([]CleanerResult{}, t.cleaner...),
+	}
+	for _, export := range t.exports {
+		snapshot.Exports = append(snapshot.Exports, export)
+	}
+	sort.Slice(snapshot.Exports, func(i, j int) bool {
+		a, b := snapshot.Exports[i], snapshot.Exports[j]
+		return objectKey(a.Kind, a.Namespace, a.Name) < objectKey(b.Kind, b.Namespace, b.Name)
+	})
+	for _, follower := range t.followers {
+		snapshot.Followers = append(snapshot.Followers, follower)
+	}
+	sort.Slice(snapshot.Followers, func(i, j int) bool {
+		a, b := snapshot.Followers[i], snapshot.Followers[j]
+		return objectKey(a.Kind, a.Namespace, a.Name) < objectKey(b.Kind, b.Namespace, b.Name)
+	})
+	for _, objectErr := range t.errors {
+		snapshot.Errors = append(snapshot.Errors, objectErr)
+	}
+	sort.Slice(snapshot.Errors, func(i, j int) bool {
+		a, b := snapshot.Errors[i], snapshot.Errors[j]
+		return objectKey(a.Kind, a.Namespace, a.Name) < objectKey(b.Kind, b.Namespace, b.Name)
+	})
+	for queue, items := range t.queues {
+		snapshot.Queues[queue] = append([]QueueItem{}, items...)
+	}
+	return snapshot
+}
+
+func objectKey(kind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
@@ -0,0 +1,67 @@
+package state
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTrackerRecordWrite(t *testing.T) {
+	tracker := New(defaultCleanerHistory)
+	tracker.RecordWrite("services", "add", "bar", "foo", false, nil)
+	tracker.RecordWrite("services", "update", "bar", "foo", false, errors.New("oh no"))
+
+	snapshot := tracker.Snapshot()
+	if len(snapshot.Followers) != 1 {
+		t.Fatalf("Expected 1 follower, got %+v", snapshot.Followers)
+	}
+	follower := snapshot.Followers[0]
+	if follower.Synced || follower.LastAction != "update" || follower.LastSync.IsZero() {
+		t.Errorf("Expected an unsynced follower that was synced before, got %+v", follower)
+	}
+	if len(snapshot.Errors) != 1 || snapshot.Errors[0].Error != "oh no" {
+		t.Errorf("Expected the last error to be recorded, got %+v", snapshot.Errors)
+	}
+
+	// Deleting the follower stops tracking it, but keeps its last error
+	tracker.RecordWrite("services", "delete", "bar", "foo", true, nil)
+	snapshot = tracker.Snapshot()
+	if len(snapshot.Followers) != 0 {
+		t.Errorf("Expected no followers, got %+v", snapshot.Followers)
+	}
+	if len(snapshot.Errors) != 1 {
+		t.Errorf("Expected the last error to be kept, got %+v", snapshot.Errors)
+	}
+}
+
+func TestTrackerQueues(t *testing.T) {
+	tracker := New(defaultCleanerHistory)
+	tracker.Enqueue("services", "add", "bar", "foo")
+	tracker.Enqueue("services", "delete", "bar", "baz")
+	tracker.Enqueue("endpoints", "add", "bar", "foo")
+	tracker.Enqueue("services", "update", "bar", "foo")
+	// Picked up out of order
+	tracker.Dequeue("services", "bar", "baz")
+	tracker.Dequeue("services", "bar", "foo")
+	// Nothing is queued for it
+	tracker.Dequeue("services", "bar", "qux")
+
+	snapshot := tracker.Snapshot()
+	if len(snapshot.Queues["services"]) != 1 || snapshot.Queues["services"][0].Action != "update" {
+		t.Errorf("Expected only the last service request to be queued, got %+v", snapshot.Queues["services"])
+	}
+	if len(snapshot.Queues["endpoints"]) != 1 {
+		t.Errorf("Expected the endpoints request to be queued, got %+v", snapshot.Queues["endpoints"])
+	}
+}
+
+func TestTrackerRecordCleaner(t *testing.T) {
+	tracker := New(2)
+	for _, name := range []string{"a", "b", "c"} {
+		tracker.RecordCleaner(CleanerResult{DeletedServices: []string{name}})
+	}
+
+	snapshot := tracker.Snapshot()
+	if len(snapshot.Cleaner) != 2 || snapshot.Cleaner[0].DeletedServices[0] != "b" {
+		t.Errorf("Expected only the last 2 cleaner results, got %+v", snapshot.Cleaner)
+	}
+}